@@ -0,0 +1,342 @@
+package switcher
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/rpc"
+	"gopkg.in/yaml.v3"
+)
+
+// EffectScope selects whether effects are configured on a source or on a target.
+type EffectScope string
+
+const (
+	ScopeSource EffectScope = "source"
+	ScopeTarget EffectScope = "target"
+)
+
+// SourceInfo describes a configured source, as listed by the admin API.
+type SourceInfo struct {
+	Name string `json:"name"`
+	// DefaultTarget is the target the source connects to by default, if any.
+	DefaultTarget string           `json:"defaultTarget,omitempty"`
+	Effects       []map[string]any `json:"effects"`
+}
+
+// TargetInfo describes a configured target and its connection, as listed by the admin API.
+type TargetInfo struct {
+	RemoteStatus
+	Effects []map[string]any `json:"effects"`
+}
+
+// ConnectionInfo describes a connected source, as listed by the admin API.
+type ConnectionInfo struct {
+	ID         uint64 `json:"id"`
+	Source     string `json:"source"`
+	Target     string `json:"target"`
+	RemoteAddr string `json:"remoteAddr"`
+	Origin     string `json:"origin"`
+	Paused     bool   `json:"paused"`
+}
+
+// AdminAPI is served under the "admin" namespace, to control the switch at runtime.
+// Changes to effects apply to live routes right away,
+// but are not persisted: reloading the config file replaces them.
+//
+// Effects are passed in the same structure as in the YAML config, e.g.:
+//
+//	{"direction": "source-request", "filter": "^eth_", "drop": {"chance": 0.2}}
+type AdminAPI struct {
+	backend *Backend
+}
+
+// Sources lists the configured sources.
+func (api *AdminAPI) Sources() (map[string]*SourceInfo, error) {
+	cfg := api.backend.cfg.Load()
+	out := make(map[string]*SourceInfo, len(cfg.Sources))
+	for name, src := range cfg.Sources {
+		effects, err := effectViews(src.Effects)
+		if err != nil {
+			return nil, fmt.Errorf("source %q: %w", name, err)
+		}
+		out[name] = &SourceInfo{Name: name, DefaultTarget: cfg.Routes[name], Effects: effects}
+	}
+	return out, nil
+}
+
+// Targets lists the configured targets, and the state of their connections.
+func (api *AdminAPI) Targets() (map[string]*TargetInfo, error) {
+	ba := api.backend
+	ba.mu.Lock()
+	defer ba.mu.Unlock()
+	cfg := ba.cfg.Load()
+	out := make(map[string]*TargetInfo, len(cfg.Targets))
+	for name, target := range cfg.Targets {
+		effects, err := effectViews(target.Effects)
+		if err != nil {
+			return nil, fmt.Errorf("target %q: %w", name, err)
+		}
+		out[name] = &TargetInfo{RemoteStatus: ba.remotes[name].Status(), Effects: effects}
+	}
+	return out, nil
+}
+
+// Connections lists the connected sources, ordered by ID.
+func (api *AdminAPI) Connections() []*ConnectionInfo {
+	ba := api.backend
+	ba.mu.Lock()
+	defer ba.mu.Unlock()
+	out := make([]*ConnectionInfo, 0, len(ba.routes))
+	for id, ro := range ba.routes {
+		out = append(out, &ConnectionInfo{
+			ID:         id,
+			Source:     ro.sourceName,
+			Target:     ro.targetName,
+			RemoteAddr: ro.user.Meta.RemoteAddr,
+			Origin:     ro.user.Meta.Origin,
+			Paused:     ro.Paused(),
+		})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].ID < out[j].ID
+	})
+	return out
+}
+
+// AddEffect inserts an effect on the source or target, at the given index, or at the end if no index is given.
+// The index of the new effect is returned.
+func (api *AdminAPI) AddEffect(scope EffectScope, name string, effect json.RawMessage, index *int) (int, error) {
+	var at int
+	err := api.backend.editEffects(scope, name, func(effects []*Effect) ([]*Effect, error) {
+		at = len(effects)
+		if index != nil {
+			at = *index
+		}
+		if at < 0 || at > len(effects) {
+			return nil, fmt.Errorf("index %d out of range, have %d effects", at, len(effects))
+		}
+		ef, err := parseEffect(effect)
+		if err != nil {
+			return nil, err
+		}
+		return slices.Insert(effects, at, ef), nil
+	})
+	return at, err
+}
+
+// RemoveEffect removes the effect at the given index from the source or target.
+func (api *AdminAPI) RemoveEffect(scope EffectScope, name string, index int) error {
+	return api.backend.editEffects(scope, name, func(effects []*Effect) ([]*Effect, error) {
+		if index < 0 || index >= len(effects) {
+			return nil, fmt.Errorf("index %d out of range, have %d effects", index, len(effects))
+		}
+		return slices.Delete(effects, index, index+1), nil
+	})
+}
+
+// ReplaceEffect replaces the effect at the given index of the source or target.
+func (api *AdminAPI) ReplaceEffect(scope EffectScope, name string, index int, effect json.RawMessage) error {
+	return api.backend.editEffects(scope, name, func(effects []*Effect) ([]*Effect, error) {
+		if index < 0 || index >= len(effects) {
+			return nil, fmt.Errorf("index %d out of range, have %d effects", index, len(effects))
+		}
+		ef, err := parseEffect(effect)
+		if err != nil {
+			return nil, err
+		}
+		effects[index] = ef
+		return effects, nil
+	})
+}
+
+// SetEffects replaces all effects of the source or target. An empty list clears the effects.
+func (api *AdminAPI) SetEffects(scope EffectScope, name string, effects []json.RawMessage) error {
+	return api.backend.editEffects(scope, name, func([]*Effect) ([]*Effect, error) {
+		out := make([]*Effect, 0, len(effects))
+		for i, raw := range effects {
+			ef, err := parseEffect(raw)
+			if err != nil {
+				return nil, fmt.Errorf("effect %d: %w", i, err)
+			}
+			out = append(out, ef)
+		}
+		return out, nil
+	})
+}
+
+// PauseConnection holds all messages of the connection, until it is resumed.
+// A paused connection holds up to 1000 messages per direction. Beyond that, the source is no longer read,
+// and a target that keeps sending to the connection closes it.
+// HTTP sources have a connection per request, which ends with the request:
+// pausing it holds up that request until it times out.
+func (api *AdminAPI) PauseConnection(id uint64) error {
+	ro, err := api.backend.route(id)
+	if err != nil {
+		return err
+	}
+	ro.Pause()
+	return nil
+}
+
+// ResumeConnection releases the messages that were held while the connection was paused.
+func (api *AdminAPI) ResumeConnection(id uint64) error {
+	ro, err := api.backend.route(id)
+	if err != nil {
+		return err
+	}
+	ro.Resume()
+	return nil
+}
+
+// Disconnect closes the connection of the source.
+func (api *AdminAPI) Disconnect(id uint64) error {
+	ro, err := api.backend.route(id)
+	if err != nil {
+		return err
+	}
+	ro.log.Info("disconnecting source by admin request")
+	return ro.user.Close()
+}
+
+// route looks up a connected route by ID.
+func (ba *Backend) route(id uint64) (*Route, error) {
+	ba.mu.Lock()
+	defer ba.mu.Unlock()
+	ro, ok := ba.routes[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown connection %d", id)
+	}
+	return ro, nil
+}
+
+// editEffects replaces the effects of a source or target with the edited effects,
+// and applies the change to the live routes.
+// The edit function may modify the given slice, but not the effects in it.
+func (ba *Backend) editEffects(scope EffectScope, name string, edit func(effects []*Effect) ([]*Effect, error)) error {
+	ba.mu.Lock()
+	defer ba.mu.Unlock()
+	cfg := ba.cfg.Load().clone()
+	var current []*Effect
+	switch scope {
+	case ScopeSource:
+		src, ok := cfg.Sources[name]
+		if !ok {
+			return fmt.Errorf("unknown source %q", name)
+		}
+		current = src.Effects
+	case ScopeTarget:
+		target, ok := cfg.Targets[name]
+		if !ok {
+			return fmt.Errorf("unknown target %q", name)
+		}
+		current = target.Effects
+	default:
+		return fmt.Errorf("unknown scope %q, expected %q or %q", scope, ScopeSource, ScopeTarget)
+	}
+	next, err := edit(slices.Clone(current))
+	if err != nil {
+		return err
+	}
+	// effects that were added are seeded by their new position, the others keep their seed
+	for i, ef := range next {
+		if !slices.Contains(current, ef) {
+			ef.seedRand(cfg.seed, scope, name, i)
+		}
+	}
+	var retired []*Effect
+	for _, ef := range current {
+		if !slices.Contains(next, ef) {
+			retired = append(retired, ef)
+		}
+	}
+	switch scope {
+	case ScopeSource:
+		src := *cfg.Sources[name]
+		src.Effects = next
+		cfg.Sources[name] = &src
+	case ScopeTarget:
+		target := *cfg.Targets[name]
+		target.Effects = next
+		cfg.Targets[name] = &target
+	}
+	ba.log.Info("effects changed by admin request", "scope", scope, "name", name, "effects", len(next))
+	ba.swapConfig(cfg, retired)
+	return nil
+}
+
+// parseEffect decodes an effect, in the same structure as the YAML config, and initializes it.
+func parseEffect(data []byte) (*Effect, error) {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	var ef Effect
+	if err := dec.Decode(&ef); err != nil {
+		return nil, fmt.Errorf("failed to decode effect: %w", err)
+	}
+	if err := ef.Init(); err != nil {
+		return nil, err
+	}
+	return &ef, nil
+}
+
+// effectViews represents the effects in the same structure as the YAML config.
+func effectViews(effects []*Effect) ([]map[string]any, error) {
+	out := make([]map[string]any, 0, len(effects))
+	for i, ef := range effects {
+		data, err := yaml.Marshal(ef)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode effect %d: %w", i, err)
+		}
+		var v map[string]any
+		if err := yaml.Unmarshal(data, &v); err != nil {
+			return nil, fmt.Errorf("failed to decode effect %d: %w", i, err)
+		}
+		out = append(out, v)
+	}
+	return out, nil
+}
+
+// newAdminServer serves the AdminAPI.
+func newAdminServer(ba *Backend) *rpc.Server {
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("admin", &AdminAPI{backend: ba}); err != nil {
+		panic(fmt.Errorf("failed to register admin API: %w", err))
+	}
+	return srv
+}
+
+// adminAuth restricts access to the admin API, as configured.
+func (ba *Backend) adminAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := ba.cfg.Load()
+		if !originAllowed(cfg.Origins, r.Header.Get("Origin")) {
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			return
+		}
+		if status, err := authorize(r, cfg.AdminAuth, nil); err != nil {
+			ba.log.Warn("rejected unauthorized admin request", "remote", r.RemoteAddr, "err", err)
+			writeAuthError(w, cfg.AdminAuth, status, err)
+			return
+		}
+		addCorsHeader(w, r, cfg.Origins)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// adminHandler serves the admin RPC server over both HTTP and websocket.
+// Origins are checked by adminAuth.
+func adminHandler(srv *rpc.Server) http.Handler {
+	wsHandler := srv.WebsocketHandler([]string{"*"})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+			wsHandler.ServeHTTP(w, r)
+			return
+		}
+		srv.ServeHTTP(w, r)
+	})
+}
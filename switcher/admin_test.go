@@ -0,0 +1,135 @@
+package switcher
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/rpc"
+	jsonrpc "github.com/protolambda/jsonrpc2"
+)
+
+func startAdminTest(t *testing.T) (*Server, *rpc.Client) {
+	t.Helper()
+	srv := startServer(t, &Config{
+		Targets: map[string]*Target{"t": {Endpoint: startTarget(t)}},
+		Sources: map[string]*Source{"s": {}},
+		Routes:  map[string]string{"s": "t"},
+	})
+	admin, err := rpc.Dial("http://" + srv.Address() + "/admin")
+	if err != nil {
+		t.Fatalf("failed to dial admin API: %v", err)
+	}
+	t.Cleanup(admin.Close)
+	return srv, admin
+}
+
+func TestAdminEffects(t *testing.T) {
+	srv, admin := startAdminTest(t)
+	src := dialSource(t, srv, "/dial/s")
+	expectResult(t, call(t, src, request("1", "x", "")), "1", "x:1")
+
+	var index int
+	failing := json.RawMessage(`{"direction":"source-request","filter":"^x","error":{"chance":1,"code":-5,"message":"nope"}}`)
+	if err := admin.Call(&index, "admin_addEffect", "source", "s", failing); err != nil {
+		t.Fatal(err)
+	}
+	if index != 0 {
+		t.Errorf("expected effect at index 0, got %d", index)
+	}
+	resp := call(t, src, request("2", "x", ""))
+	if resp.Error == nil || resp.Error.Code != -5 {
+		t.Fatalf("expected error of the added effect, got %s", (&Envelope{Msg: *resp}).JSON())
+	}
+	expectResult(t, call(t, src, request("3", "y", "")), "3", "y:2")
+
+	if err := admin.Call(nil, "admin_addEffect", "target", "t", json.RawMessage(`{"bogus":1}`)); err == nil {
+		t.Fatal("expected invalid effect to be rejected")
+	}
+	if err := admin.Call(nil, "admin_removeEffect", "source", "s", 1); err == nil {
+		t.Fatal("expected out of range index to be rejected")
+	}
+
+	var sources map[string]*SourceInfo
+	if err := admin.Call(&sources, "admin_sources"); err != nil {
+		t.Fatal(err)
+	}
+	if s := sources["s"]; s == nil || s.DefaultTarget != "t" || len(s.Effects) != 1 || s.Effects[0]["filter"] != "^x" {
+		t.Fatalf("unexpected sources: %+v", sources)
+	}
+	var targets map[string]struct {
+		State   string           `json:"state"`
+		Routes  int              `json:"routes"`
+		Effects []map[string]any `json:"effects"`
+	}
+	if err := admin.Call(&targets, "admin_targets"); err != nil {
+		t.Fatal(err)
+	}
+	if tgt, ok := targets["t"]; !ok || tgt.State != "up" || tgt.Routes != 1 || len(tgt.Effects) != 0 {
+		t.Fatalf("unexpected targets: %+v", targets)
+	}
+
+	if err := admin.Call(nil, "admin_setEffects", "source", "s", []any{}); err != nil {
+		t.Fatal(err)
+	}
+	expectResult(t, call(t, src, request("4", "x", "")), "4", "x:3")
+}
+
+func TestAdminPauseAndDisconnect(t *testing.T) {
+	srv, admin := startAdminTest(t)
+	src := dialSource(t, srv, "/dial/s")
+	expectResult(t, call(t, src, request("1", "x", "")), "1", "x:1")
+
+	var conns []*ConnectionInfo
+	if err := admin.Call(&conns, "admin_connections"); err != nil {
+		t.Fatal(err)
+	}
+	if len(conns) != 1 || conns[0].Source != "s" || conns[0].Target != "t" || conns[0].Paused {
+		t.Fatalf("unexpected connections: %+v", conns)
+	}
+	id := conns[0].ID
+
+	if err := admin.Call(nil, "admin_pauseConnection", id); err != nil {
+		t.Fatal(err)
+	}
+	ro, err := srv.backend.route(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ro.Paused() {
+		t.Fatal("expected route to be paused")
+	}
+	// a paused route holds a limited number of messages, and then leaves the rest unread
+	total := maxHeld + cap(ro.user.inwards) + 10
+	go func() {
+		for i := range total {
+			if err := src.Write(request(jsonrpc.RawID(fmt.Sprint(i)), "held", "")); err != nil {
+				return
+			}
+		}
+	}()
+	eventually(t, func() bool { return len(ro.user.inwards) == cap(ro.user.inwards) })
+
+	if err := admin.Call(nil, "admin_resumeConnection", id); err != nil {
+		t.Fatal(err)
+	}
+	for i := range total {
+		resp := readMsg(t, src)
+		if resp.ID != jsonrpc.RawID(fmt.Sprint(i)) {
+			t.Fatalf("expected response %d, got %s", i, (&Envelope{Msg: *resp}).JSON())
+		}
+	}
+
+	if err := admin.Call(nil, "admin_disconnect", id); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.Read(new(jsonrpc.Message)); err == nil {
+		t.Fatal("expected the connection to close")
+	}
+	eventually(t, func() bool {
+		return admin.Call(&conns, "admin_connections") == nil && len(conns) == 0
+	})
+	if err := admin.Call(nil, "admin_pauseConnection", id); err == nil {
+		t.Fatal("expected unknown connection to be rejected")
+	}
+}
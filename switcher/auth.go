@@ -0,0 +1,125 @@
+package switcher
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Auth restricts who may connect.
+// If an IP allowlist is configured, the remote address must be in it.
+// If any credentials are configured, one of them must be presented.
+type Auth struct {
+	// Tokens are accepted as "Authorization: Bearer <token>" header.
+	Tokens []string `yaml:"tokens,omitempty"`
+	// Basic maps usernames to passwords, accepted with HTTP basic authentication.
+	Basic map[string]string `yaml:"basic,omitempty"`
+	// AllowIPs restricts the remote address to the given IPs and CIDR ranges, e.g. "10.0.0.0/8".
+	AllowIPs []string `yaml:"allowIPs,omitempty"`
+
+	allowed []netip.Prefix
+}
+
+func (a *Auth) Init() error {
+	a.allowed = nil
+	for _, v := range a.AllowIPs {
+		if strings.Contains(v, "/") {
+			p, err := netip.ParsePrefix(v)
+			if err != nil {
+				return fmt.Errorf("invalid CIDR range %q: %w", v, err)
+			}
+			a.allowed = append(a.allowed, p.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(v)
+		if err != nil {
+			return fmt.Errorf("invalid IP %q: %w", v, err)
+		}
+		addr = addr.Unmap()
+		a.allowed = append(a.allowed, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return nil
+}
+
+// checkIP verifies the remote address of the request is allowed.
+func (a *Auth) checkIP(r *http.Request) error {
+	if len(a.allowed) == 0 {
+		return nil
+	}
+	addrPort, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return fmt.Errorf("unknown remote address %q", r.RemoteAddr)
+	}
+	addr := addrPort.Addr().Unmap()
+	for _, p := range a.allowed {
+		if p.Contains(addr) {
+			return nil
+		}
+	}
+	return fmt.Errorf("remote address %s is not allowed", addr)
+}
+
+// hasCredentials checks if any credentials are configured.
+func (a *Auth) hasCredentials() bool {
+	return len(a.Tokens) > 0 || len(a.Basic) > 0
+}
+
+// checkCredentials verifies the request presents one of the configured credentials.
+func (a *Auth) checkCredentials(r *http.Request) bool {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token := strings.TrimPrefix(auth, "Bearer ")
+		for _, t := range a.Tokens {
+			if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+				return true
+			}
+		}
+	}
+	if user, pass, ok := r.BasicAuth(); ok {
+		if expected, ok := a.Basic[user]; ok && subtle.ConstantTimeCompare([]byte(expected), []byte(pass)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize checks the request against the auth config and JWT secret, both optional.
+// A valid JWT is accepted as credential, next to the configured credentials.
+// If the request is rejected, the HTTP status to respond with is returned with the reason.
+func authorize(r *http.Request, auth *Auth, jwtSecret []byte) (status int, err error) {
+	credentials := jwtSecret != nil
+	if auth != nil {
+		if err := auth.checkIP(r); err != nil {
+			return http.StatusForbidden, err
+		}
+		if auth.hasCredentials() {
+			if auth.checkCredentials(r) {
+				return http.StatusOK, nil
+			}
+			credentials = true
+		}
+	}
+	if !credentials {
+		return http.StatusOK, nil
+	}
+	if jwtSecret != nil {
+		err := verifyJWT(jwtSecret, r)
+		if err == nil {
+			return http.StatusOK, nil
+		}
+		if auth == nil || !auth.hasCredentials() {
+			return http.StatusUnauthorized, err
+		}
+	}
+	return http.StatusUnauthorized, errors.New("missing or invalid credentials")
+}
+
+// writeAuthError responds to a rejected request.
+func writeAuthError(w http.ResponseWriter, auth *Auth, status int, err error) {
+	if status == http.StatusUnauthorized && auth != nil && len(auth.Basic) > 0 {
+		w.Header().Set("WWW-Authenticate", `Basic realm="switcheroo"`)
+	}
+	http.Error(w, err.Error(), status)
+}
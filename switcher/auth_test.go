@@ -0,0 +1,71 @@
+package switcher
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestAuth(t *testing.T) {
+	srv := startServer(t, &Config{
+		Targets: map[string]*Target{"t": {Endpoint: startTarget(t)}},
+		Sources: map[string]*Source{
+			"tok":   {Auth: &Auth{Tokens: []string{"secret"}}},
+			"basic": {Auth: &Auth{Basic: map[string]string{"bob": "pw"}}},
+			"ip":    {Auth: &Auth{AllowIPs: []string{"10.0.0.0/8"}}},
+			"local": {Auth: &Auth{AllowIPs: []string{"127.0.0.1"}}},
+			"open":  {},
+		},
+		Routes:    map[string]string{"tok": "t", "basic": "t", "ip": "t", "local": "t", "open": "t"},
+		Origins:   []string{"https://ok.example"},
+		AdminAuth: &Auth{Tokens: []string{"adm"}},
+	})
+	body := `{"jsonrpc":"2.0","id":1,"method":"a"}`
+	for _, tc := range []struct {
+		name   string
+		method string
+		path   string
+		header map[string]string
+		status int
+		// allowOrigin is the expected CORS header
+		allowOrigin string
+	}{
+		{"no token", "POST", "/dial/tok", nil, http.StatusUnauthorized, ""},
+		{"wrong token", "POST", "/dial/tok", map[string]string{"Authorization": "Bearer nope"}, http.StatusUnauthorized, ""},
+		{"token", "POST", "/dial/tok", map[string]string{"Authorization": "Bearer secret"}, http.StatusOK, ""},
+		{"no basic", "POST", "/dial/basic", nil, http.StatusUnauthorized, ""},
+		{"basic", "POST", "/dial/basic", map[string]string{"Authorization": "Basic Ym9iOnB3"}, http.StatusOK, ""},
+		{"ip denied", "POST", "/dial/ip", nil, http.StatusForbidden, ""},
+		{"ip allowed", "POST", "/dial/local", nil, http.StatusOK, ""},
+		{"origin denied", "POST", "/dial/open", map[string]string{"Origin": "https://evil.example"}, http.StatusForbidden, ""},
+		{"origin allowed", "POST", "/dial/open", map[string]string{"Origin": "https://ok.example"}, http.StatusOK, "https://ok.example"},
+		{"admin denied", "POST", "/admin", map[string]string{"Content-Type": "application/json"}, http.StatusUnauthorized, ""},
+		{"admin", "POST", "/admin", map[string]string{"Authorization": "Bearer adm", "Content-Type": "application/json"}, http.StatusOK, ""},
+		{"targets denied", "GET", "/targets", nil, http.StatusUnauthorized, ""},
+		{"targets", "GET", "/targets", map[string]string{"Authorization": "Bearer adm", "Origin": "https://ok.example"}, http.StatusOK, "https://ok.example"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest(tc.method, "http://"+srv.Address()+tc.path, strings.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range tc.header {
+				req.Header.Set(k, v)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = resp.Body.Close()
+			if resp.StatusCode != tc.status {
+				t.Fatalf("expected status %d, got %d", tc.status, resp.StatusCode)
+			}
+			if got := resp.Header.Get("Access-Control-Allow-Origin"); got != tc.allowOrigin {
+				t.Errorf("expected allowed origin %q, got %q", tc.allowOrigin, got)
+			}
+			if challenge := resp.Header.Get("WWW-Authenticate"); (tc.path == "/dial/basic" && tc.status == http.StatusUnauthorized) != (challenge != "") {
+				t.Errorf("unexpected authentication challenge %q", challenge)
+			}
+		})
+	}
+}
@@ -1,49 +1,192 @@
 package switcher
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rpc"
 	"github.com/protolambda/websocket"
 )
 
+// drainTimeout is how long the effects of a replaced config may keep processing
+// the messages that entered them before the reload, before the effects are closed.
+const drainTimeout = 30 * time.Second
+
 type Backend struct {
 	log log.Logger
 
 	wsSrv *websocket.Server[*User]
 
-	cfg *Config
+	cfg atomic.Pointer[Config]
+
+	// mu protects the remotes and routes,
+	// and serializes config reloads with the setup of new routes.
+	mu          sync.Mutex
+	remotes     map[string]*Remote
+	routes      map[uint64]*Route
+	nextRouteID uint64
+	// routeOrdinals counts the routes of every source and target pair, to label their random streams
+	routeOrdinals map[routeKey]uint64
+	// ipc listeners, by source name
+	ipc map[string]*ipcListener
+	// captures are the open capture files, by path
+	captures map[string]*captureFile
 
 	acceptNew atomic.Bool
 
+	// admin serves the AdminAPI
+	admin *rpc.Server
+
+	metrics *metrics
+
+	// taps stream the messages that cross the switch
+	taps   *tapHub
+	tapSrv *websocket.Server[*tap]
+
 	mux *http.ServeMux
 }
 
 func NewBackend(log log.Logger, cfg *Config) *Backend {
 	mux := http.NewServeMux()
 	backend := &Backend{
-		log:   log,
-		cfg:   cfg,
-		wsSrv: nil,
-		mux:   mux,
+		log:           log,
+		wsSrv:         nil,
+		remotes:       make(map[string]*Remote),
+		routes:        make(map[uint64]*Route),
+		routeOrdinals: make(map[routeKey]uint64),
+		ipc:           make(map[string]*ipcListener),
+		captures:      make(map[string]*captureFile),
+		taps:          newTapHub(),
+		mux:           mux,
+	}
+	backend.cfg.Store(cfg)
+	for name, target := range cfg.Targets {
+		backend.remotes[name] = NewRemote(log.With("target", name), name, target)
+	}
+	mux.Handle("GET /targets", backend.adminAuth(http.HandlerFunc(backend.handleTargets)))
+	mux.HandleFunc("GET /dial/{source}", backend.handleDial)
+	mux.HandleFunc("GET /dial/{source}/{target}", backend.handleDial)
+	mux.HandleFunc("POST /dial/{source}", backend.handleHTTP)
+	mux.HandleFunc("POST /dial/{source}/{target}", backend.handleHTTP)
+	backend.metrics = newMetrics(backend)
+	mux.Handle("GET /metrics", backend.metrics.handler())
+	backend.admin = newAdminServer(backend)
+	mux.Handle("/admin", backend.adminAuth(adminHandler(backend.admin)))
+	mux.Handle("GET /tap", backend.adminAuth(http.HandlerFunc(backend.handleTap)))
+	for _, path := range []string{"/targets", "/dial/{source}", "/dial/{source}/{target}", "/admin"} {
+		mux.HandleFunc("OPTIONS "+path, backend.handlePreflight)
 	}
-	mux.HandleFunc("GET /dial/{name}", backend.handleDial)
 	backend.initWebsocketServer()
+	backend.initTapServer()
 	backend.acceptNew.Store(true)
 	return backend
 }
 
 func (ba *Backend) Start() error {
-	// TODO dial each endpoint
-
-	// TODO start running all of the config effect routines
+	if err := ba.cfg.Load().Init(); err != nil {
+		return fmt.Errorf("failed to init effects: %w", err)
+	}
+	ba.mu.Lock()
+	defer ba.mu.Unlock()
+	if _, err := ba.updateCaptures(ba.cfg.Load()); err != nil {
+		return fmt.Errorf("failed to open capture files: %w", err)
+	}
+	for _, r := range ba.remotes {
+		r.Start()
+	}
+	if err := ba.updateIPC(ba.cfg.Load()); err != nil {
+		return fmt.Errorf("failed to expose sources over IPC: %w", err)
+	}
+	return nil
+}
 
+// Reload swaps in the new config.
+// The effects of live routes are replaced, without closing any of the connections,
+// except for the routes of which the source or target was removed from the config.
+// If the new config is invalid, the old config stays in place.
+func (ba *Backend) Reload(cfg *Config) error {
+	if err := cfg.Check(); err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+	if err := cfg.Init(); err != nil {
+		_ = cfg.Close()
+		return fmt.Errorf("failed to init effects: %w", err)
+	}
+	ba.mu.Lock()
+	defer ba.mu.Unlock()
+	ba.swapConfig(cfg, ba.cfg.Load().effects())
 	return nil
 }
 
+// swapConfig makes the initialized config current, and updates the remotes and routes to match it.
+// Routes are only reloaded if their source or target changed.
+// The retired effects, and the capture files that are no longer used,
+// are closed once the pipelines that ran them are drained.
+// The caller must hold the lock.
+func (ba *Backend) swapConfig(cfg *Config, retired []*Effect) {
+	ba.cfg.Store(cfg)
+
+	for name, r := range ba.remotes {
+		if target, ok := cfg.Targets[name]; ok {
+			r.Reconfigure(target)
+			continue
+		}
+		ba.log.Info("target was removed, closing it", "target", name)
+		if err := r.Close(); err != nil {
+			ba.log.Warn("failed to close removed target", "target", name, "err", err)
+		}
+		delete(ba.remotes, name)
+	}
+	for name, target := range cfg.Targets {
+		if _, ok := ba.remotes[name]; !ok {
+			r := NewRemote(ba.log.With("target", name), name, target)
+			r.Start()
+			ba.remotes[name] = r
+		}
+	}
+
+	if err := ba.updateIPC(cfg); err != nil {
+		ba.log.Warn("failed to update IPC listeners", "err", err)
+	}
+	retiredCaptures, err := ba.updateCaptures(cfg)
+	if err != nil {
+		ba.log.Warn("failed to update capture files", "err", err)
+	}
+
+	var draining []*pipeline
+	for _, ro := range ba.routes {
+		src, target, err := cfg.Route(ro.sourceName, ro.targetName)
+		if err != nil {
+			ro.log.Info("route was removed, closing it", "err", err)
+			if err := ro.user.Close(); err != nil {
+				ro.log.Warn("failed to close source connection", "err", err)
+			}
+			draining = append(draining, ro.up, ro.down)
+			continue
+		}
+		if src == ro.src && target == ro.target {
+			continue
+		}
+		draining = append(draining, ro.Reload(src, target)...)
+	}
+	go func() {
+		waitPipelines(draining, time.After(drainTimeout))
+		if err := closeEffects(retired); err != nil {
+			ba.log.Warn("failed to close retired effects", "err", err)
+		}
+		if err := closeCaptures(retiredCaptures); err != nil {
+			ba.log.Warn("failed to close retired capture files", "err", err)
+		}
+	}()
+	ba.log.Info("applied config", "routes", len(ba.routes))
+}
+
 func (ba *Backend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ba.mux.ServeHTTP(w, r)
 }
@@ -51,11 +194,33 @@ func (ba *Backend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 // Close closes all users, and stops the backend from accepting new users.
 func (ba *Backend) Close() error {
 	ba.acceptNew.Store(false)
+	ba.admin.Stop()
 	var result error
-	ba.wsSrv.Range(func(e *User) bool {
-		result = errors.Join(result, e.Close())
+	ba.tapSrv.Range(func(t *tap) bool {
+		result = errors.Join(result, t.conn.Close())
 		return true
 	})
+	ba.mu.Lock()
+	defer ba.mu.Unlock()
+	for name, l := range ba.ipc {
+		result = errors.Join(result, l.ln.Close())
+		delete(ba.ipc, name)
+	}
+	var draining []*pipeline
+	for _, ro := range ba.routes {
+		result = errors.Join(result, ro.user.Close())
+		draining = append(draining, ro.up, ro.down)
+	}
+	for _, r := range ba.remotes {
+		result = errors.Join(result, r.Close())
+	}
+	// the pipelines record the messages they drop as they shut down, before the capture files close
+	waitPipelines(draining, time.After(drainTimeout))
+	for path, f := range ba.captures {
+		result = errors.Join(result, f.Close())
+		delete(ba.captures, path)
+	}
+	result = errors.Join(result, ba.cfg.Load().Close())
 	return result
 }
 
@@ -64,15 +229,24 @@ func (ba *Backend) initWebsocketServer() {
 		if !ba.acceptNew.Load() {
 			return nil, errors.New("not accepting new users")
 		}
-		name := GetName(meta.Context)
-		if name == "" {
-			return nil, fmt.Errorf("cannot upgrade user %s without name", meta.RemoteAddr)
+		sourceName, targetName := GetRoute(meta.Context)
+		if sourceName == "" || targetName == "" {
+			return nil, fmt.Errorf("cannot upgrade user %s without route", meta.RemoteAddr)
+		}
+		// Hold the lock, so the route is not missed by a concurrent config reload.
+		ba.mu.Lock()
+		defer ba.mu.Unlock()
+		src, target, err := ba.cfg.Load().Route(sourceName, targetName)
+		if err != nil {
+			return nil, err
 		}
 
 		ba.log.Info("new WS JSON RPC connection to provider",
-			"remote", meta.RemoteAddr, "origin", meta.Origin, "name", name)
+			"remote", meta.RemoteAddr, "origin", meta.Origin, "source", sourceName, "target", targetName)
 
-		out := NewUser(ba.log.With("name", name), c, meta, name)
+		logger := ba.log.With("source", sourceName, "target", targetName)
+		out := NewUser(logger, c, meta, sourceName, src)
+		ba.startRoute(logger, out, targetName, src, target)
 
 		return out, nil
 	}, websocket.WithOnDisconnect(func(e *User) {
@@ -80,7 +254,7 @@ func (ba *Backend) initWebsocketServer() {
 		ba.log.Info("disconnected websocket",
 			"remote", e.Meta.RemoteAddr, "origin", e.Meta.Origin)
 	}), websocket.WithCheckOrigin[*User](func(r *http.Request) bool {
-		return true
+		return originAllowed(ba.cfg.Load().Origins, r.Header.Get("Origin"))
 	}), websocket.WithOnUpgradeFailed[*User](func(r *http.Request, err error) {
 		ba.log.Warn("failed to upgrade websocket",
 			"origin", r.Header.Get("Origin"),
@@ -88,15 +262,97 @@ func (ba *Backend) initWebsocketServer() {
 	}))
 }
 
+// routeKey identifies the routes between a source and a target.
+type routeKey struct {
+	source, target string
+}
+
+// startRoute starts a route between the user and the target, and tracks it until the user disconnects.
+// The caller must hold the lock.
+func (ba *Backend) startRoute(logger log.Logger, user *User, targetName string, src *Source, target *Target) *Route {
+	ba.nextRouteID += 1
+	id := ba.nextRouteID
+	key := routeKey{source: user.name, target: targetName}
+	ba.routeOrdinals[key] += 1
+	route := NewRoute(logger.With("route", id), id, ba.routeOrdinals[key], user, ba.remotes[targetName], ba.metrics, ba.taps)
+	route.Start(src, target)
+	ba.routes[id] = route
+	connections := ba.metrics.connections.WithLabelValues(user.name, targetName)
+	connections.Inc()
+	go func() {
+		<-user.Conn.CloseCtx().Done()
+		connections.Dec()
+		ba.mu.Lock()
+		defer ba.mu.Unlock()
+		delete(ba.routes, id)
+	}()
+	return route
+}
+
+// dialRoute determines the source and target names of a dial request, and authenticates it.
+// If the route is unknown, or the request is not authorized, an HTTP error is written, and ok is false.
+func (ba *Backend) dialRoute(w http.ResponseWriter, r *http.Request) (sourceName, targetName string, ok bool) {
+	sourceName = r.PathValue("source")
+	targetName = r.PathValue("target")
+	cfg := ba.cfg.Load()
+	if _, ok := cfg.Sources[sourceName]; ok && targetName == "" {
+		targetName = cfg.Routes[sourceName]
+		if targetName == "" {
+			http.Error(w, fmt.Sprintf("source %q has no default route, a target must be specified", sourceName), http.StatusNotFound)
+			return "", "", false
+		}
+	}
+	src, _, err := cfg.Route(sourceName, targetName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return "", "", false
+	}
+	if status, err := authorize(r, src.Auth, src.jwtSecret); err != nil {
+		ba.log.Warn("rejected unauthorized dial", "source", sourceName, "remote", r.RemoteAddr, "err", err)
+		writeAuthError(w, src.Auth, status, err)
+		return "", "", false
+	}
+	return sourceName, targetName, true
+}
+
 func (ba *Backend) handleDial(w http.ResponseWriter, r *http.Request) {
-	addCorsHeader(w)
+	addCorsHeader(w, r, ba.cfg.Load().Origins)
 	ctx := r.Context()
-	name := r.PathValue("name")
-	// Attach name to context,
+	// Reject unknown routes before upgrading, so the caller gets a clear HTTP error.
+	sourceName, targetName, ok := ba.dialRoute(w, r)
+	if !ok {
+		return
+	}
+	// Attach route to context,
 	// so the websocket handler knows how this upgrade-request came to be.
-	r = r.WithContext(WithName(ctx, name))
+	r = r.WithContext(WithRoute(ctx, sourceName, targetName))
 
-	ba.log.Info("Upgrading to websocket", "name", name)
+	ba.log.Info("Upgrading to websocket", "source", sourceName, "target", targetName)
 	ba.wsSrv.Handle(w, r)
-	ba.log.Info("websocket stopped", "name", name)
+	ba.log.Info("websocket stopped", "source", sourceName, "target", targetName)
+}
+
+// handlePreflight answers CORS preflight requests of browsers.
+func (ba *Backend) handlePreflight(w http.ResponseWriter, r *http.Request) {
+	origins := ba.cfg.Load().Origins
+	if !originAllowed(origins, r.Header.Get("Origin")) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	addCorsHeader(w, r, origins)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleTargets lists the status of the targets. Access is restricted by adminAuth.
+func (ba *Backend) handleTargets(w http.ResponseWriter, r *http.Request) {
+	ba.mu.Lock()
+	out := make(map[string]RemoteStatus, len(ba.remotes))
+	for name, r := range ba.remotes {
+		out[name] = r.Status()
+	}
+	ba.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(out); err != nil {
+		ba.log.Warn("failed to write targets status", "err", err)
+	}
 }
@@ -0,0 +1,96 @@
+package switcher
+
+import (
+	"testing"
+	"time"
+
+	jsonrpc "github.com/protolambda/jsonrpc2"
+)
+
+func reloadTestConfig(endpoint string, effects ...*Effect) *Config {
+	return &Config{
+		Targets: map[string]*Target{"t": {Endpoint: endpoint, Effects: effects}},
+		Sources: map[string]*Source{"s": {}},
+		Routes:  map[string]string{"s": "t"},
+	}
+}
+
+func TestReloadEffects(t *testing.T) {
+	endpoint := startTarget(t)
+	failing := func() *Effect {
+		return &Effect{Error: &ErrorEffect{Chance: 1, Code: -1, Message: "boom"}}
+	}
+	srv := startServer(t, reloadTestConfig(endpoint, failing()))
+	rpc := dialSource(t, srv, "/dial/s")
+
+	expectError := func(id string) {
+		t.Helper()
+		resp := call(t, rpc, request(jsonrpc.RawID(id), "x", ""))
+		if resp.Error == nil || resp.Error.Message != "boom" {
+			t.Fatalf("expected error of the effect, got %s", (&Envelope{Msg: *resp}).JSON())
+		}
+	}
+	expectError("1")
+
+	if err := srv.Reload(reloadTestConfig(endpoint)); err != nil {
+		t.Fatal(err)
+	}
+	expectResult(t, call(t, rpc, request("2", "x", "")), "2", "x:1")
+
+	bad := reloadTestConfig(endpoint, failing())
+	bad.Routes["s"] = "unknown"
+	if err := srv.Reload(bad); err == nil {
+		t.Fatal("expected invalid config to be rejected")
+	}
+	expectResult(t, call(t, rpc, request("3", "x", "")), "3", "x:2")
+
+	if err := srv.Reload(reloadTestConfig(endpoint, failing())); err != nil {
+		t.Fatal(err)
+	}
+	expectError("4")
+}
+
+func TestReloadClosesRemovedRoutes(t *testing.T) {
+	endpoint := startTarget(t)
+	srv := startServer(t, reloadTestConfig(endpoint))
+	rpc := dialSource(t, srv, "/dial/s")
+	expectResult(t, call(t, rpc, request("1", "x", "")), "1", "x:1")
+
+	cfg := reloadTestConfig(endpoint)
+	delete(cfg.Sources, "s")
+	delete(cfg.Routes, "s")
+	if err := srv.Reload(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := rpc.Read(new(jsonrpc.Message)); err == nil {
+		t.Fatal("expected the connection of the removed source to close")
+	}
+}
+
+// A route that is stuck on a slow effect must not hold up the reload, or the routes after it.
+func TestReloadBusyRoute(t *testing.T) {
+	endpoint := startTarget(t)
+	stuck := &Effect{RateLimit: &RateLimitEffect{Rate: 0.001, Burst: 1}}
+	srv := startServer(t, reloadTestConfig(endpoint, stuck))
+	rpc := dialSource(t, srv, "/dial/s")
+	// fill up the effect, until the pump blocks on it
+	for range 2 * matchedBuffer {
+		if err := rpc.Write(&jsonrpc.Message{Request: &jsonrpc.Request{Method: "x"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	reloaded := make(chan error, 1)
+	go func() { reloaded <- srv.Reload(reloadTestConfig(endpoint)) }()
+	select {
+	case err := <-reloaded:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("reload blocked on a busy route")
+	}
+	// the notification that was blocked enters the new pipeline, and so does the request after it
+	expectResult(t, call(t, rpc, request("1", "x", "")), "1", "x:1")
+}
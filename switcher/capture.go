@@ -0,0 +1,358 @@
+package switcher
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultCaptureMaxSize is the size at which capture files are rotated, if not configured.
+	defaultCaptureMaxSize = 100 * 1024 * 1024
+	// defaultCaptureMaxFiles is the number of rotated capture files that are kept, if not configured.
+	defaultCaptureMaxFiles = 5
+)
+
+// Capture records every message of the routes of a source or target to a JSONL file,
+// one CaptureRecord per line.
+type Capture struct {
+	// Path of the capture file. Records are appended to an existing file.
+	// Sources and targets may share a capture file, if they configure it the same.
+	Path string `yaml:"path"`
+	// MaxSize is the size in bytes at which the capture file is rotated. Defaults to 100 MiB.
+	MaxSize int64 `yaml:"maxSize,omitempty"`
+	// MaxFiles is the number of rotated files that are kept, named path.1, path.2, etc.,
+	// with path.1 the most recent. Defaults to 5.
+	MaxFiles int `yaml:"maxFiles,omitempty"`
+
+	// file is opened by the backend, and shared by all captures with the same path.
+	file *captureFile
+}
+
+func (c *Capture) maxSize() int64 {
+	if c.MaxSize <= 0 {
+		return defaultCaptureMaxSize
+	}
+	return c.MaxSize
+}
+
+func (c *Capture) maxFiles() int {
+	if c.MaxFiles <= 0 {
+		return defaultCaptureMaxFiles
+	}
+	return c.MaxFiles
+}
+
+// CaptureOutcome describes what the switch did with a captured message.
+type CaptureOutcome string
+
+const (
+	// CaptureForwarded messages passed through the effects unchanged.
+	CaptureForwarded CaptureOutcome = "forwarded"
+	// CaptureAltered messages were modified by an effect, before they were passed on.
+	CaptureAltered CaptureOutcome = "altered"
+	// CaptureDropped messages were discarded by an effect.
+	CaptureDropped CaptureOutcome = "dropped"
+	// CaptureAnswered requests were answered by an effect, instead of being passed on.
+	CaptureAnswered CaptureOutcome = "answered"
+	// CaptureInjected messages were created by an effect, e.g. the answer to a request.
+	CaptureInjected CaptureOutcome = "injected"
+	// CaptureCorrupted messages were passed on as a malformed frame, by a corrupt effect.
+	CaptureCorrupted CaptureOutcome = "corrupted"
+)
+
+// CaptureRecord is a line of a capture file.
+type CaptureRecord struct {
+	// Time the outcome of the message was decided, e.g. when it left the switch.
+	Time time.Time `json:"time"`
+	// Entered is the time the message entered the effects of the route.
+	Entered time.Time `json:"entered"`
+	// Route is the ID of the connection, as listed by the admin API.
+	Route  uint64 `json:"route"`
+	Source string `json:"source"`
+	Target string `json:"target"`
+	// Direction is the kind of message and the way it travels, e.g. "source-request".
+	Direction Direction `json:"direction"`
+	// Method of the request, or of the request that is responded to, if known.
+	Method  string         `json:"method,omitempty"`
+	Outcome CaptureOutcome `json:"outcome"`
+	// Effects lists the kinds of the effects that applied to the message, in order, e.g. "delay".
+	Effects []string `json:"effects,omitempty"`
+	// Msg is the message as it left the switch,
+	// or as it entered the switch if it was dropped or answered.
+	// Corrupted messages that are not valid JSON are recorded as JSON string.
+	Msg json.RawMessage `json:"msg"`
+	// Original is the message as it entered the switch, if it was altered or corrupted.
+	Original json.RawMessage `json:"original,omitempty"`
+}
+
+// captureTrace follows a message through the effects of a route,
+// to capture its outcome, and to show it to the taps.
+type captureTrace struct {
+	files    []*captureFile
+	taps     *tapHub
+	route    *Route
+	entered  time.Time
+	original json.RawMessage
+	injected bool
+	// effects that applied to the message so far
+	effects []string
+
+	once sync.Once
+}
+
+func newCaptureTrace(files []*captureFile, taps *tapHub, route *Route, em *Envelope, injected bool) *captureTrace {
+	return &captureTrace{
+		files:    files,
+		taps:     taps,
+		route:    route,
+		entered:  time.Now(),
+		original: captureJSON(em),
+		injected: injected,
+	}
+}
+
+// record writes the outcome of the message to the capture files, and publishes it to the taps.
+// Only the first outcome is recorded.
+// The outcome of a message that is passed on is derived from whether it was injected or altered.
+func (t *captureTrace) record(em *Envelope, outcome CaptureOutcome) {
+	t.once.Do(func() {
+		rec := &CaptureRecord{
+			Time:      time.Now(),
+			Entered:   t.entered,
+			Route:     t.route.id,
+			Source:    t.route.sourceName,
+			Target:    t.route.targetName,
+			Direction: MessageDirection(em.Msg.Request != nil, em.FromSource),
+			Method:    em.Method(),
+			Outcome:   outcome,
+			Effects:   t.effects,
+			Msg:       t.original,
+		}
+		if outcome == CaptureForwarded {
+			msg := captureJSON(em)
+			rec.Msg = msg
+			if em.corrupt != nil {
+				rec.Outcome = CaptureCorrupted
+				rec.Msg = captureFrame(em.corrupt.apply(msg))
+				rec.Original = t.original
+			} else if t.injected {
+				rec.Outcome = CaptureInjected
+			} else if !bytes.Equal(msg, t.original) {
+				rec.Outcome = CaptureAltered
+				rec.Original = t.original
+			}
+		}
+		for _, f := range t.files {
+			if err := f.write(rec); err != nil {
+				t.route.log.Warn("failed to capture message", "path", f.path, "err", err)
+			}
+		}
+		if t.taps.active() {
+			t.taps.publish(rec)
+		}
+	})
+}
+
+// captureJSON encodes the message of the envelope, or null if it cannot be encoded.
+func captureJSON(em *Envelope) json.RawMessage {
+	data, err := json.Marshal(&em.Msg)
+	if err != nil {
+		return json.RawMessage("null")
+	}
+	return data
+}
+
+// captureFrame represents a corrupted frame in a capture record:
+// as-is if it is still valid JSON, or else as JSON string.
+func captureFrame(frame []byte) json.RawMessage {
+	if json.Valid(frame) {
+		return frame
+	}
+	data, err := json.Marshal(string(frame))
+	if err != nil {
+		return json.RawMessage("null")
+	}
+	return data
+}
+
+// captureFile is an open capture file, rotated by size.
+type captureFile struct {
+	path string
+
+	mu       sync.Mutex
+	f        *os.File
+	size     int64
+	maxSize  int64
+	maxFiles int
+}
+
+func openCaptureFile(cfg *Capture) (*captureFile, error) {
+	c := &captureFile{path: cfg.Path}
+	c.configure(cfg)
+	if err := c.open(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// configure updates the rotation settings.
+func (c *captureFile) configure(cfg *Capture) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.maxSize = cfg.maxSize()
+	c.maxFiles = cfg.maxFiles()
+}
+
+// open opens the capture file for appending. The caller must hold the lock, or own the file.
+func (c *captureFile) open() error {
+	f, err := os.OpenFile(c.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open capture file: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to stat capture file: %w", err)
+	}
+	c.f = f
+	c.size = info.Size()
+	return nil
+}
+
+// write appends the record, rotating the file first if it would grow past the max size.
+func (c *captureFile) write(rec *CaptureRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("failed to encode capture record: %w", err)
+	}
+	data = append(data, '\n')
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.f == nil {
+		return errors.New("capture file is closed")
+	}
+	var result error
+	if c.size > 0 && c.size+int64(len(data)) > c.maxSize {
+		result = c.rotate()
+		if c.f == nil {
+			return result
+		}
+	}
+	n, err := c.f.Write(data)
+	c.size += int64(n)
+	return errors.Join(result, err)
+}
+
+// rotate shifts the rotated files, drops the oldest, and starts a new capture file.
+// If rotation fails, capturing continues in the current file.
+// The caller must hold the lock.
+func (c *captureFile) rotate() error {
+	if err := c.f.Close(); err != nil {
+		return fmt.Errorf("failed to close capture file: %w", err)
+	}
+	c.f = nil
+	var result error
+	_ = os.Remove(fmt.Sprintf("%s.%d", c.path, c.maxFiles))
+	for i := c.maxFiles - 1; i >= 1; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", c.path, i), fmt.Sprintf("%s.%d", c.path, i+1))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			result = errors.Join(result, fmt.Errorf("failed to rotate capture file: %w", err))
+		}
+	}
+	if err := os.Rename(c.path, c.path+".1"); err != nil {
+		result = errors.Join(result, fmt.Errorf("failed to rotate capture file: %w", err))
+	}
+	return errors.Join(result, c.open())
+}
+
+func (c *captureFile) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.f == nil {
+		return nil
+	}
+	err := c.f.Close()
+	c.f = nil
+	return err
+}
+
+// captures lists the capture files of the source and target, without duplicates.
+func captures(src *Source, target *Target) (out []*captureFile) {
+	for _, c := range []*Capture{src.Capture, target.Capture} {
+		if c == nil || c.file == nil {
+			continue
+		}
+		if len(out) == 1 && out[0] == c.file {
+			continue
+		}
+		out = append(out, c.file)
+	}
+	return out
+}
+
+// configCaptures lists the captures of all sources and targets.
+func configCaptures(cfg *Config) (out []*Capture) {
+	for _, src := range cfg.Sources {
+		if src.Capture != nil {
+			out = append(out, src.Capture)
+		}
+	}
+	for _, target := range cfg.Targets {
+		if target.Capture != nil {
+			out = append(out, target.Capture)
+		}
+	}
+	return out
+}
+
+// updateCaptures opens the capture files of the config, and returns the files that are no longer used.
+// Routes pick up the capture files when their pipelines are (re)started.
+// The retired files are left open, for the pipelines that still run to record their last messages:
+// the caller closes them once those are drained.
+// The caller must hold the lock.
+func (ba *Backend) updateCaptures(cfg *Config) (retired []*captureFile, result error) {
+	wanted := make(map[string]*Capture)
+	for _, c := range configCaptures(cfg) {
+		wanted[c.Path] = c
+	}
+	for path, f := range ba.captures {
+		if _, ok := wanted[path]; ok {
+			continue
+		}
+		retired = append(retired, f)
+		delete(ba.captures, path)
+	}
+	for path, c := range wanted {
+		if f, ok := ba.captures[path]; ok {
+			f.configure(c)
+			continue
+		}
+		f, err := openCaptureFile(c)
+		if err != nil {
+			result = errors.Join(result, fmt.Errorf("capture %q: %w", path, err))
+			continue
+		}
+		ba.log.Info("capturing messages", "path", path)
+		ba.captures[path] = f
+	}
+	for _, c := range configCaptures(cfg) {
+		c.file = ba.captures[c.Path]
+	}
+	return retired, result
+}
+
+// closeCaptures closes the capture files.
+func closeCaptures(files []*captureFile) error {
+	var result error
+	for _, f := range files {
+		if err := f.Close(); err != nil {
+			result = errors.Join(result, fmt.Errorf("failed to close capture file %q: %w", f.path, err))
+		}
+	}
+	return result
+}
@@ -0,0 +1,210 @@
+package switcher
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	jsonrpc "github.com/protolambda/jsonrpc2"
+)
+
+// readCapture reads the records of a capture file.
+func readCapture(t *testing.T, path string) []*CaptureRecord {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open capture: %v", err)
+	}
+	defer f.Close()
+	var out []*CaptureRecord
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var rec CaptureRecord
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			t.Fatalf("invalid capture record %q: %v", sc.Text(), err)
+		}
+		out = append(out, &rec)
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestCapture(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	srv := startServer(t, &Config{
+		// the source and target share the capture file, and each message is recorded once
+		Targets: map[string]*Target{"t": {Endpoint: startTarget(t), Capture: &Capture{Path: path}}},
+		Sources: map[string]*Source{"s": {Capture: &Capture{Path: path}, Effects: []*Effect{
+			{RegexMatcher: regexp.MustCompile("^drop$"), Drop: &DropEffect{Chance: 1}},
+			{RegexMatcher: regexp.MustCompile("^err$"), Direction: DirectionSourceRequest, Error: &ErrorEffect{Chance: 1, Code: 5, Message: "x"}},
+			{RegexMatcher: regexp.MustCompile("^alt$"), Direction: DirectionTargetResponse, Substitute: &SubstituteEffect{Result: "x"}},
+		}}},
+		Routes: map[string]string{"s": "t"},
+	})
+	src := dialSource(t, srv, "/dial/s")
+	expectResult(t, call(t, src, request("1", "ok", "")), "1", "ok:1")
+	if err := src.Write(request("2", "drop", "")); err != nil {
+		t.Fatal(err)
+	}
+	if resp := call(t, src, request("3", "err", "")); resp.Error == nil || resp.Error.Code != 5 {
+		t.Fatalf("expected error, got %s", (&Envelope{Msg: *resp}).JSON())
+	}
+	expectResult(t, call(t, src, request("4", "alt", "")), "4", "x")
+
+	want := []struct {
+		direction Direction
+		method    string
+		outcome   CaptureOutcome
+	}{
+		{DirectionSourceRequest, "ok", CaptureForwarded},
+		{DirectionTargetResponse, "ok", CaptureForwarded},
+		{DirectionSourceRequest, "drop", CaptureDropped},
+		{DirectionSourceRequest, "err", CaptureAnswered},
+		{DirectionTargetResponse, "err", CaptureInjected},
+		{DirectionSourceRequest, "alt", CaptureForwarded},
+		{DirectionTargetResponse, "alt", CaptureAltered},
+	}
+	var records []*CaptureRecord
+	eventually(t, func() bool {
+		records = readCapture(t, path)
+		return len(records) >= len(want)
+	})
+	if len(records) != len(want) {
+		t.Fatalf("expected %d records, got %d", len(want), len(records))
+	}
+	for i, w := range want {
+		rec := records[i]
+		if rec.Direction != w.direction || rec.Method != w.method || rec.Outcome != w.outcome {
+			t.Errorf("record %d: expected %s %s %s, got %s %s %s", i,
+				w.direction, w.method, w.outcome, rec.Direction, rec.Method, rec.Outcome)
+		}
+		if rec.Source != "s" || rec.Target != "t" {
+			t.Errorf("record %d: unexpected route %s -> %s", i, rec.Source, rec.Target)
+		}
+	}
+	var altered, original jsonrpc.Message
+	if err := json.Unmarshal(records[6].Msg, &altered); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(records[6].Original, &original); err != nil {
+		t.Fatal(err)
+	}
+	expectResult(t, &altered, "4", "x")
+	// the target answered the ID of the shared connection, the original is recorded as it entered the switch
+	if original.Result == nil || !strings.HasPrefix(string(*original.Result), `"alt:`) {
+		t.Errorf("expected the original result, got %s", records[6].Original)
+	}
+	if records[0].Effects != nil || len(records[2].Effects) != 1 || records[2].Effects[0] != "drop" {
+		t.Errorf("unexpected effects: %v, %v", records[0].Effects, records[2].Effects)
+	}
+}
+
+func TestCaptureRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	srv := startServer(t, &Config{
+		Targets: map[string]*Target{"t": {Endpoint: startTarget(t)}},
+		Sources: map[string]*Source{"s": {Capture: &Capture{Path: path, MaxSize: 1000, MaxFiles: 1}}},
+		Routes:  map[string]string{"s": "t"},
+	})
+	src := dialSource(t, srv, "/dial/s")
+	for i := range 20 {
+		call(t, src, request(jsonrpc.RawID(fmt.Sprint(i)), "eth_chainId", ""))
+	}
+	var records []*CaptureRecord
+	eventually(t, func() bool {
+		if _, err := os.Stat(path + ".1"); err != nil {
+			return false
+		}
+		records = append(readCapture(t, path+".1"), readCapture(t, path)...)
+		return len(records) > 0 && records[len(records)-1].Direction == DirectionTargetResponse
+	})
+	if _, err := os.Stat(path + ".2"); !os.IsNotExist(err) {
+		t.Fatalf("expected only one rotated file to be kept, got %v", err)
+	}
+	for _, p := range []string{path, path + ".1"} {
+		info, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > 1000 {
+			t.Errorf("capture file %s grew past the max size: %d", p, info.Size())
+		}
+	}
+	if len(records) >= 40 {
+		t.Errorf("expected the oldest records to be removed, got %d", len(records))
+	}
+}
+
+func TestCaptureReloadDrains(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	endpoint := startTarget(t)
+	cfg := func(capture *Capture) *Config {
+		return &Config{
+			Targets: map[string]*Target{"t": {Endpoint: endpoint}},
+			Sources: map[string]*Source{"s": {Capture: capture, Effects: []*Effect{
+				{RegexMatcher: regexp.MustCompile("^slow$"), Direction: DirectionSourceRequest, Delay: &DelayEffect{Time: 300 * time.Millisecond}},
+			}}},
+			Routes: map[string]string{"s": "t"},
+		}
+	}
+	srv := startServer(t, cfg(&Capture{Path: path}))
+	src := dialSource(t, srv, "/dial/s")
+	if err := src.Write(request("1", "slow", "")); err != nil {
+		t.Fatal(err)
+	}
+	// the fast request passes the delayed one, which is then known to be in the pipeline
+	expectResult(t, call(t, src, request("2", "fast", "")), "2", "fast:1")
+	// the capture is removed while the delayed request is still in the old pipeline
+	if err := srv.Reload(cfg(nil)); err != nil {
+		t.Fatal(err)
+	}
+	expectResult(t, readMsg(t, src), "1", "slow:2")
+	expectResult(t, call(t, src, request("3", "after", "")), "3", "after:3")
+
+	var methods []string
+	for _, rec := range readCapture(t, path) {
+		if rec.Direction == DirectionSourceRequest {
+			methods = append(methods, rec.Method)
+		}
+	}
+	// the delayed request is recorded as it leaves the old pipeline, the request after the reload is not
+	if len(methods) != 2 || methods[0] != "fast" || methods[1] != "slow" {
+		t.Fatalf("unexpected captured requests: %v", methods)
+	}
+}
+
+func TestCaptureDroppedOnClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	srv := startServer(t, &Config{
+		Targets: map[string]*Target{"t": {Endpoint: startTarget(t)}},
+		Sources: map[string]*Source{"s": {Capture: &Capture{Path: path}, Effects: []*Effect{
+			{RegexMatcher: regexp.MustCompile("^slow$"), Direction: DirectionSourceRequest, Delay: &DelayEffect{Time: time.Minute}},
+		}}},
+		Routes: map[string]string{"s": "t"},
+	})
+	src := dialSource(t, srv, "/dial/s")
+	if err := src.Write(request("1", "slow", "")); err != nil {
+		t.Fatal(err)
+	}
+	expectResult(t, call(t, src, request("2", "fast", "")), "2", "fast:1")
+	// the delayed request is lost as the route closes, and recorded as such
+	if err := src.Close(); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, func() bool {
+		for _, rec := range readCapture(t, path) {
+			if rec.Method == "slow" {
+				return rec.Outcome == CaptureDropped
+			}
+		}
+		return false
+	})
+}
@@ -2,10 +2,17 @@ package switcher
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
+	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
+	"time"
 
+	"github.com/ethereum/go-ethereum/log"
 	"github.com/protolambda/asklog"
 )
 
@@ -15,15 +22,28 @@ type MainCmd struct {
 	ListenAddr string `ask:"--listen.addr" help:"Address to bind server to"`
 	ListenPort uint16 `ask:"--listen.port" help:"Port to bind server to"`
 
-	Config string `ask:"--config" help:"File path to YAML config"`
+	TLSCert     string `ask:"--tls.cert" help:"Path to PEM certificate to serve TLS with. Requires --tls.key."`
+	TLSKey      string `ask:"--tls.key" help:"Path to PEM key of the TLS certificate"`
+	TLSClientCA string `ask:"--tls.client-ca" help:"Path to PEM CA bundle. If set, clients must present a certificate signed by it (mTLS)."`
+
+	Config             string        `ask:"--config" help:"File path to YAML config"`
+	ConfigPollInterval time.Duration `ask:"--config.poll-interval" help:"Interval to check the config file for changes, to reload it. 0 to disable. SIGHUP always reloads."`
+
+	Seed uint64 `ask:"--seed" help:"Seed for the random draws of effects, to reproduce a run. Overrides the seed of the config. If 0, the config seed is used, or else a random seed, which is logged."`
 
 	srv *Server `ask:"-"`
+
+	// seed is used for configs that do not set a seed, unless --seed is set
+	seed uint64 `ask:"-"`
+
+	stopWatch context.CancelFunc `ask:"-"`
 }
 
 func (m *MainCmd) Default() {
 	m.ListenAddr = "127.0.0.1"
 	m.ListenPort = 8080
 	m.Config = "config.yaml"
+	m.ConfigPollInterval = 2 * time.Second
 	m.LogConfig.Default()
 }
 
@@ -31,17 +51,110 @@ func (m *MainCmd) Run(ctx context.Context, args ...string) error {
 	logger := m.LogConfig.New()
 	addr := net.JoinHostPort(m.ListenAddr, strconv.FormatUint(uint64(m.ListenPort), 10))
 
+	info, err := os.Stat(m.Config)
+	if err != nil {
+		return fmt.Errorf("failed to read config %q: %w", m.Config, err)
+	}
 	cfg, err := LoadConfig(m.Config)
 	if err != nil {
 		return fmt.Errorf("failed to load config %q: %w", m.Config, err)
 	}
+	if m.Seed != 0 {
+		m.seed = m.Seed
+	} else if cfg.Seed != nil {
+		m.seed = *cfg.Seed
+	} else {
+		m.seed = randUint64()
+	}
+	logger.Info("seeded effects", "seed", m.seed)
+	m.applySeed(cfg)
 
-	srv := NewServer(logger, addr, cfg)
+	var tlsCfg *tls.Config
+	if m.TLSCert != "" || m.TLSKey != "" {
+		if m.TLSCert == "" || m.TLSKey == "" {
+			return errors.New("--tls.cert and --tls.key must be set together")
+		}
+		tlsCfg, err = ServerTLSConfig(m.TLSCert, m.TLSKey, m.TLSClientCA)
+		if err != nil {
+			return err
+		}
+	} else if m.TLSClientCA != "" {
+		return errors.New("--tls.client-ca requires --tls.cert and --tls.key")
+	}
+
+	srv := NewServer(logger, addr, cfg, tlsCfg)
 	m.srv = srv
-	return srv.Start()
+	if err := srv.Start(); err != nil {
+		return err
+	}
+
+	watchCtx, stopWatch := context.WithCancel(context.Background())
+	m.stopWatch = stopWatch
+	go m.watchConfig(watchCtx, logger, info)
+	return nil
+}
+
+// watchConfig reloads the config on SIGHUP, and when the config file is modified.
+func (m *MainCmd) watchConfig(ctx context.Context, logger log.Logger, last os.FileInfo) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var poll <-chan time.Time
+	if m.ConfigPollInterval > 0 {
+		ticker := time.NewTicker(m.ConfigPollInterval)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			logger.Info("received SIGHUP, reloading config", "path", m.Config)
+		case <-poll:
+			info, err := os.Stat(m.Config)
+			if err != nil {
+				logger.Warn("failed to check config file", "path", m.Config, "err", err)
+				continue
+			}
+			if info.ModTime().Equal(last.ModTime()) && info.Size() == last.Size() {
+				continue
+			}
+			last = info
+			logger.Info("config file changed, reloading config", "path", m.Config)
+		}
+		if err := m.reloadConfig(); err != nil {
+			logger.Error("failed to reload config, keeping previous config", "path", m.Config, "err", err)
+		}
+	}
+}
+
+func (m *MainCmd) reloadConfig() error {
+	cfg, err := LoadConfig(m.Config)
+	if err != nil {
+		return err
+	}
+	m.applySeed(cfg)
+	return m.srv.Reload(cfg)
+}
+
+// applySeed sets the seed of the config: --seed takes precedence,
+// and configs without seed keep the seed that was picked at startup.
+func (m *MainCmd) applySeed(cfg *Config) {
+	if m.Seed != 0 {
+		seed := m.Seed
+		cfg.Seed = &seed
+	} else if cfg.Seed == nil {
+		seed := m.seed
+		cfg.Seed = &seed
+	}
 }
 
 func (m *MainCmd) Close() error {
+	if m.stopWatch != nil {
+		m.stopWatch()
+	}
 	if m.srv != nil {
 		return m.srv.Close()
 	}
@@ -0,0 +1,58 @@
+package switcher
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	jsonrpc "github.com/protolambda/jsonrpc2"
+)
+
+func TestMainCmdWatchConfig(t *testing.T) {
+	endpoint := startTarget(t)
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	write := func(effects string) {
+		t.Helper()
+		src := "targets: {t: {endpoint: " + endpoint + ", effects: [" + effects + "]}}\nsources: {s: {}}\nroutes: {s: t}\n"
+		if err := os.WriteFile(path, []byte(src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("{error: {chance: 1, code: 5}}")
+	var m MainCmd
+	m.Default()
+	m.ListenPort = 0
+	m.Config = path
+	m.ConfigPollInterval = 10 * time.Millisecond
+	if err := m.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = m.Close() })
+	src := dialSource(t, m.srv, "/dial/s")
+	errored := func(id jsonrpc.RawID) bool {
+		return call(t, src, request(id, "x", "")).Error != nil
+	}
+	if !errored("1") {
+		t.Fatal("expected error of the effect")
+	}
+
+	// modification times may be coarse, the size tells the files apart
+	write("")
+	i := 1
+	eventually(t, func() bool {
+		i++
+		return !errored(jsonrpc.RawID(fmt.Sprint(i)))
+	})
+
+	// an invalid config is not applied, the connection stays up with the previous config
+	if err := os.WriteFile(path, []byte("routes: {s: unknown, other: t}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if errored("100") {
+		t.Fatal("expected the previous config to be kept")
+	}
+}
@@ -1,11 +1,18 @@
 package switcher
 
 import (
-	"crypto/rand"
-	"encoding/binary"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"math"
+	"maps"
+	"net/http"
 	"regexp"
+	"strings"
+	"sync"
+	"text/template"
 	"time"
 
 	"golang.org/x/time/rate"
@@ -18,33 +25,274 @@ type Config struct {
 	Targets map[string]*Target `yaml:"targets"`
 	// Sources are expected incoming connections
 	Sources map[string]*Source `yaml:"sources"`
+	// Routes maps a source to the target it connects to by default.
+	// Sources may still dial any other target explicitly.
+	Routes map[string]string `yaml:"routes,omitempty"`
+	// Origins lists the browser origins that may use the server, "*" allows any origin.
+	// Requests without origin, i.e. not from a browser, are not restricted by this.
+	Origins []string `yaml:"origins,omitempty"`
+	// AdminAuth restricts access to the admin API, the /targets status and the /tap stream. Optional.
+	AdminAuth *Auth `yaml:"adminAuth,omitempty"`
+	// Seed makes the random draws of effects reproducible.
+	// Every effect draws from its own streams, derived from the seed and the source or target and position of the effect,
+	// so changing one source or target does not change the draws of another.
+	// Every route has its own streams, labeled by its source and target,
+	// and numbered by the order in which the routes between that source and target connect,
+	// so the draws of a route do not depend on the traffic or connections of other sources and targets.
+	// A reload, including an edit of effects through the admin API, starts new streams for the routes,
+	// so the draws after a reload are reproduced by connecting and reloading in the same order.
+	// If not set, a random seed is used.
+	Seed *uint64 `yaml:"seed,omitempty"`
+
+	// seed that the effects were seeded with, to seed effects that are added later
+	seed uint64
+}
+
+// Check verifies the config is consistent.
+func (c *Config) Check() error {
+	for source, target := range c.Routes {
+		if _, _, err := c.Route(source, target); err != nil {
+			return fmt.Errorf("invalid default route: %w", err)
+		}
+	}
+	ipcPaths := make(map[string]string)
+	for name, src := range c.Sources {
+		if src.IPCPath == "" {
+			continue
+		}
+		if _, ok := c.Routes[name]; !ok {
+			return fmt.Errorf("source %q is exposed over IPC, but has no default route", name)
+		}
+		if other, ok := ipcPaths[src.IPCPath]; ok {
+			return fmt.Errorf("sources %q and %q share IPC path %q", other, name, src.IPCPath)
+		}
+		ipcPaths[src.IPCPath] = name
+	}
+	for name, target := range c.Targets {
+		if target.TLS != nil && !strings.HasPrefix(target.Endpoint, "wss://") && !strings.HasPrefix(target.Endpoint, "https://") {
+			return fmt.Errorf("target %q has TLS options, but endpoint %q does not use TLS", name, target.Endpoint)
+		}
+	}
+	capturePaths := make(map[string]*Capture)
+	for _, c := range configCaptures(c) {
+		if c.Path == "" {
+			return errors.New("capture path must be set")
+		}
+		if other, ok := capturePaths[c.Path]; ok && (other.maxSize() != c.maxSize() || other.maxFiles() != c.maxFiles()) {
+			return fmt.Errorf("captures to %q are configured differently", c.Path)
+		}
+		capturePaths[c.Path] = c
+	}
+	return nil
+}
+
+// Init loads the auth configuration, JWT secrets, TLS certificates and replayed captures, and prepares all effects to run.
+func (c *Config) Init() error {
+	if c.Seed != nil {
+		c.seed = *c.Seed
+	} else {
+		c.seed = randUint64()
+	}
+	if c.AdminAuth != nil {
+		if err := c.AdminAuth.Init(); err != nil {
+			return fmt.Errorf("invalid admin auth: %w", err)
+		}
+	}
+	for name, src := range c.Sources {
+		if src.Auth != nil {
+			if err := src.Auth.Init(); err != nil {
+				return fmt.Errorf("source %q: invalid auth: %w", name, err)
+			}
+		}
+		if src.JWTSecret != "" {
+			secret, err := loadJWTSecret(src.JWTSecret)
+			if err != nil {
+				return fmt.Errorf("source %q: %w", name, err)
+			}
+			src.jwtSecret = secret
+		}
+		for i, ef := range src.Effects {
+			if err := ef.Init(); err != nil {
+				return fmt.Errorf("source %q effect %d: %w", name, i, err)
+			}
+			ef.seedRand(c.seed, ScopeSource, name, i)
+		}
+	}
+	for name, target := range c.Targets {
+		if target.JWTSecret != "" {
+			secret, err := loadJWTSecret(target.JWTSecret)
+			if err != nil {
+				return fmt.Errorf("target %q: %w", name, err)
+			}
+			target.jwtSecret = secret
+		}
+		if path, ok := strings.CutPrefix(target.Endpoint, replayScheme); ok {
+			replay, err := loadReplay(path)
+			if err != nil {
+				return fmt.Errorf("target %q: failed to load replay: %w", name, err)
+			}
+			target.replay = replay
+		}
+		if target.TLS != nil {
+			tlsCfg, digest, err := target.TLS.config()
+			if err != nil {
+				return fmt.Errorf("target %q: invalid TLS config: %w", name, err)
+			}
+			target.tlsConfig = tlsCfg
+			target.tlsDigest = digest
+			target.httpClient = newHTTPClient(tlsCfg)
+		}
+		for i, ef := range target.Effects {
+			if err := ef.Init(); err != nil {
+				return fmt.Errorf("target %q effect %d: %w", name, i, err)
+			}
+			ef.seedRand(c.seed, ScopeTarget, name, i)
+		}
+	}
+	return nil
+}
+
+// Close stops all effects.
+func (c *Config) Close() error {
+	return closeEffects(c.effects())
+}
+
+// effects lists the effects of all sources and targets.
+func (c *Config) effects() (out []*Effect) {
+	for _, src := range c.Sources {
+		out = append(out, src.Effects...)
+	}
+	for _, target := range c.Targets {
+		out = append(out, target.Effects...)
+	}
+	return out
+}
+
+// clone copies the config, sharing the sources, targets and their effects.
+func (c *Config) clone() *Config {
+	return &Config{
+		Targets:   maps.Clone(c.Targets),
+		Sources:   maps.Clone(c.Sources),
+		Routes:    maps.Clone(c.Routes),
+		Origins:   c.Origins,
+		AdminAuth: c.AdminAuth,
+		Seed:      c.Seed,
+		seed:      c.seed,
+	}
+}
+
+func closeEffects(effects []*Effect) error {
+	var result error
+	for _, ef := range effects {
+		result = errors.Join(result, ef.Close())
+	}
+	return result
+}
+
+// Route looks up the source and target configuration of a route.
+func (c *Config) Route(sourceName, targetName string) (*Source, *Target, error) {
+	src, ok := c.Sources[sourceName]
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown source %q", sourceName)
+	}
+	target, ok := c.Targets[targetName]
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown target %q", targetName)
+	}
+	return src, target, nil
 }
 
 type Target struct {
-	// Endpoint to connect to
+	// Endpoint to connect to.
+	// Websocket (ws://, wss://) endpoints are connected to,
+	// HTTP (http://, https://) endpoints receive each request as a POST.
+	// Replay (replay:///path/capture.jsonl) endpoints answer with the responses recorded in a capture file.
 	Endpoint string `yaml:"endpoint"`
 	// KeepAlive keeps the connection to the endpoint open, even if it's not being used.
 	KeepAlive bool `yaml:"keepAlive,omitempty"`
+	// JWTSecret is the path to a hex-encoded 32 byte secret, like the geth --authrpc.jwtsecret file.
+	// If set, the target is authenticated with fresh HS256 tokens, on every dial and HTTP request,
+	// as the Engine API requires.
+	JWTSecret string `yaml:"jwtSecret,omitempty"`
+	// TLS customizes the TLS connection to wss:// and https:// endpoints. Optional.
+	TLS *TargetTLS `yaml:"tls,omitempty"`
+	// Capture records the messages of all routes to the target. Optional.
+	Capture *Capture `yaml:"capture,omitempty"`
 	// Effects applied to every
 	Effects []*Effect `yaml:"effects"`
+
+	jwtSecret []byte
+	tlsConfig *tls.Config
+	// tlsDigest identifies the TLS options and the certificates they loaded, zero without TLS options
+	tlsDigest [sha256.Size]byte
+	// replay is the capture to answer with, if the endpoint is a replay
+	replay *replayLog
+	// httpClient sends the requests to an HTTP target
+	httpClient *http.Client
+}
+
+// authHeader returns the headers to authenticate a dial or request to the target with.
+func (t *Target) authHeader() (http.Header, error) {
+	if t.jwtSecret == nil {
+		return nil, nil
+	}
+	return jwtAuthHeader(t.jwtSecret)
+}
+
+// client returns the client to send requests to an HTTP target with.
+func (t *Target) client() *http.Client {
+	if t.httpClient == nil {
+		return http.DefaultClient
+	}
+	return t.httpClient
 }
 
 type Source struct {
+	// Effects applied to every message of this source
 	Effects []*Effect `yaml:"effects"`
+	// HTTPTimeout is how long an HTTP request of this source waits for its responses.
+	// Requests that are not answered in time are answered with a timeout error.
+	// Defaults to 30 seconds.
+	HTTPTimeout time.Duration `yaml:"httpTimeout,omitempty"`
+	// Capture records the messages of all routes of the source. Optional.
+	Capture *Capture `yaml:"capture,omitempty"`
+	// Auth restricts who may dial the source. Optional.
+	Auth *Auth `yaml:"auth,omitempty"`
+	// IPCPath, if set, exposes the source as a unix socket at the given path,
+	// speaking newline-delimited JSON-RPC like geth.ipc.
+	// Connections to the socket take the default route of the source.
+	IPCPath string `yaml:"ipcPath,omitempty"`
+	// JWTSecret is the path to a hex-encoded 32 byte secret, like the geth --authrpc.jwtsecret file.
+	// If set, dials and HTTP requests of the source must carry a valid HS256 bearer token,
+	// as geth requires on the Engine API. IPC connections are not authenticated.
+	JWTSecret string `yaml:"jwtSecret,omitempty"`
+
+	jwtSecret []byte
 }
 
+// Effect applies sub-effects to the messages that match it.
+// The sub-effects are applied in the order they are declared in.
 type Effect struct {
-	// Direction to match the effect on.
+	// Direction to match the effect on. Defaults to "any".
+	// The direction is matched the same for source and target effects:
+	// "source-request" matches requests travelling from source to target, whether the effect is configured on either.
 	Direction Direction `yaml:"direction,omitempty"`
 
 	// RegexFilter filters the method with a regex.
 	// Effects are only applied to matching RPC methods.
+	// Responses are matched by the method of the request they respond to, if known.
 	// If no filter is configured, the message is let through (there may still be a FuncFilter).
 	RegexMatcher *regexp.Regexp `yaml:"filter,omitempty"`
 	// FuncFilter matches the message (request or response).
-	// If true, the message is let through. If false, the message is dropped.
+	// If true, the message is let through to the sub-effects.
+	// If false, the message passes by unaffected.
 	// Optional additional filter step.
 	FuncFilter func(msg *jsonrpc.Message) bool `yaml:"-"`
+	// Match filters the message by its params, result or error.
+	// Effects are only applied to matching messages.
+	Match *Match `yaml:"match,omitempty"`
+	// Seed makes the random draws of the effect reproducible, independent of the config seed. Optional.
+	Seed *uint64 `yaml:"seed,omitempty"`
 
 	Delay      *DelayEffect      `yaml:"delay,omitempty"`
 	Drop       *DropEffect       `yaml:"drop,omitempty"`
@@ -52,18 +300,223 @@ type Effect struct {
 	RateLimit  *RateLimitEffect  `yaml:"rateLimit,omitempty"`
 	Parallel   *ParallelEffect   `yaml:"parallel,omitempty"`
 	Substitute *SubstituteEffect `yaml:"substitute,omitempty"`
+	Reorder    *ReorderEffect    `yaml:"reorder,omitempty"`
+	Duplicate  *DuplicateEffect  `yaml:"duplicate,omitempty"`
+	Corrupt    *CorruptEffect    `yaml:"corrupt,omitempty"`
+
+	// seed of the random streams of the runs of the effect
+	seed uint64
+	// ctx is canceled when the effect is closed
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// matchedBuffer is the number of matched messages that may queue up for the sub-effects of an Effect.
+const matchedBuffer = 100
+
+// subEffect is a single stage of an Effect.
+// Run passes messages from incoming to outgoing, and closes outgoing when incoming is closed.
+// The incoming channel is always drained, also after the context is canceled.
+// Random draws are taken from the given stream, that is not shared with other runs.
+type subEffect interface {
+	Run(ctx context.Context, r *effectRand, incoming <-chan *Envelope, outgoing chan<- *Envelope)
+}
+
+// kindedSubEffect is a configured sub-effect, with the name of its kind, e.g. "delay".
+type kindedSubEffect struct {
+	kind string
+	subEffect
+}
+
+func (ef *Effect) subEffects() (out []kindedSubEffect) {
+	for _, sub := range []struct {
+		kind string
+		set  bool
+		sub  subEffect
+	}{
+		{"delay", ef.Delay != nil, ef.Delay},
+		{"drop", ef.Drop != nil, ef.Drop},
+		{"error", ef.Error != nil, ef.Error},
+		{"rateLimit", ef.RateLimit != nil, ef.RateLimit},
+		{"parallel", ef.Parallel != nil, ef.Parallel},
+		{"substitute", ef.Substitute != nil, ef.Substitute},
+		{"reorder", ef.Reorder != nil, ef.Reorder},
+		{"duplicate", ef.Duplicate != nil, ef.Duplicate},
+		{"corrupt", ef.Corrupt != nil, ef.Corrupt},
+	} {
+		if sub.set {
+			out = append(out, kindedSubEffect{kind: sub.kind, subEffect: sub.sub})
+		}
+	}
+	return out
+}
+
+func (ef *Effect) Init() error {
+	if ef.Delay != nil {
+		if err := ef.Delay.Init(); err != nil {
+			return fmt.Errorf("invalid delay effect: %w", err)
+		}
+	}
+	if ef.Match != nil {
+		if err := ef.Match.Init(); err != nil {
+			return fmt.Errorf("invalid match: %w", err)
+		}
+	}
+	if ef.RateLimit != nil {
+		if err := ef.RateLimit.Init(); err != nil {
+			return fmt.Errorf("invalid rateLimit effect: %w", err)
+		}
+	}
+	if ef.Parallel != nil {
+		if err := ef.Parallel.Init(); err != nil {
+			return fmt.Errorf("invalid parallel effect: %w", err)
+		}
+		// the tokens of requests are given back by their responses, which travel the other way
+		if (ef.Direction.Match(true, true) && !ef.Direction.Match(false, false)) ||
+			(ef.Direction.Match(true, false) && !ef.Direction.Match(false, true)) {
+			return fmt.Errorf("invalid parallel effect: direction %s must match the responses to the requests it matches", ef.Direction)
+		}
+	}
+	if ef.Substitute != nil {
+		if err := ef.Substitute.Init(); err != nil {
+			return fmt.Errorf("invalid substitute effect: %w", err)
+		}
+	}
+	if ef.Reorder != nil {
+		if err := ef.Reorder.Init(); err != nil {
+			return fmt.Errorf("invalid reorder effect: %w", err)
+		}
+	}
+	if ef.Corrupt != nil {
+		if err := ef.Corrupt.Init(); err != nil {
+			return fmt.Errorf("invalid corrupt effect: %w", err)
+		}
+	}
+	ef.ctx, ef.cancel = context.WithCancel(context.Background())
+	return nil
 }
 
-func (ef *Effect) Init() {
-	// TODO start effect sub-routines
+// Run pumps messages from incoming to outgoing, through all sub-effects.
+// Messages pass on in the order they entered, whether they match the effect or not,
+// unless a sub-effect holds a message back on purpose, e.g. to delay it:
+// such a message then no longer holds up the messages behind it.
+// The effect can Run any number of times concurrently, state such as rate-limits is shared.
+// Every run draws from its own random streams, derived from the seed of the run.
+// Outgoing is closed after incoming is closed and all messages are processed.
+// If the context is canceled, or the effect is closed, remaining messages are dropped.
+func (ef *Effect) Run(ctx context.Context, seed uint64, incoming <-chan *Envelope, outgoing chan<- *Envelope) {
+	defer close(outgoing)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer context.AfterFunc(ef.ctx, cancel)()
+
+	matched := make(chan *Envelope, matchedBuffer)
+	var in <-chan *Envelope = matched
+	for _, sub := range ef.subEffects() {
+		next := make(chan *Envelope)
+		go sub.Run(ctx, newEffectRand(deriveSeed(seed, sub.kind)), in, next)
+		in = next
+	}
+	// order lists all messages in the order they entered,
+	// the matched messages as the slot they take up once they leave the sub-effects.
+	order := make(chan sequenced, matchedBuffer)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for em := range in {
+			if ctx.Err() != nil {
+				// nothing passes on anymore
+				em.dropped()
+				continue
+			}
+			if settle := em.settle; settle != nil {
+				em.settle = nil
+				settle(em)
+				continue
+			}
+			// messages that were held back, or injected, do not have a slot
+			send(ctx, outgoing, em)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for seq := range order {
+			em := seq.em
+			if seq.slot != nil {
+				select {
+				case <-ctx.Done():
+					// the message may have settled just before
+					select {
+					case em := <-seq.slot:
+						if em != nil {
+							em.dropped()
+						}
+					default:
+					}
+					continue
+				case em = <-seq.slot:
+				}
+			}
+			if em != nil {
+				send(ctx, outgoing, em)
+			}
+		}
+	}()
+	for em := range incoming {
+		if !ef.applies(em) {
+			if !sendSequenced(ctx, order, sequenced{em: em}) {
+				em.dropped()
+			}
+			continue
+		}
+		em.applied(ef)
+		slot, settle := newSlot()
+		em.settle = settle
+		if send(ctx, matched, em) {
+			sendSequenced(ctx, order, sequenced{slot: slot})
+		}
+	}
+	close(matched)
+	close(order)
+	wg.Wait()
 }
 
-func (ef *Effect) Run(incoming chan *Envelope, outgoing chan *Envelope) {
-	// TODO pump messages through all effect sub-routines
+// sequenced is a message that did not match an effect, or the slot of a message that did.
+type sequenced struct {
+	em   *Envelope
+	slot <-chan *Envelope
 }
 
+func sendSequenced(ctx context.Context, order chan<- sequenced, seq sequenced) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case order <- seq:
+		return true
+	}
+}
+
+// newSlot returns the slot of a matched message, and the function to settle it:
+// with the message, to pass it on in its place, or with nil, if the message gives up its place.
+func newSlot() (<-chan *Envelope, func(em *Envelope)) {
+	slot := make(chan *Envelope, 1)
+	var once sync.Once
+	return slot, func(em *Envelope) {
+		once.Do(func() {
+			if em != nil {
+				slot <- em
+			}
+			close(slot)
+		})
+	}
+}
+
+// Close stops all runs of the effect.
 func (ef *Effect) Close() error {
-	// TODO close all sub-effects
+	if ef.cancel != nil {
+		ef.cancel()
+	}
 	return nil
 }
 
@@ -74,31 +527,155 @@ type DelayEffect struct {
 	// Time is a flat extra delay added to the propagation of requests.
 	// Set to 0 to disable. Negative delay has no effect.
 	Time time.Duration `yaml:"time,omitempty"`
+
+	// Extra delay drawn from a distribution, added to Time and the jitter.
+	// At most one distribution can be configured.
+	Normal    *NormalDelay    `yaml:"normal,omitempty"`
+	LogNormal *LogNormalDelay `yaml:"logNormal,omitempty"`
+	Pareto    *ParetoDelay    `yaml:"pareto,omitempty"`
+	Empirical *EmpiricalDelay `yaml:"empirical,omitempty"`
+
+	// Max caps the total delay, to cut off the tail of a distribution. Set to 0 to disable.
+	Max time.Duration `yaml:"max,omitempty"`
+
+	// KeepOrder holds back messages until the messages before them are passed on,
+	// so delayed messages do not reorder. A long delay then stalls all messages behind it.
+	// By default, every message is passed on as soon as its own delay is over.
+	KeepOrder bool `yaml:"keepOrder,omitempty"`
 }
 
-func (ef *DelayEffect) Run(incoming chan *Envelope, outgoing chan *Envelope) {
-	// TODO read incoming message
-	// TODO go routine with delay
-	// TODO pass on message
+func (ef *DelayEffect) Init() error {
+	configured := 0
+	for _, set := range []bool{ef.Normal != nil, ef.LogNormal != nil, ef.Pareto != nil, ef.Empirical != nil} {
+		if set {
+			configured += 1
+		}
+	}
+	if configured > 1 {
+		return errors.New("at most one distribution can be configured")
+	}
+	if dist := ef.distribution(); dist != nil {
+		if err := dist.Init(); err != nil {
+			return err
+		}
+	}
+	if ef.Max < 0 {
+		return fmt.Errorf("max must not be negative, got %s", ef.Max)
+	}
+	return nil
+}
+
+// distribution returns the configured distribution, if any.
+func (ef *DelayEffect) distribution() delayDistribution {
+	switch {
+	case ef.Normal != nil:
+		return ef.Normal
+	case ef.LogNormal != nil:
+		return ef.LogNormal
+	case ef.Pareto != nil:
+		return ef.Pareto
+	case ef.Empirical != nil:
+		return ef.Empirical
+	default:
+		return nil
+	}
+}
+
+// delay draws the delay of a message from the random stream.
+func (ef *DelayEffect) delay(r *effectRand) time.Duration {
+	delay := max(ef.Time, 0)
+	if ef.MaxJitter > 0 {
+		delay = addDurations(delay, time.Duration(r.float64()*float64(ef.MaxJitter)))
+	}
+	if dist := ef.distribution(); dist != nil {
+		delay = addDurations(delay, max(dist.sample(r), 0))
+	}
+	if ef.Max > 0 {
+		delay = min(delay, ef.Max)
+	}
+	return delay
+}
+
+func (ef *DelayEffect) Run(ctx context.Context, r *effectRand, incoming <-chan *Envelope, outgoing chan<- *Envelope) {
+	var wg sync.WaitGroup
+	defer close(outgoing)
+	defer wg.Wait()
+	// prev is closed when the previous message is passed on, if the order is kept
+	prev := make(chan struct{})
+	close(prev)
+	for em := range incoming {
+		delay := ef.delay(r)
+		if delay > 0 {
+			em.settled()
+		}
+		passed := make(chan struct{})
+		wg.Add(1)
+		go func(prev <-chan struct{}) {
+			defer wg.Done()
+			defer close(passed)
+			timer := time.NewTimer(delay)
+			defer timer.Stop()
+			select {
+			case <-ctx.Done():
+				em.dropped()
+				return
+			case <-timer.C:
+			}
+			select {
+			case <-ctx.Done():
+				em.dropped()
+				return
+			case <-prev:
+			}
+			send(ctx, outgoing, em)
+		}(prev)
+		if ef.KeepOrder {
+			prev = passed
+		}
+	}
 }
 
 type DropEffect struct {
 	// Chance drops messages with the given probability.
 	// Set to 0 to disable. Negative probability has no effect.
 	Chance float64 `yaml:"chance,omitempty"`
+	// Timeout, if set, answers dropped requests with a timeout error after the given duration,
+	// like a server that gave up on the request. Dropped requests are left unanswered if 0.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
 }
 
-func (ef *DropEffect) Run(incoming chan *Envelope, outgoing chan *Envelope) {
-	// TODO read incoming msg
-	// check chance
-	if checkChance(ef.Chance) {
-		// drop, with warn log maybe
-	} else {
-		// pass on the message
+func (ef *DropEffect) Run(ctx context.Context, r *effectRand, incoming <-chan *Envelope, outgoing chan<- *Envelope) {
+	defer close(outgoing)
+	for em := range incoming {
+		if !r.chance(ef.Chance) {
+			send(ctx, outgoing, em)
+			continue
+		}
+		em.dropped()
+		if ef.Timeout > 0 && em.Msg.Request != nil && !em.Msg.ID.IsNotification() {
+			go func() {
+				timer := time.NewTimer(ef.Timeout)
+				defer timer.Stop()
+				select {
+				case <-ctx.Done():
+				case <-timer.C:
+					em.Respond(em.Msg.RespondErr(timeoutErrorObj()))
+				}
+			}()
+		}
 	}
 }
 
-// ErrorEffect only applies to request messages.
+// timeoutErrorCode is the error code geth uses for requests that timed out.
+const timeoutErrorCode = -32002
+
+func timeoutErrorObj() *jsonrpc.ErrorObject {
+	return &jsonrpc.ErrorObject{Code: timeoutErrorCode, Message: "request timed out"}
+}
+
+// ErrorEffect answers requests with an error, instead of forwarding them.
+// Responses are replaced with the error.
+// Notifications cannot be answered, and pass through unaffected.
 type ErrorEffect struct {
 	// Chance responds to the request with an error with the given probability.
 	// Set to 0 to disable. Negative probability has no effect.
@@ -113,10 +690,36 @@ type ErrorEffect struct {
 	Data any `yaml:"data,omitempty"`
 }
 
-func (ef *ErrorEffect) Run(incoming chan *Envelope, outgoing chan *Envelope) {
-	// TODO take incoming msg
-	// if request, forward on a matching error
-	// if response, replace with an error
+func (ef *ErrorEffect) errorObj() *jsonrpc.ErrorObject {
+	out := &jsonrpc.ErrorObject{
+		Code:    ef.Code,
+		Message: ef.Message,
+	}
+	if ef.Data != nil {
+		data, err := json.Marshal(ef.Data)
+		if err != nil {
+			return jsonrpc.AnnotatedErrorObj(jsonrpc.InternalError, fmt.Errorf("failed to encode error data: %w", err))
+		}
+		out.Data = data
+	}
+	return out
+}
+
+func (ef *ErrorEffect) Run(ctx context.Context, r *effectRand, incoming <-chan *Envelope, outgoing chan<- *Envelope) {
+	defer close(outgoing)
+	for em := range incoming {
+		if em.Msg.ID.IsNotification() || !r.chance(ef.Chance) {
+			send(ctx, outgoing, em)
+			continue
+		}
+		em.observe(eventErrored)
+		if em.Msg.Request != nil {
+			em.Respond(em.Msg.RespondErr(ef.errorObj()))
+			continue
+		}
+		em.Msg.Response = &jsonrpc.Response{Error: ef.errorObj()}
+		send(ctx, outgoing, em)
+	}
 }
 
 type RateLimitEffect struct {
@@ -124,6 +727,7 @@ type RateLimitEffect struct {
 	// Negative rates are invalid.
 	Rate float64 `yaml:"rate"`
 	// Burst is the number of reservations that may be filled at one time.
+	// Must be at least 1.
 	Burst uint `yaml:"burst"`
 
 	// limiter that implements the actual rate-limit
@@ -134,38 +738,109 @@ func (ef *RateLimitEffect) Init() error {
 	if ef.Rate < 0 {
 		return fmt.Errorf("invalid rate, cannot be negative: %f", ef.Rate)
 	}
+	if ef.Burst == 0 {
+		return errors.New("invalid burst, must be at least 1")
+	}
 	ef.limiter = rate.NewLimiter(rate.Limit(ef.Rate), int(ef.Burst))
 	return nil
 }
 
-func (ef *RateLimitEffect) Run(incoming chan *Envelope, outgoing chan *Envelope) {
-	// TODO take incoming request
-	// await rate limiter
-	// pass msg onwards
+func (ef *RateLimitEffect) Run(ctx context.Context, _ *effectRand, incoming <-chan *Envelope, outgoing chan<- *Envelope) {
+	defer close(outgoing)
+	for em := range incoming {
+		if !ef.limiter.Allow() {
+			em.settled()
+			if err := ef.limiter.Wait(ctx); err != nil {
+				em.dropped()
+				continue
+			}
+		}
+		send(ctx, outgoing, em)
+	}
 }
 
 type ParallelEffect struct {
 	// Max is the number of requests that may be open at any time, awaiting a response.
 	// Setting this to 0 blocks all requests.
 	// Setting this to 1 makes the RPC synchronous.
+	// The effect direction must match both the requests and the responses,
+	// since requests only give back their token when the response passes by,
+	// or when the request is dropped before it is answered.
+	// Requests that the other side never answers hold their token until the route closes.
 	Max int `yaml:"max"`
 
 	tokens chan struct{} `yaml:"-"`
+
+	// open requests that hold a token, by the run that took the token
+	openLock sync.Mutex
+	open     map[parallelKey]*parallelRun
+}
+
+// parallelRun identifies a single run of the effect.
+type parallelRun struct{}
+
+// parallelKey identifies a request by ID, per route.
+type parallelKey struct {
+	route *Route
+	id    jsonrpc.RawID
 }
 
 func (p *ParallelEffect) Init() error {
+	if p.Max < 0 {
+		return fmt.Errorf("invalid max, cannot be negative: %d", p.Max)
+	}
 	p.tokens = make(chan struct{}, p.Max)
+	p.open = make(map[parallelKey]*parallelRun)
 	return nil
 }
 
-func (ef *ParallelEffect) Run(incoming chan *Envelope, outgoing chan *Envelope) {
-	// TODO register requests by ID and sender
-
-	// TODO on response, remove by ID and sender
-
-	// TODO on request, take token
+// release gives back the token of the request, if it holds one.
+func (ef *ParallelEffect) release(key parallelKey) {
+	ef.openLock.Lock()
+	defer ef.openLock.Unlock()
+	if _, ok := ef.open[key]; ok {
+		delete(ef.open, key)
+		<-ef.tokens
+	}
+}
 
-	// TODO on response, give back token
+func (ef *ParallelEffect) Run(ctx context.Context, _ *effectRand, incoming <-chan *Envelope, outgoing chan<- *Envelope) {
+	defer close(outgoing)
+	// Give back the tokens of this run when it ends, as the responses will never arrive.
+	run := new(parallelRun)
+	defer func() {
+		ef.openLock.Lock()
+		defer ef.openLock.Unlock()
+		for key, v := range ef.open {
+			if v == run {
+				delete(ef.open, key)
+				<-ef.tokens
+			}
+		}
+	}()
+	for em := range incoming {
+		key := parallelKey{route: em.Route, id: em.Msg.ID}
+		if em.Msg.Response != nil {
+			ef.release(key)
+		} else if !em.Msg.ID.IsNotification() {
+			select {
+			case ef.tokens <- struct{}{}:
+			default:
+				em.settled()
+				select {
+				case <-ctx.Done():
+					em.dropped()
+					continue
+				case ef.tokens <- struct{}{}:
+				}
+			}
+			ef.openLock.Lock()
+			ef.open[key] = run
+			ef.openLock.Unlock()
+			em.held = append(em.held, func() { ef.release(key) })
+		}
+		send(ctx, outgoing, em)
+	}
 }
 
 type SubstituteEffect struct {
@@ -173,30 +848,171 @@ type SubstituteEffect struct {
 	// Also see Effect.Direction configuration:
 	// to override the effect before it reaches the target, or only replaces the response after the server responds.
 	// Can be a structured object in YAMl config, will be JSON-encoded in the response.
-	Result any `yaml:"result"`
+	Result any `yaml:"result,omitempty"`
+	// Template renders the result as JSON, derived from the request, instead of a static Result.
+	// This is a Go text/template, see substituteTemplateData for the available data,
+	// and substituteTemplateFuncs for the available functions.
+	// E.g. `{"number": {{index .Params 0 | json}}}` echoes the first param of the request.
+	Template string `yaml:"template,omitempty"`
+
+	tmpl *template.Template `yaml:"-"`
 }
 
-func (ef *SubstituteEffect) Run(incoming chan *Envelope, outgoing chan *Envelope) {
-	// TODO take incoming requests, substitute responses, write outgoing
+func (ef *SubstituteEffect) Init() error {
+	if ef.Template == "" {
+		return nil
+	}
+	if ef.Result != nil {
+		return errors.New("cannot substitute with both a static result and a template")
+	}
+	tmpl, err := template.New("substitute").Funcs(substituteTemplateFuncs).Parse(ef.Template)
+	if err != nil {
+		return fmt.Errorf("invalid template: %w", err)
+	}
+	ef.tmpl = tmpl
+	return nil
 }
 
-func checkChance(f float64) bool {
-	if f <= 0 {
-		return false
+// response renders the substituted response to the message.
+func (ef *SubstituteEffect) response(em *Envelope) *jsonrpc.Response {
+	if ef.tmpl == nil {
+		return resultResponse(ef.Result)
 	}
-	if f >= 1 {
-		return true
+	result, err := renderSubstitute(ef.tmpl, em)
+	if err != nil {
+		return &jsonrpc.Response{Error: jsonrpc.AnnotatedErrorObj(jsonrpc.InternalError, err)}
+	}
+	return &jsonrpc.Response{Result: &result}
+}
+
+func (ef *SubstituteEffect) Run(ctx context.Context, _ *effectRand, incoming <-chan *Envelope, outgoing chan<- *Envelope) {
+	defer close(outgoing)
+	for em := range incoming {
+		if em.Msg.ID.IsNotification() {
+			send(ctx, outgoing, em)
+			continue
+		}
+		em.observe(eventSubstituted)
+		if em.Msg.Request != nil {
+			em.Respond(&jsonrpc.Message{Response: ef.response(em), ID: em.Msg.ID})
+			continue
+		}
+		em.Msg.Response = ef.response(em)
+		send(ctx, outgoing, em)
 	}
-	return randUniformFloat64() < f
 }
 
-// randUniformFloat64 returns a random uniform float64 in the range 0 to 1
-func randUniformFloat64() float64 {
-	var x [8]uint8
-	_, err := rand.Read(x[:])
+// resultResponse encodes the result into a response.
+// If the result cannot be encoded, the response is an internal error.
+func resultResponse(result any) *jsonrpc.Response {
+	data, err := json.Marshal(result)
 	if err != nil {
-		panic(fmt.Errorf("failed to get randomness: %w", err))
+		return &jsonrpc.Response{Error: jsonrpc.AnnotatedErrorObj(jsonrpc.InternalError,
+			fmt.Errorf("failed to encode result: %w", err))}
+	}
+	raw := json.RawMessage(data)
+	return &jsonrpc.Response{Result: &raw}
+}
+
+// ReorderEffect holds messages back, and releases them in shuffled order.
+type ReorderEffect struct {
+	// Window is the number of messages to hold, before they are released.
+	// Set to 0 to only release messages after the timeout.
+	Window int `yaml:"window,omitempty"`
+	// Timeout is the maximum time to hold a message, before the held messages are released,
+	// even if the window is not full. Set to 0 to only release messages when the window is full.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+}
+
+func (ef *ReorderEffect) Init() error {
+	if ef.Window < 0 {
+		return fmt.Errorf("invalid window, cannot be negative: %d", ef.Window)
+	}
+	if ef.Timeout < 0 {
+		return fmt.Errorf("invalid timeout, cannot be negative: %s", ef.Timeout)
+	}
+	if ef.Window == 0 && ef.Timeout == 0 {
+		return errors.New("window or timeout must be set, to release the messages")
+	}
+	return nil
+}
+
+func (ef *ReorderEffect) Run(ctx context.Context, r *effectRand, incoming <-chan *Envelope, outgoing chan<- *Envelope) {
+	defer close(outgoing)
+	var held []*Envelope
+	// timeout of the oldest held message, nil if no messages are held
+	var timeout <-chan time.Time
+	release := func() {
+		r.shuffle(len(held), func(i, j int) {
+			held[i], held[j] = held[j], held[i]
+		})
+		for _, em := range held {
+			send(ctx, outgoing, em)
+		}
+		held = nil
+		timeout = nil
+	}
+	for {
+		select {
+		case em, ok := <-incoming:
+			if !ok {
+				release()
+				return
+			}
+			held = append(held, em)
+			if len(held) == 1 && ef.Timeout > 0 {
+				timeout = time.After(ef.Timeout)
+			}
+			if ef.Window > 0 && len(held) >= ef.Window {
+				release()
+			} else {
+				em.settled()
+			}
+		case <-timeout:
+			release()
+		}
+	}
+}
+
+// DuplicateEffect passes messages on twice, with the same JSON-RPC ID,
+// like a retrying client or a buggy server.
+type DuplicateEffect struct {
+	// Chance duplicates messages with the given probability.
+	// Set to 0 to disable. Negative probability has no effect.
+	Chance float64 `yaml:"chance,omitempty"`
+	// Delay of the copy, after the message was passed on. Set to 0 to pass the copy on right after the message.
+	Delay time.Duration `yaml:"delay,omitempty"`
+}
+
+func (ef *DuplicateEffect) Run(ctx context.Context, r *effectRand, incoming <-chan *Envelope, outgoing chan<- *Envelope) {
+	var wg sync.WaitGroup
+	defer close(outgoing)
+	defer wg.Wait()
+	for em := range incoming {
+		if !r.chance(ef.Chance) {
+			send(ctx, outgoing, em)
+			continue
+		}
+		em.observe(eventDuplicated)
+		// copy before passing the message on, as later stages may change it
+		dup := em.duplicate()
+		send(ctx, outgoing, em)
+		if ef.Delay <= 0 {
+			send(ctx, outgoing, dup)
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			timer := time.NewTimer(ef.Delay)
+			defer timer.Stop()
+			select {
+			case <-ctx.Done():
+				dup.dropped()
+				return
+			case <-timer.C:
+			}
+			send(ctx, outgoing, dup)
+		}()
 	}
-	v := binary.LittleEndian.Uint64(x[:])
-	return float64(v) / float64(math.MaxUint64)
 }
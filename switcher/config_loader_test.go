@@ -0,0 +1,26 @@
+package switcher
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	if _, err := LoadConfig("../example/config.yaml"); err != nil {
+		t.Fatalf("failed to load example config: %v", err)
+	}
+	for name, src := range map[string]string{
+		"unknown field": "targets: {t: {endpoint: ws://localhost, foo: 1}}",
+		"unknown route": "sources: {s: {}}\nroutes: {s: t}",
+		"syntax":        "targets: [",
+	} {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		if err := os.WriteFile(path, []byte(src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadConfig(path); err == nil {
+			t.Errorf("%s: expected config to be rejected", name)
+		}
+	}
+}
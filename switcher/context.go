@@ -2,18 +2,24 @@ package switcher
 
 import "context"
 
-type nameCtxKeyType struct{}
+type routeCtxKeyType struct{}
 
-var nameCtxKey = nameCtxKeyType{}
+var routeCtxKey = routeCtxKeyType{}
 
-func WithName(ctx context.Context, name string) context.Context {
-	return context.WithValue(ctx, nameCtxKey, name)
+type routeNames struct {
+	source string
+	target string
 }
 
-func GetName(ctx context.Context) string {
-	v := ctx.Value(nameCtxKey)
+func WithRoute(ctx context.Context, source, target string) context.Context {
+	return context.WithValue(ctx, routeCtxKey, routeNames{source: source, target: target})
+}
+
+func GetRoute(ctx context.Context) (source, target string) {
+	v := ctx.Value(routeCtxKey)
 	if v == nil {
-		return ""
+		return "", ""
 	}
-	return v.(string)
+	names := v.(routeNames)
+	return names.source, names.target
 }
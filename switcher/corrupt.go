@@ -0,0 +1,276 @@
+package switcher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/protolambda/switcheroo/ws"
+)
+
+// CorruptMode is a way of corrupting a message.
+type CorruptMode string
+
+const (
+	// CorruptFlipBytes flips the bits of random bytes of the frame, likely breaking the JSON.
+	CorruptFlipBytes CorruptMode = "flipBytes"
+	// CorruptTruncate cuts the frame off at a random position.
+	CorruptTruncate CorruptMode = "truncate"
+	// CorruptDropField removes a required field: jsonrpc, id, method, or the result or error.
+	CorruptDropField CorruptMode = "dropField"
+	// CorruptChangeType replaces a random value with a value of another type, e.g. a string with a number.
+	CorruptChangeType CorruptMode = "changeType"
+	// CorruptInvalidHex breaks a random 0x-prefixed string, e.g. by removing the prefix or adding a non-hex character.
+	// Messages without hex strings are not changed.
+	CorruptInvalidHex CorruptMode = "invalidHex"
+)
+
+// corruptModes are all modes, the default of a CorruptEffect.
+var corruptModes = []CorruptMode{CorruptFlipBytes, CorruptTruncate, CorruptDropField, CorruptChangeType, CorruptInvalidHex}
+
+// CorruptEffect sends malformed messages, to test how the other side handles garbage.
+// Messages are corrupted when they are written to the connection, after any other effects,
+// and after request IDs are rewritten for the target.
+type CorruptEffect struct {
+	// Chance corrupts messages with the given probability.
+	// Set to 0 to disable. Negative probability has no effect.
+	Chance float64 `yaml:"chance,omitempty"`
+	// Modes to corrupt messages with, one picked at random for every corrupted message.
+	// Defaults to all modes.
+	Modes []CorruptMode `yaml:"modes,omitempty"`
+	// Bytes is the number of bytes the flipBytes mode flips. Defaults to 1.
+	Bytes int `yaml:"bytes,omitempty"`
+}
+
+func (ef *CorruptEffect) Init() error {
+	for _, mode := range ef.Modes {
+		if !slices.Contains(corruptModes, mode) {
+			return fmt.Errorf("unknown mode %q", mode)
+		}
+	}
+	if ef.Bytes < 0 {
+		return fmt.Errorf("invalid bytes, cannot be negative: %d", ef.Bytes)
+	}
+	return nil
+}
+
+func (ef *CorruptEffect) Run(ctx context.Context, r *effectRand, incoming <-chan *Envelope, outgoing chan<- *Envelope) {
+	defer close(outgoing)
+	modes := ef.Modes
+	if len(modes) == 0 {
+		modes = corruptModes
+	}
+	flips := max(ef.Bytes, 1)
+	for em := range incoming {
+		if r.chance(ef.Chance) {
+			em.observe(eventCorrupted)
+			c := &corruption{
+				mode: modes[int(r.float64()*float64(len(modes)))%len(modes)],
+				prev: em.corrupt,
+			}
+			// draw up front, so the corruption is the same wherever it is applied
+			n := 3
+			if c.mode == CorruptFlipBytes {
+				n = 2 * flips
+			}
+			for range n {
+				c.draws = append(c.draws, r.float64())
+			}
+			em.corrupt = c
+		}
+		send(ctx, outgoing, em)
+	}
+}
+
+// corruption describes how to corrupt the frame of a message.
+type corruption struct {
+	mode CorruptMode
+	// draws are uniform random numbers in the range 0 to 1, that decide the details of the corruption
+	draws []float64
+	// prev is the corruption of an earlier effect, applied first
+	prev *corruption
+}
+
+// pick chooses an index below n, with the i-th draw.
+func (c *corruption) pick(i int, n int) int {
+	return min(int(c.draws[i]*float64(n)), n-1)
+}
+
+// apply corrupts the frame. The given frame is not modified.
+func (c *corruption) apply(frame []byte) []byte {
+	if c.prev != nil {
+		frame = c.prev.apply(frame)
+	}
+	if len(frame) == 0 {
+		return frame
+	}
+	switch c.mode {
+	case CorruptFlipBytes:
+		out := slices.Clone(frame)
+		for i := 0; i+1 < len(c.draws); i += 2 {
+			out[c.pick(i, len(out))] ^= byte(1 + c.pick(i+1, 255))
+		}
+		return out
+	case CorruptTruncate:
+		// keep at least a byte, an empty frame is not a truncated message
+		return slices.Clone(frame[:1+c.pick(0, len(frame)-1)])
+	case CorruptDropField:
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(frame, &fields); err != nil {
+			return frame
+		}
+		var candidates []string
+		for _, k := range []string{"jsonrpc", "id", "method", "result", "error"} {
+			if _, ok := fields[k]; ok {
+				candidates = append(candidates, k)
+			}
+		}
+		if len(candidates) == 0 {
+			return frame
+		}
+		delete(fields, candidates[c.pick(0, len(candidates))])
+		return marshalOr(fields, frame)
+	case CorruptChangeType, CorruptInvalidHex:
+		var v any
+		if err := decodeJSON(frame, &v); err != nil {
+			return frame
+		}
+		var slots []jsonSlot
+		collectSlots(v, func(x any) { v = x }, c.mode == CorruptInvalidHex, &slots)
+		// the root itself is not replaced, the message stays an object
+		if c.mode == CorruptChangeType && len(slots) > 0 {
+			slots = slots[1:]
+		}
+		if len(slots) == 0 {
+			return frame
+		}
+		slot := slots[c.pick(0, len(slots))]
+		if c.mode == CorruptChangeType {
+			slot.set(changeType(slot.value))
+		} else {
+			slot.set(invalidHex(slot.value.(string), c.draws[1], c.draws[2]))
+		}
+		return marshalOr(v, frame)
+	default:
+		return frame
+	}
+}
+
+// jsonSlot is a value in decoded JSON, and a function to replace it.
+type jsonSlot struct {
+	value any
+	set   func(v any)
+}
+
+// collectSlots lists the values in the decoded JSON, depth-first, with object keys in sorted order.
+// If hexOnly, only 0x-prefixed strings are listed.
+func collectSlots(v any, set func(v any), hexOnly bool, out *[]jsonSlot) {
+	if s, ok := v.(string); !hexOnly || (ok && strings.HasPrefix(s, "0x")) {
+		*out = append(*out, jsonSlot{value: v, set: set})
+	}
+	switch x := v.(type) {
+	case map[string]any:
+		keys := make([]string, 0, len(x))
+		for k := range x {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		for _, k := range keys {
+			collectSlots(x[k], func(v any) { x[k] = v }, hexOnly, out)
+		}
+	case []any:
+		for i := range x {
+			collectSlots(x[i], func(v any) { x[i] = v }, hexOnly, out)
+		}
+	}
+}
+
+// changeType returns a value of another type, that JSON RPC clients would not expect.
+func changeType(v any) any {
+	switch x := v.(type) {
+	case string:
+		return json.Number("0")
+	case json.Number:
+		return x.String()
+	case bool:
+		return fmt.Sprint(x)
+	case map[string]any:
+		return []any{}
+	case []any:
+		return map[string]any{}
+	default:
+		return false
+	}
+}
+
+// invalidHex breaks the hex string: the variant draw decides how, the position draw where.
+func invalidHex(s string, variant, position float64) string {
+	digits := strings.TrimPrefix(s, "0x")
+	switch {
+	case variant < 1.0/3:
+		// missing prefix
+		if digits == "" {
+			return "zz"
+		}
+		return digits
+	case variant < 2.0/3 && digits != "":
+		// non-hex character
+		i := min(int(position*float64(len(digits))), len(digits)-1)
+		return "0x" + digits[:i] + "g" + digits[i+1:]
+	default:
+		// trailing non-hex character
+		return s + "z"
+	}
+}
+
+// marshalOr encodes the value, or returns the fallback if it cannot be encoded.
+func marshalOr(v any, fallback []byte) []byte {
+	out, err := json.Marshal(v)
+	if err != nil {
+		return fallback
+	}
+	return out
+}
+
+// frame encodes the message of the envelope, as it is written to the connection.
+// Corrupted messages may not be valid JSON.
+func (en *Envelope) frame() ([]byte, error) {
+	data, err := json.Marshal(&en.Msg)
+	if err != nil {
+		return nil, err
+	}
+	if en.corrupt != nil {
+		data = en.corrupt.apply(data)
+	}
+	return data, nil
+}
+
+// carriesID checks if the corrupted frame still carries the request ID of the message,
+// so the other side can answer it. Frames that lost their ID, e.g. as the field was dropped, are never answered.
+func carriesID(em *Envelope) bool {
+	data, err := em.frame()
+	if err != nil {
+		return false
+	}
+	var fields struct {
+		ID json.RawMessage `json:"id"`
+	}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return false
+	}
+	return string(fields.ID) == string(em.Msg.ID)
+}
+
+// writeEnvelope writes the message to the connection, corrupted if an effect corrupted it.
+func writeEnvelope(rpc ws.JSONRPCConnection, em *Envelope) error {
+	if em.corrupt == nil {
+		return rpc.Write(&em.Msg)
+	}
+	data, err := em.frame()
+	if err != nil {
+		return fmt.Errorf("failed to marshal JSON RPC message: %w", err)
+	}
+	return rpc.WriteRaw(data)
+}
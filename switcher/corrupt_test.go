@@ -0,0 +1,161 @@
+package switcher
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	jsonrpc "github.com/protolambda/jsonrpc2"
+	"github.com/protolambda/websocket"
+)
+
+func TestCorruptApply(t *testing.T) {
+	frame := []byte(`{"jsonrpc":"2.0","id":1,"result":{"number":"0x1b4","hash":"0xabcdef","txs":[true,1]}}`)
+	r := newEffectRand(9)
+	for _, mode := range corruptModes {
+		for range 5 {
+			c := &corruption{mode: mode}
+			for range 6 {
+				c.draws = append(c.draws, r.float64())
+			}
+			out := c.apply(frame)
+			if bytes.Equal(out, frame) {
+				t.Errorf("%s: frame was not corrupted", mode)
+			}
+			if !bytes.Equal(out, c.apply(frame)) {
+				t.Errorf("%s: corruption is not the same when applied again", mode)
+			}
+			switch mode {
+			case CorruptTruncate:
+				if len(out) == 0 || !bytes.HasPrefix(frame, out) {
+					t.Errorf("%s: expected a prefix of the frame, got %s", mode, out)
+				}
+			case CorruptDropField:
+				var fields map[string]json.RawMessage
+				if err := json.Unmarshal(out, &fields); err != nil || len(fields) != 2 {
+					t.Errorf("%s: expected a field less, got %s", mode, out)
+				}
+			case CorruptChangeType, CorruptInvalidHex:
+				if !json.Valid(out) {
+					t.Errorf("%s: expected valid JSON, got %s", mode, out)
+				}
+			}
+		}
+	}
+	// the messages are not changed if there is nothing to corrupt
+	noHex := []byte(`{"jsonrpc":"2.0","id":1,"result":true}`)
+	if out := (&corruption{mode: CorruptInvalidHex, draws: []float64{0, 0, 0}}).apply(noHex); !bytes.Equal(out, noHex) {
+		t.Errorf("expected frame without hex to be unchanged, got %s", out)
+	}
+}
+
+// startRawTarget starts a websocket target that never answers, and collects the frames it receives.
+func startRawTarget(t *testing.T) (endpoint string, frames func() [][]byte) {
+	t.Helper()
+	var mu sync.Mutex
+	var received [][]byte
+	srv := websocket.NewServer[*websocket.Connection](func(c *websocket.Connection, meta *websocket.ConnectionMetadata) (*websocket.Connection, error) {
+		go func() {
+			for {
+				_, data, err := c.Read()
+				if err != nil {
+					return
+				}
+				mu.Lock()
+				received = append(received, bytes.Clone(data))
+				mu.Unlock()
+			}
+		}()
+		return c, nil
+	})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", srv.Handle)
+	s := httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return strings.Replace(s.URL, "http://", "ws://", 1) + "/ws", func() [][]byte {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(received)
+	}
+}
+
+func TestCorruptCapture(t *testing.T) {
+	endpoint, frames := startRawTarget(t)
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	seed := uint64(1)
+	srv := startServer(t, &Config{
+		Seed:    &seed,
+		Targets: map[string]*Target{"t": {Endpoint: endpoint}},
+		Sources: map[string]*Source{"s": {Capture: &Capture{Path: path}, Effects: []*Effect{
+			{RegexMatcher: regexp.MustCompile("^req$"), Direction: DirectionSourceRequest,
+				Corrupt: &CorruptEffect{Chance: 1, Modes: []CorruptMode{CorruptDropField}}},
+		}}},
+		Routes: map[string]string{"s": "t"},
+	})
+	src := dialSource(t, srv, "/dial/s")
+	const n = 20
+	for i := range n {
+		if err := src.Write(request(jsonrpc.RawID(strconv.Itoa(100+i)), "req", `["0x10"]`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var written [][]byte
+	eventually(t, func() bool {
+		written = frames()
+		return len(written) == n
+	})
+	var records []*CaptureRecord
+	eventually(t, func() bool {
+		records = readCapture(t, path)
+		return len(records) == n
+	})
+
+	// the capture records the frames as written to the target, with the request ID of the target connection
+	withID := 0
+	for i, rec := range records {
+		if rec.Outcome != CaptureCorrupted {
+			t.Errorf("record %d: expected corrupted outcome, got %s", i, rec.Outcome)
+		}
+		if !bytes.Equal(rec.Msg, written[i]) {
+			t.Errorf("record %d: expected the written frame %s, got %s", i, written[i], rec.Msg)
+		}
+		var original struct {
+			ID json.RawMessage `json:"id"`
+		}
+		if err := json.Unmarshal(rec.Original, &original); err != nil || string(original.ID) != strconv.Itoa(100+i) {
+			t.Errorf("record %d: expected the original request, got %s", i, rec.Original)
+		}
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(written[i], &fields); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := fields["id"]; ok {
+			withID++
+		}
+	}
+	if withID == 0 || withID == n {
+		t.Fatalf("expected some frames to lose their ID, %d of %d kept it", withID, n)
+	}
+
+	// the requests that lost their ID are never answered, and no longer awaited
+	srv.backend.mu.Lock()
+	ro := srv.backend.routes[1]
+	srv.backend.mu.Unlock()
+	ro.requestsLock.Lock()
+	awaited, timed := len(ro.sourceRequests), len(ro.requestTimes)
+	ro.requestsLock.Unlock()
+	ro.remote.mux.mu.Lock()
+	pending := len(ro.remote.mux.pending)
+	ro.remote.mux.mu.Unlock()
+	if awaited != withID || timed != withID || pending != withID {
+		t.Errorf("expected %d awaited requests, got %d tracked, %d timed and %d pending", withID, awaited, timed, pending)
+	}
+}
@@ -1,13 +1,36 @@
 package switcher
 
-import "net/http"
+import (
+	"net/http"
+	"strings"
+)
 
-func addCorsHeader(res http.ResponseWriter) {
+// originAllowed checks if a browser with the given origin may use the server.
+// Requests without origin do not come from a browser, and are always allowed.
+func originAllowed(origins []string, origin string) bool {
+	if origin == "" {
+		return true
+	}
+	for _, o := range origins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// addCorsHeader allows the origin of the request to read the response, if the origin is allowed.
+func addCorsHeader(res http.ResponseWriter, r *http.Request, origins []string) {
 	headers := res.Header()
-	headers.Add("Access-Control-Allow-Origin", "*")
 	headers.Add("Vary", "Origin")
+	origin := r.Header.Get("Origin")
+	if origin == "" || !originAllowed(origins, origin) {
+		return
+	}
+	headers.Set("Access-Control-Allow-Origin", origin)
 	headers.Add("Vary", "Access-Control-Request-Method")
 	headers.Add("Vary", "Access-Control-Request-Headers")
-	headers.Add("Access-Control-Allow-Headers", "*")
+	// the wildcard does not cover the Authorization header
+	headers.Add("Access-Control-Allow-Headers", "*, Authorization")
 	headers.Add("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
 }
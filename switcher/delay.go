@@ -0,0 +1,181 @@
+package switcher
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// delayDistribution draws extra delays for a DelayEffect.
+type delayDistribution interface {
+	Init() error
+	sample(r *effectRand) time.Duration
+}
+
+// NormalDelay draws delays from a normal distribution. Negative draws add no delay.
+type NormalDelay struct {
+	Mean   time.Duration `yaml:"mean"`
+	StdDev time.Duration `yaml:"stdDev"`
+}
+
+func (d *NormalDelay) Init() error {
+	if d.StdDev < 0 {
+		return fmt.Errorf("normal stdDev must not be negative, got %s", d.StdDev)
+	}
+	return nil
+}
+
+func (d *NormalDelay) sample(r *effectRand) time.Duration {
+	return toDuration(float64(d.Mean) + r.normFloat64()*float64(d.StdDev))
+}
+
+// LogNormalDelay draws delays from a log-normal distribution:
+// most delays are close to the median, with a long tail of slow messages.
+type LogNormalDelay struct {
+	// Median delay. Must be positive.
+	Median time.Duration `yaml:"median"`
+	// Sigma is the standard deviation of the log of the delay, i.e. the shape.
+	// Higher values make the tail heavier, e.g. 1 makes 5% of delays over 5x the median.
+	Sigma float64 `yaml:"sigma"`
+}
+
+func (d *LogNormalDelay) Init() error {
+	if d.Median <= 0 {
+		return fmt.Errorf("logNormal median must be positive, got %s", d.Median)
+	}
+	if d.Sigma < 0 {
+		return fmt.Errorf("logNormal sigma must not be negative, got %v", d.Sigma)
+	}
+	return nil
+}
+
+func (d *LogNormalDelay) sample(r *effectRand) time.Duration {
+	return toDuration(float64(d.Median) * math.Exp(d.Sigma*r.normFloat64()))
+}
+
+// ParetoDelay draws delays from a Pareto distribution: a heavy tail of rare, very long stalls.
+type ParetoDelay struct {
+	// Scale is the minimum delay. Must be positive.
+	Scale time.Duration `yaml:"scale"`
+	// Shape (alpha) of the tail. Must be positive. Lower values make the tail heavier:
+	// with a shape of 1 or lower, the mean delay is unbounded. Consider capping the delay with max.
+	Shape float64 `yaml:"shape"`
+}
+
+func (d *ParetoDelay) Init() error {
+	if d.Scale <= 0 {
+		return fmt.Errorf("pareto scale must be positive, got %s", d.Scale)
+	}
+	if d.Shape <= 0 {
+		return fmt.Errorf("pareto shape must be positive, got %v", d.Shape)
+	}
+	return nil
+}
+
+func (d *ParetoDelay) sample(r *effectRand) time.Duration {
+	// inverse transform, with u in (0, 1]
+	u := 1 - r.float64()
+	return toDuration(float64(d.Scale) / math.Pow(u, 1/d.Shape))
+}
+
+// EmpiricalDelay draws delays from a histogram, e.g. of latencies measured on a real provider.
+type EmpiricalDelay struct {
+	// Path to the histogram file. Every line is the upper bound of a bucket and its count,
+	// separated by whitespace or a comma, e.g. "250ms 42". Buckets are in increasing order,
+	// and the first bucket starts at 0. Delays are uniform within a bucket.
+	// Empty lines, and lines starting with #, are ignored.
+	Path string `yaml:"path"`
+
+	// bounds are the upper bounds of the buckets
+	bounds []time.Duration
+	// cumulative counts of the buckets
+	cumulative []float64
+}
+
+func (d *EmpiricalDelay) Init() error {
+	if d.Path == "" {
+		return errors.New("empirical path must be set")
+	}
+	f, err := os.Open(d.Path)
+	if err != nil {
+		return fmt.Errorf("failed to open histogram: %w", err)
+	}
+	defer f.Close()
+	d.bounds, d.cumulative = nil, nil
+	total := 0.0
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.FieldsFunc(text, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		})
+		if len(fields) != 2 {
+			return fmt.Errorf("histogram line %d: expected bucket bound and count, got %q", line, text)
+		}
+		bound, err := time.ParseDuration(fields[0])
+		if err != nil {
+			return fmt.Errorf("histogram line %d: invalid bucket bound: %w", line, err)
+		}
+		count, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil || count < 0 || math.IsInf(count, 0) {
+			return fmt.Errorf("histogram line %d: invalid count %q", line, fields[1])
+		}
+		if n := len(d.bounds); bound < 0 || (n > 0 && bound <= d.bounds[n-1]) {
+			return fmt.Errorf("histogram line %d: bucket bounds must be increasing", line)
+		}
+		total += count
+		d.bounds = append(d.bounds, bound)
+		d.cumulative = append(d.cumulative, total)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read histogram: %w", err)
+	}
+	if total <= 0 {
+		return errors.New("histogram is empty")
+	}
+	return nil
+}
+
+func (d *EmpiricalDelay) sample(r *effectRand) time.Duration {
+	total := d.cumulative[len(d.cumulative)-1]
+	u := r.float64() * total
+	i := sort.Search(len(d.cumulative), func(i int) bool { return d.cumulative[i] > u })
+	i = min(i, len(d.bounds)-1)
+	var lower time.Duration
+	if i > 0 {
+		lower = d.bounds[i-1]
+	}
+	return lower + time.Duration(r.float64()*float64(d.bounds[i]-lower))
+}
+
+// toDuration converts nanoseconds to a duration, saturating instead of overflowing.
+func toDuration(ns float64) time.Duration {
+	switch {
+	case math.IsNaN(ns):
+		return 0
+	case ns >= math.MaxInt64:
+		return math.MaxInt64
+	case ns <= math.MinInt64:
+		return math.MinInt64
+	default:
+		return time.Duration(ns)
+	}
+}
+
+// addDurations adds two non-negative durations, saturating instead of overflowing,
+// as the tail of a distribution can draw delays close to the max duration.
+func addDurations(a, b time.Duration) time.Duration {
+	if b > math.MaxInt64-a {
+		return math.MaxInt64
+	}
+	return a + b
+}
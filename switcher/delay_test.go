@@ -0,0 +1,137 @@
+package switcher
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	jsonrpc "github.com/protolambda/jsonrpc2"
+	"gopkg.in/yaml.v3"
+)
+
+func parseDelay(t *testing.T, src string) *DelayEffect {
+	t.Helper()
+	var ef DelayEffect
+	if err := yaml.Unmarshal([]byte(src), &ef); err != nil {
+		t.Fatal(err)
+	}
+	if err := ef.Init(); err != nil {
+		t.Fatalf("failed to init %s: %v", src, err)
+	}
+	return &ef
+}
+
+// sampleDelays draws n sorted delays.
+func sampleDelays(ef *DelayEffect, n int) []time.Duration {
+	r := newEffectRand(1)
+	out := make([]time.Duration, n)
+	for i := range out {
+		out[i] = ef.delay(r)
+	}
+	slices.Sort(out)
+	return out
+}
+
+func TestDelayDistributions(t *testing.T) {
+	hist := filepath.Join(t.TempDir(), "histogram.txt")
+	if err := os.WriteFile(hist, []byte("# latency\n10ms 90\n100ms, 0\n1s 10\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		src string
+		// expected ranges of the median and the 99th percentile
+		p50, p99 [2]time.Duration
+	}{
+		{`{normal: {mean: 50ms, stdDev: 10ms}}`,
+			[2]time.Duration{45 * time.Millisecond, 55 * time.Millisecond}, [2]time.Duration{65 * time.Millisecond, 80 * time.Millisecond}},
+		{`{time: 1s, normal: {mean: 50ms, stdDev: 10ms}}`,
+			[2]time.Duration{1045 * time.Millisecond, 1055 * time.Millisecond}, [2]time.Duration{1065 * time.Millisecond, 1080 * time.Millisecond}},
+		{`{logNormal: {median: 50ms, sigma: 1}}`,
+			[2]time.Duration{45 * time.Millisecond, 55 * time.Millisecond}, [2]time.Duration{400 * time.Millisecond, 700 * time.Millisecond}},
+		{`{pareto: {scale: 10ms, shape: 1.2}, max: 2s}`,
+			[2]time.Duration{15 * time.Millisecond, 20 * time.Millisecond}, [2]time.Duration{400 * time.Millisecond, 700 * time.Millisecond}},
+		{`{empirical: {path: "` + hist + `"}}`,
+			[2]time.Duration{0, 10 * time.Millisecond}, [2]time.Duration{100 * time.Millisecond, time.Second}},
+	} {
+		xs := sampleDelays(parseDelay(t, tc.src), 10000)
+		p50, p99 := xs[5000], xs[9900]
+		if p50 < tc.p50[0] || p50 > tc.p50[1] || p99 < tc.p99[0] || p99 > tc.p99[1] {
+			t.Errorf("%s: unexpected p50 %s and p99 %s", tc.src, p50, p99)
+		}
+		if xs[0] < 0 {
+			t.Errorf("%s: negative delay %s", tc.src, xs[0])
+		}
+	}
+}
+
+func TestDelayMax(t *testing.T) {
+	xs := sampleDelays(parseDelay(t, `{pareto: {scale: 10ms, shape: 0.5}, max: 2s}`), 1000)
+	if xs[len(xs)-1] != 2*time.Second {
+		t.Fatalf("expected the tail to be capped at 2s, got %s", xs[len(xs)-1])
+	}
+	// the draws of a heavy tail saturate, instead of overflowing into short or negative delays
+	xs = sampleDelays(parseDelay(t, `{time: 1s, maxJitter: 1s, pareto: {scale: 1h, shape: 0.01}}`), 1000)
+	if xs[0] < time.Hour {
+		t.Fatalf("expected no delay below the scale, got %s", xs[0])
+	}
+	if xs[len(xs)-1] != math.MaxInt64 {
+		t.Fatalf("expected the tail to saturate, got %s", xs[len(xs)-1])
+	}
+}
+
+func TestDelayInvalid(t *testing.T) {
+	for _, src := range []string{
+		`{normal: {stdDev: -1s}}`,
+		`{logNormal: {median: 0s}}`,
+		`{logNormal: {median: 1s, sigma: -1}}`,
+		`{pareto: {scale: 1s}}`,
+		`{pareto: {shape: 1}}`,
+		`{normal: {}, pareto: {scale: 1s, shape: 1}}`,
+		`{empirical: {path: /nonexistent}}`,
+		`{max: -1s}`,
+	} {
+		var ef DelayEffect
+		if err := yaml.Unmarshal([]byte(src), &ef); err != nil {
+			t.Fatal(err)
+		}
+		if err := ef.Init(); err == nil {
+			t.Errorf("expected %s to be rejected", src)
+		}
+	}
+}
+
+func TestDelayKeepOrder(t *testing.T) {
+	for _, keep := range []bool{false, true} {
+		ef := &DelayEffect{Normal: &NormalDelay{Mean: 20 * time.Millisecond, StdDev: 20 * time.Millisecond}, KeepOrder: keep}
+		incoming, outgoing := make(chan *Envelope), make(chan *Envelope)
+		go ef.Run(context.Background(), newEffectRand(3), incoming, outgoing)
+		const n = 50
+		go func() {
+			defer close(incoming)
+			for i := range n {
+				incoming <- &Envelope{Msg: jsonrpc.Message{ID: jsonrpc.RawID(fmt.Sprint(i))}}
+			}
+		}()
+		var got []string
+		for em := range outgoing {
+			got = append(got, string(em.Msg.ID))
+		}
+		if len(got) != n {
+			t.Fatalf("expected %d messages, got %d", n, len(got))
+		}
+		inOrder := slices.IsSortedFunc(got, func(a, b string) int {
+			var x, y int
+			_, _ = fmt.Sscan(a, &x)
+			_, _ = fmt.Sscan(b, &y)
+			return x - y
+		})
+		if inOrder != keep {
+			t.Errorf("keepOrder %v: unexpected order %v", keep, got)
+		}
+	}
+}
@@ -17,6 +17,32 @@ const (
 	DirectionAny            = DirectionBiRequest | DirectionBiResponse          // match any kind of request/response (default).
 )
 
+// MessageDirection classifies a message by kind and by the way it travels.
+// The result is one of DirectionSourceRequest, DirectionSourceResponse,
+// DirectionTargetRequest or DirectionTargetResponse.
+func MessageDirection(request bool, fromSource bool) Direction {
+	switch {
+	case request && fromSource:
+		return DirectionSourceRequest
+	case !request && fromSource:
+		return DirectionSourceResponse
+	case request && !fromSource:
+		return DirectionTargetRequest
+	default:
+		return DirectionTargetResponse
+	}
+}
+
+// Match checks if a message of the given kind, travelling from the source if fromSource,
+// or from the target otherwise, matches the direction.
+// The zero direction is treated as DirectionAny.
+func (d Direction) Match(request bool, fromSource bool) bool {
+	if d == 0 {
+		d = DirectionAny
+	}
+	return d&MessageDirection(request, fromSource) != 0
+}
+
 func (d Direction) MatchRequest() bool {
 	return d&DirectionBiRequest != 0
 }
@@ -41,6 +67,10 @@ func (d Direction) String() string {
 		return "bi-request"
 	case DirectionBiResponse:
 		return "bi-response"
+	case DirectionSourceAny:
+		return "source-any"
+	case DirectionTargetAny:
+		return "target-any"
 	case DirectionSourceRequest:
 		return "source-request"
 	case DirectionSourceResponse:
@@ -63,6 +93,8 @@ func (d Direction) Valid() bool {
 	case DirectionAny,
 		DirectionBiRequest,
 		DirectionBiResponse,
+		DirectionSourceAny,
+		DirectionTargetAny,
 		DirectionSourceRequest,
 		DirectionSourceResponse,
 		DirectionTargetRequest,
@@ -80,6 +112,8 @@ func (d *Direction) UnmarshalText(data []byte) error {
 		DirectionSourceResponse,
 		DirectionTargetRequest,
 		DirectionTargetResponse,
+		DirectionSourceAny,
+		DirectionTargetAny,
 		DirectionBiRequest,
 		DirectionBiResponse,
 		DirectionAny,
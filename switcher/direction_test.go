@@ -0,0 +1,96 @@
+package switcher
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestDirectionMatch(t *testing.T) {
+	type expect struct {
+		sourceRequest  bool
+		sourceResponse bool
+		targetRequest  bool
+		targetResponse bool
+	}
+	testCases := []struct {
+		name string
+		dir  Direction
+		expect
+	}{
+		{"source-request", DirectionSourceRequest, expect{true, false, false, false}},
+		{"source-response", DirectionSourceResponse, expect{false, true, false, false}},
+		{"target-request", DirectionTargetRequest, expect{false, false, true, false}},
+		{"target-response", DirectionTargetResponse, expect{false, false, false, true}},
+		{"source-any", DirectionSourceAny, expect{true, true, false, false}},
+		{"target-any", DirectionTargetAny, expect{false, false, true, true}},
+		{"bi-request", DirectionBiRequest, expect{true, false, true, false}},
+		{"bi-response", DirectionBiResponse, expect{false, true, false, true}},
+		{"any", DirectionAny, expect{true, true, true, true}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.dir.String(); got != tc.name {
+				t.Fatalf("expected name %q, got %q", tc.name, got)
+			}
+			if !tc.dir.Valid() {
+				t.Fatal("expected direction to be valid")
+			}
+			var parsed Direction
+			if err := parsed.UnmarshalText([]byte(tc.name)); err != nil {
+				t.Fatalf("failed to parse direction: %v", err)
+			}
+			if parsed != tc.dir {
+				t.Fatalf("parsed %s, expected %s", parsed, tc.dir)
+			}
+			check := func(request, fromSource, want bool) {
+				t.Helper()
+				if got := tc.dir.Match(request, fromSource); got != want {
+					t.Errorf("request=%v fromSource=%v: expected match %v, got %v",
+						request, fromSource, want, got)
+				}
+			}
+			check(true, true, tc.sourceRequest)
+			check(false, true, tc.sourceResponse)
+			check(true, false, tc.targetRequest)
+			check(false, false, tc.targetResponse)
+		})
+	}
+}
+
+func TestDirectionZeroMatchesAny(t *testing.T) {
+	var d Direction
+	for _, request := range []bool{true, false} {
+		for _, fromSource := range []bool{true, false} {
+			if !d.Match(request, fromSource) {
+				t.Errorf("request=%v fromSource=%v: expected zero direction to match", request, fromSource)
+			}
+		}
+	}
+}
+
+// Each effect applies to the messages of its direction, whether it is an effect of the source or of the target.
+func TestDirectionOnRoute(t *testing.T) {
+	srv := startServer(t, &Config{
+		Targets: map[string]*Target{"t": {Endpoint: startTarget(t), Effects: []*Effect{
+			{Direction: DirectionSourceResponse, Drop: &DropEffect{Chance: 1}},
+			{Direction: DirectionTargetResponse, RegexMatcher: regexp.MustCompile("^b$"), Substitute: &SubstituteEffect{Result: "response"}},
+		}}},
+		Sources: map[string]*Source{"s": {Effects: []*Effect{
+			{Direction: DirectionTargetRequest, Drop: &DropEffect{Chance: 1}},
+			{Direction: DirectionSourceRequest, RegexMatcher: regexp.MustCompile("^c$"), Error: &ErrorEffect{Chance: 1, Code: 7}},
+		}}},
+		Routes: map[string]string{"s": "t"},
+	})
+	src := dialSource(t, srv, "/dial/s")
+	expectResult(t, call(t, src, request("1", "a", "")), "1", "a:1")
+	expectResult(t, call(t, src, request("2", "b", "")), "2", "response")
+	if resp := call(t, src, request("3", "c", "")); resp.Error == nil || resp.Error.Code != 7 {
+		t.Fatalf("expected error, got %s", (&Envelope{Msg: *resp}).JSON())
+	}
+	// the notification of the subscription is a request of the target, and dropped
+	resp := call(t, src, request("4", "eth_subscribe", `["newHeads"]`))
+	if resp.Response == nil || resp.ID != "4" {
+		t.Fatalf("expected subscription, got %s", (&Envelope{Msg: *resp}).JSON())
+	}
+	expectResult(t, call(t, src, request("5", "a", "")), "5", "a:4")
+}
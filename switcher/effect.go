@@ -1,39 +1,49 @@
 package switcher
 
-import "fmt"
+import "context"
 
-func handle(cfg *Config, em *Envelope, sourceName, targetName string) error {
-	src, ok := cfg.Sources[sourceName]
-	if !ok {
-		return fmt.Errorf("unknown source %s", sourceName)
+// applies checks if the effect applies to the message.
+// Whether the effect is configured on the source or the target does not matter,
+// only the kind of message and the way it travels are matched against the effect direction.
+func (ef *Effect) applies(em *Envelope) bool {
+	if !ef.Direction.Match(em.Msg.Request != nil, em.FromSource) {
+		return false
 	}
-	target, ok := cfg.Targets[targetName]
-	if !ok {
-		return fmt.Errorf("unknown target %s", targetName)
+	if ef.RegexMatcher != nil && !ef.RegexMatcher.MatchString(em.Method()) {
+		return false
 	}
-	for _, ef := range src.Effects {
-		if !ef.Direction.MatchSource() {
-			continue
-		}
-		if em.Msg.Request != nil && !ef.Direction.MatchRequest() {
-			continue
-		}
-		if em.Msg.Response != nil && ef.Direction.MatchResponse() {
-			continue
-		}
-		// TODO apply effect
+	if ef.FuncFilter != nil && !ef.FuncFilter(&em.Msg) {
+		return false
 	}
-	for _, ef := range target.Effects {
-		if !ef.Direction.MatchTarget() {
-			continue
-		}
-		if em.Msg.Request != nil && !ef.Direction.MatchRequest() {
-			continue
-		}
-		if em.Msg.Response != nil && ef.Direction.MatchResponse() {
-			continue
-		}
-		// TODO apply effect
+	if ef.Match != nil && !ef.Match.match(em) {
+		return false
+	}
+	return true
+}
+
+// kinds names the sub-effects of the effect, as configured.
+func (ef *Effect) kinds() (out []string) {
+	for _, sub := range ef.subEffects() {
+		out = append(out, sub.kind)
+	}
+	return out
+}
+
+// applied records that the effect applies to the message, if the message is traced.
+func (en *Envelope) applied(ef *Effect) {
+	if en.trace != nil {
+		en.trace.effects = append(en.trace.effects, ef.kinds()...)
+	}
+}
+
+// send passes the message on to the next stage.
+// The message is dropped, and recorded as such, if the context is canceled.
+func send(ctx context.Context, outgoing chan<- *Envelope, em *Envelope) bool {
+	select {
+	case <-ctx.Done():
+		em.dropped()
+		return false
+	case outgoing <- em:
+		return true
 	}
-	return nil
 }
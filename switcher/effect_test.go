@@ -0,0 +1,307 @@
+package switcher
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	jsonrpc "github.com/protolambda/jsonrpc2"
+)
+
+// runEffect runs the effect on its own, and returns the channels to feed and read it.
+func runEffect(t *testing.T, ef *Effect) (chan<- *Envelope, <-chan *Envelope) {
+	t.Helper()
+	if err := ef.Init(); err != nil {
+		t.Fatalf("failed to init effect: %v", err)
+	}
+	t.Cleanup(func() { _ = ef.Close() })
+	incoming, outgoing := make(chan *Envelope), make(chan *Envelope)
+	go ef.Run(context.Background(), 0, incoming, outgoing)
+	return incoming, outgoing
+}
+
+func notification(method string) *Envelope {
+	return &Envelope{Ctx: context.Background(), Msg: jsonrpc.Message{Request: &jsonrpc.Request{Method: method}}}
+}
+
+func matchMethod(method string) func(msg *jsonrpc.Message) bool {
+	return func(msg *jsonrpc.Message) bool { return msg.Method == method }
+}
+
+func TestEffectKeepsOrderOfUnmatched(t *testing.T) {
+	incoming, outgoing := runEffect(t, &Effect{
+		FuncFilter: matchMethod("matched"),
+		Duplicate:  &DuplicateEffect{Chance: 0},
+	})
+	const n = 1000
+	go func() {
+		defer close(incoming)
+		for i := range n {
+			method := "matched"
+			if i%3 == 0 {
+				method = "unmatched"
+			}
+			em := notification(method)
+			em.Msg.Params = jsonrpc.Params(fmt.Sprint(i))
+			incoming <- em
+		}
+	}()
+	i := 0
+	for em := range outgoing {
+		if got := string(em.Msg.Params); got != fmt.Sprint(i) {
+			t.Fatalf("expected message %d, got %s", i, got)
+		}
+		i++
+	}
+	if i != n {
+		t.Fatalf("expected %d messages, got %d", n, i)
+	}
+}
+
+func TestEffectUnmatchedPassesDelayedAndDropped(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		ef   *Effect
+	}{
+		{"delay", &Effect{FuncFilter: matchMethod("matched"), Delay: &DelayEffect{Time: time.Hour}}},
+		{"drop", &Effect{FuncFilter: matchMethod("matched"), Drop: &DropEffect{Chance: 1}}},
+		{"reorder", &Effect{FuncFilter: matchMethod("matched"), Reorder: &ReorderEffect{Window: 10}}},
+		{"rateLimit", &Effect{FuncFilter: matchMethod("matched"), RateLimit: &RateLimitEffect{Rate: 0.001, Burst: 1}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			incoming, outgoing := runEffect(t, tc.ef)
+			if tc.ef.RateLimit != nil {
+				// use up the burst, so the next matched message waits
+				incoming <- notification("matched")
+				<-outgoing
+			}
+			incoming <- notification("matched")
+			incoming <- notification("unmatched")
+			select {
+			case em := <-outgoing:
+				if em.Msg.Method != "unmatched" {
+					t.Fatalf("expected unmatched message, got %s", em.Msg.Method)
+				}
+			case <-time.After(testTimeout):
+				t.Fatal("unmatched message was held up")
+			}
+		})
+	}
+}
+
+func TestEffectsOnRoute(t *testing.T) {
+	dir := Direction(DirectionSourceRequest)
+	srv := startServer(t, &Config{
+		Targets: map[string]*Target{"t": {Endpoint: startTarget(t), Effects: []*Effect{
+			{Direction: dir, RegexMatcher: regexp.MustCompile("^slow$"), Delay: &DelayEffect{Time: 300 * time.Millisecond}},
+			{Direction: dir, RegexMatcher: regexp.MustCompile("^drop$"), Drop: &DropEffect{Chance: 1}},
+			{Direction: dir, RegexMatcher: regexp.MustCompile("^sub$"), Substitute: &SubstituteEffect{Result: map[string]any{"x": []int{1, 2}}}},
+			{Direction: dir, RegexMatcher: regexp.MustCompile("^rl$"), RateLimit: &RateLimitEffect{Rate: 5, Burst: 1}},
+			{RegexMatcher: regexp.MustCompile("^par$"), Parallel: &ParallelEffect{Max: 1}},
+			{Direction: DirectionTargetResponse, RegexMatcher: regexp.MustCompile("^par$"), Delay: &DelayEffect{Time: 200 * time.Millisecond}},
+		}}},
+		Sources: map[string]*Source{"s": {}},
+		Routes:  map[string]string{"s": "t"},
+	})
+	src := dialSource(t, srv, "/dial/s")
+	methods := []string{"slow", "fast", "drop", "sub", "rl", "rl", "rl", "par", "par"}
+	start := time.Now()
+	for i, method := range methods {
+		if err := src.Write(request(jsonrpc.RawID(strconv.Itoa(i)), method, "")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var order []string
+	results := make(map[string]*jsonrpc.Message)
+	arrived := make(map[string]time.Duration)
+	for range len(methods) - 1 {
+		msg := readMsg(t, src)
+		order = append(order, string(msg.ID))
+		results[string(msg.ID)] = msg
+		arrived[string(msg.ID)] = time.Since(start)
+	}
+
+	// only the matching messages are held up
+	if !slices.Contains(order[:slices.Index(order, "0")], "1") {
+		t.Errorf("expected the fast request to overtake the slow one, got order %v", order)
+	}
+	if arrived["0"] < 300*time.Millisecond {
+		t.Errorf("slow request was answered after %s", arrived["0"])
+	}
+	if _, ok := results["2"]; ok {
+		t.Error("expected the dropped request to not be answered")
+	}
+	if res := results["3"].Result; res == nil || string(*res) != `{"x":[1,2]}` {
+		t.Errorf("expected substituted result, got %s", (&Envelope{Msg: *results["3"]}).JSON())
+	}
+	// the burst passes right away, the others wait for the rate
+	if arrived["6"] < 300*time.Millisecond {
+		t.Errorf("rate limited requests were answered after %s", arrived["6"])
+	}
+	// the second parallel request waits for the response to the first
+	if max(arrived["7"], arrived["8"]) < 400*time.Millisecond {
+		t.Errorf("parallel requests were answered after %s and %s", arrived["7"], arrived["8"])
+	}
+	if err := src.Write(request("9", "fast", "")); err != nil {
+		t.Fatal(err)
+	}
+	if msg := readMsg(t, src); msg.ID != "9" {
+		t.Errorf("expected no more responses, got %s", (&Envelope{Msg: *msg}).JSON())
+	}
+}
+
+func TestEffectResponses(t *testing.T) {
+	srv := startServer(t, &Config{
+		Targets: map[string]*Target{"t": {Endpoint: startTarget(t), Effects: []*Effect{
+			{Direction: DirectionSourceRequest, RegexMatcher: regexp.MustCompile("^drop$"), Drop: &DropEffect{Chance: 1, Timeout: 200 * time.Millisecond}},
+			{Direction: DirectionSourceRequest, RegexMatcher: regexp.MustCompile("^err$"), Error: &ErrorEffect{Chance: 1, Code: -1, Message: "boom", Data: map[string]any{"a": 1}}},
+			{Direction: DirectionTargetResponse, RegexMatcher: regexp.MustCompile("^errResponse$"), Error: &ErrorEffect{Chance: 1, Code: -2}},
+		}}},
+		Sources: map[string]*Source{"s": {}},
+		Routes:  map[string]string{"s": "t"},
+	})
+	src := dialSource(t, srv, "/dial/s")
+
+	// requests are answered with the error, with the ID chosen by the source
+	resp := call(t, src, request(`"x"`, "err", ""))
+	if resp.ID != `"x"` || resp.Error == nil || resp.Error.Code != -1 || resp.Error.Message != "boom" ||
+		string(resp.Error.Data) != `{"a":1}` {
+		t.Fatalf("expected error of the effect, got %s", (&Envelope{Msg: *resp}).JSON())
+	}
+	// responses are replaced with the error
+	resp = call(t, src, request("1", "errResponse", ""))
+	if resp.ID != "1" || resp.Error == nil || resp.Error.Code != -2 || resp.Result != nil {
+		t.Fatalf("expected the response to be replaced, got %s", (&Envelope{Msg: *resp}).JSON())
+	}
+	// dropped requests time out
+	start := time.Now()
+	resp = call(t, src, request("2", "drop", ""))
+	if resp.ID != "2" || resp.Error == nil || resp.Error.Code != timeoutErrorCode {
+		t.Fatalf("expected timeout error, got %s", (&Envelope{Msg: *resp}).JSON())
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("dropped request timed out after %s", elapsed)
+	}
+	// dropped notifications are not answered
+	if err := src.Write(&jsonrpc.Message{Request: &jsonrpc.Request{Method: "drop"}}); err != nil {
+		t.Fatal(err)
+	}
+	expectResult(t, call(t, src, request("3", "a", "")), "3", "a:2")
+}
+
+func TestReorderEffect(t *testing.T) {
+	incoming, outgoing := runEffect(t, &Effect{Reorder: &ReorderEffect{Window: 4}})
+	go func() {
+		for i := range 8 {
+			em := notification("x")
+			em.Msg.Params = jsonrpc.Params(strconv.Itoa(i))
+			incoming <- em
+		}
+	}()
+	var got []int
+	for range 8 {
+		em := <-outgoing
+		i, err := strconv.Atoi(string(em.Msg.Params))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, i)
+	}
+	// messages are shuffled within the window
+	for w := 0; w < 8; w += 4 {
+		window := slices.Clone(got[w : w+4])
+		slices.Sort(window)
+		if !slices.Equal(window, []int{w, w + 1, w + 2, w + 3}) {
+			t.Fatalf("expected messages %d to %d to be released together, got %v", w, w+3, got)
+		}
+	}
+	if slices.IsSorted(got) {
+		t.Fatalf("expected messages to be reordered, got %v", got)
+	}
+
+	// messages are released after the timeout, if the window does not fill up
+	incoming, outgoing = runEffect(t, &Effect{Reorder: &ReorderEffect{Window: 10, Timeout: 50 * time.Millisecond}})
+	start := time.Now()
+	incoming <- notification("x")
+	incoming <- notification("x")
+	<-outgoing
+	<-outgoing
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("messages were released after %s", elapsed)
+	}
+}
+
+func TestDuplicateEffect(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	srv := startServer(t, &Config{
+		Targets: map[string]*Target{"t": {Endpoint: startTarget(t)}},
+		Sources: map[string]*Source{"s": {Capture: &Capture{Path: path}, Effects: []*Effect{
+			{RegexMatcher: regexp.MustCompile("^dup$"), Direction: DirectionSourceRequest, Duplicate: &DuplicateEffect{Chance: 1, Delay: 50 * time.Millisecond}},
+		}}},
+		Routes: map[string]string{"s": "t"},
+	})
+	src := dialSource(t, srv, "/dial/s")
+	start := time.Now()
+	// both copies reach the target, and both responses reach the source, with the ID of the source
+	expectResult(t, call(t, src, request("1", "dup", "")), "1", "dup:1")
+	expectResult(t, readMsg(t, src), "1", "dup:2")
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("copy was answered after %s", elapsed)
+	}
+	var records []*CaptureRecord
+	eventually(t, func() bool {
+		records = readCapture(t, path)
+		return len(records) == 4
+	})
+	var outcomes []string
+	for _, rec := range records {
+		outcomes = append(outcomes, rec.Direction.String()+" "+string(rec.Outcome))
+	}
+	want := []string{"source-request forwarded", "target-response forwarded", "source-request injected", "target-response forwarded"}
+	if !slices.Equal(outcomes, want) {
+		t.Fatalf("expected records %v, got %v", want, outcomes)
+	}
+}
+
+func TestParallelEffectRelease(t *testing.T) {
+	srv := startServer(t, &Config{
+		Targets: map[string]*Target{"t": {Endpoint: startTarget(t), Effects: []*Effect{
+			{Parallel: &ParallelEffect{Max: 1}},
+			{Direction: DirectionSourceRequest, RegexMatcher: regexp.MustCompile("^drop$"), Drop: &DropEffect{Chance: 1}},
+		}}},
+		Sources: map[string]*Source{"s": {}},
+		Routes:  map[string]string{"s": "t"},
+	})
+	src := dialSource(t, srv, "/dial/s")
+	// the dropped requests give back their token, so the requests after them are not held up
+	for i := range 3 {
+		if err := src.Write(request(jsonrpc.RawID(strconv.Itoa(i)), "drop", "")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectResult(t, call(t, src, request("3", "x", "")), "3", "x:1")
+
+	for _, tc := range []struct {
+		dir Direction
+		ok  bool
+	}{
+		{0, true},
+		{DirectionAny, true},
+		{DirectionSourceRequest | DirectionTargetResponse, true},
+		{DirectionTargetRequest | DirectionSourceResponse, true},
+		{DirectionSourceRequest, false},
+		{DirectionSourceAny, false},
+		{DirectionBiRequest, false},
+		{DirectionBiRequest | DirectionTargetResponse, false},
+	} {
+		ef := &Effect{Direction: tc.dir, Parallel: &ParallelEffect{Max: 1}}
+		if err := ef.Init(); (err == nil) != tc.ok {
+			t.Errorf("direction %s: expected valid %v, got %v", tc.dir, tc.ok, err)
+		}
+	}
+}
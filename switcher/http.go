@@ -0,0 +1,263 @@
+package switcher
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	jsonrpc "github.com/protolambda/jsonrpc2"
+	"github.com/protolambda/websocket"
+)
+
+const (
+	// maxHTTPBodySize is the maximum size of an HTTP JSON-RPC request body, the same as geth.
+	maxHTTPBodySize = 5 * 1024 * 1024
+	// defaultHTTPTimeout is how long an HTTP request waits for its responses, if the source does not configure it.
+	defaultHTTPTimeout = 30 * time.Second
+)
+
+// errNotificationsUnsupported is returned to subscription requests over HTTP, like geth does.
+var errNotificationsUnsupported = &jsonrpc.ErrorObject{
+	Code:    jsonrpc.MethodNotFound.Code(),
+	Message: "notifications not supported",
+}
+
+// httpExchange is the connection of a user that lives for a single HTTP request.
+type httpExchange struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (h *httpExchange) Close() error {
+	h.cancel()
+	return nil
+}
+
+func (h *httpExchange) CloseCtx() context.Context {
+	return h.ctx
+}
+
+// httpCall is a single message of an HTTP request body.
+type httpCall struct {
+	// msg is the message to send through the route, nil if the message was answered already.
+	msg *jsonrpc.Message
+	// resp is the answer to the message
+	resp *jsonrpc.Message
+	// frame is the encoded answer, if an effect corrupted it
+	frame []byte
+}
+
+// decodeHTTPBody decodes a single message, or a batch of messages.
+// Messages that are not valid requests are answered right away.
+func decodeHTTPBody(body []byte) (calls []*httpCall, batch bool) {
+	body = bytes.TrimLeft(body, " \t\r\n")
+	if len(body) > 0 && body[0] == '[' {
+		var raws []json.RawMessage
+		if err := json.Unmarshal(body, &raws); err != nil {
+			return []*httpCall{{resp: nullErrResponse(jsonrpc.AnnotatedErrorObj(jsonrpc.ParseErr, err))}}, false
+		}
+		if len(raws) == 0 {
+			return []*httpCall{{resp: nullErrResponse(jsonrpc.AnnotatedErrorObj(jsonrpc.InvalidRequest, errors.New("empty batch")))}}, false
+		}
+		for _, raw := range raws {
+			calls = append(calls, decodeHTTPCall(raw))
+		}
+		return calls, true
+	}
+	return []*httpCall{decodeHTTPCall(body)}, false
+}
+
+func decodeHTTPCall(data []byte) *httpCall {
+	var msg jsonrpc.Message
+	if err := json.Unmarshal(data, &msg); err != nil {
+		if !json.Valid(data) {
+			return &httpCall{resp: nullErrResponse(jsonrpc.AnnotatedErrorObj(jsonrpc.ParseErr, err))}
+		}
+		return &httpCall{resp: nullErrResponse(jsonrpc.AnnotatedErrorObj(jsonrpc.InvalidRequest, err))}
+	}
+	if msg.Request == nil {
+		return &httpCall{resp: msg.RespondErr(jsonrpc.AnnotatedErrorObj(jsonrpc.InvalidRequest, errors.New("expected a request")))}
+	}
+	if strings.HasSuffix(msg.Method, "_subscribe") && !msg.ID.IsNotification() {
+		return &httpCall{resp: msg.RespondErr(errNotificationsUnsupported)}
+	}
+	return &httpCall{msg: &msg}
+}
+
+// nullErrResponse is an error response to a message of which the ID is not known.
+func nullErrResponse(errObj *jsonrpc.ErrorObject) *jsonrpc.Message {
+	return &jsonrpc.Message{Response: &jsonrpc.Response{Error: errObj}, ID: "null"}
+}
+
+// handleHTTP serves HTTP JSON-RPC requests, as a short-lived route.
+// The messages of the request pass through the same effects as websocket messages.
+func (ba *Backend) handleHTTP(w http.ResponseWriter, r *http.Request) {
+	origins := ba.cfg.Load().Origins
+	addCorsHeader(w, r, origins)
+	if !originAllowed(origins, r.Header.Get("Origin")) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	sourceName, targetName, ok := ba.dialRoute(w, r)
+	if !ok {
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxHTTPBodySize))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		} else {
+			http.Error(w, fmt.Sprintf("failed to read request: %v", err), http.StatusBadRequest)
+		}
+		return
+	}
+	calls, batch := decodeHTTPBody(body)
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	user, err := ba.startHTTPRoute(r, &httpExchange{ctx: ctx, cancel: cancel}, sourceName, targetName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	timeout := user.cfg.HTTPTimeout
+	if timeout <= 0 {
+		timeout = defaultHTTPTimeout
+	}
+	exchangeHTTP(ctx, user, calls, timeout)
+
+	var out []*httpCall
+	for _, c := range calls {
+		if c.resp != nil {
+			out = append(out, c)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if len(out) == 0 {
+		// only notifications, nothing to respond with
+		return
+	}
+	body, err = encodeHTTPBody(out, batch)
+	if err != nil {
+		user.log.Warn("failed to encode HTTP response", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := w.Write(body); err != nil {
+		user.log.Warn("failed to write HTTP response", "err", err)
+	}
+}
+
+// encodeHTTPBody encodes the answers to the calls, as single message, or as batch.
+// Answers that were corrupted by an effect are written as the corrupted frame.
+func encodeHTTPBody(calls []*httpCall, batch bool) ([]byte, error) {
+	frames := make([][]byte, 0, len(calls))
+	for _, c := range calls {
+		frame := c.frame
+		if frame == nil {
+			var err error
+			if frame, err = json.Marshal(c.resp); err != nil {
+				return nil, fmt.Errorf("failed to encode response: %w", err)
+			}
+		}
+		frames = append(frames, frame)
+	}
+	var body []byte
+	if batch {
+		body = append(body, '[')
+		body = append(body, bytes.Join(frames, []byte{','})...)
+		body = append(body, ']')
+	} else {
+		body = frames[0]
+	}
+	return append(body, '\n'), nil
+}
+
+// startHTTPRoute starts a route for the HTTP request, which ends when the exchange is closed.
+func (ba *Backend) startHTTPRoute(r *http.Request, conn *httpExchange, sourceName, targetName string) (*User, error) {
+	ba.mu.Lock()
+	defer ba.mu.Unlock()
+	src, target, err := ba.cfg.Load().Route(sourceName, targetName)
+	if err != nil {
+		return nil, err
+	}
+	meta := &websocket.ConnectionMetadata{
+		RemoteAddr: r.RemoteAddr,
+		Origin:     r.Header.Get("Origin"),
+		UserAgent:  r.UserAgent(),
+		Context:    conn.ctx,
+	}
+	ba.log.Debug("new HTTP JSON RPC request",
+		"remote", meta.RemoteAddr, "origin", meta.Origin, "source", sourceName, "target", targetName)
+	logger := ba.log.With("source", sourceName, "target", targetName)
+	user := newHTTPUser(logger, conn, meta, sourceName, src)
+	ba.startRoute(logger, user, targetName, src, target)
+	return user, nil
+}
+
+// exchangeHTTP sends the calls through the route of the user, and waits for the responses.
+// Requests that are not answered before the timeout are answered with a timeout error,
+// so a batch response always covers every request of the batch.
+func exchangeHTTP(ctx context.Context, user *User, calls []*httpCall, timeout time.Duration) {
+	// pending calls by request ID, in order, in case the batch reuses an ID
+	pending := make(map[jsonrpc.RawID][]*httpCall)
+	remaining := 0
+	for _, c := range calls {
+		if c.msg == nil {
+			continue
+		}
+		if !c.msg.ID.IsNotification() {
+			pending[c.msg.ID] = append(pending[c.msg.ID], c)
+			remaining += 1
+		}
+		if !send(ctx, user.inwards, &Envelope{Ctx: ctx, Msg: *c.msg}) {
+			break
+		}
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for remaining > 0 {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			user.log.Debug("HTTP request timed out", "unanswered", remaining)
+			for _, cs := range pending {
+				for _, c := range cs {
+					c.resp = c.msg.RespondErr(timeoutErrorObj())
+				}
+			}
+			return
+		case em := <-user.outwards:
+			if em.Msg.Response == nil {
+				// requests and notifications from the target cannot be delivered over HTTP
+				user.log.Debug("dropping message to HTTP source", "msg", em.JSON())
+				continue
+			}
+			cs := pending[em.Msg.ID]
+			if len(cs) == 0 {
+				continue
+			}
+			resp := em.Msg
+			cs[0].resp = &resp
+			if em.corrupt != nil {
+				if frame, err := em.frame(); err == nil {
+					cs[0].frame = frame
+				}
+			}
+			if len(cs) == 1 {
+				delete(pending, em.Msg.ID)
+			} else {
+				pending[em.Msg.ID] = cs[1:]
+			}
+			remaining -= 1
+		}
+	}
+}
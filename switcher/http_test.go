@@ -0,0 +1,87 @@
+package switcher
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// postJSON posts the body to the switch, and returns the status and the decoded response body, if any.
+func postJSON(t *testing.T, srv *Server, path string, body string) (int, any) {
+	t.Helper()
+	resp, err := http.Post("http://"+srv.Address()+path, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("failed to post: %v", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	if len(data) == 0 || resp.Header.Get("Content-Type") != "application/json" {
+		return resp.StatusCode, nil
+	}
+	var out any
+	if err := json.Unmarshal(data, &out); err != nil {
+		t.Fatalf("invalid response %q: %v", data, err)
+	}
+	return resp.StatusCode, out
+}
+
+func TestHTTPSource(t *testing.T) {
+	endpoint, conns := startCountedTarget(t)
+	srv := startServer(t, &Config{
+		Targets: map[string]*Target{"t": {Endpoint: endpoint}},
+		Sources: map[string]*Source{"s": {HTTPTimeout: 200 * time.Millisecond, Effects: []*Effect{
+			{RegexMatcher: regexp.MustCompile("^drop"), Drop: &DropEffect{Chance: 1}},
+			{RegexMatcher: regexp.MustCompile("^err"), Direction: DirectionSourceRequest, Error: &ErrorEffect{Chance: 1, Code: -3, Message: "x"}},
+		}}},
+		Routes: map[string]string{"s": "t"},
+	})
+	check := func(name, body string, wantStatus int, want string) {
+		t.Helper()
+		status, out := postJSON(t, srv, "/dial/s", body)
+		if status != wantStatus {
+			t.Fatalf("%s: expected status %d, got %d", name, wantStatus, status)
+		}
+		if want == "" {
+			if out != nil {
+				t.Fatalf("%s: expected no response, got %v", name, out)
+			}
+			return
+		}
+		var expected any
+		if err := json.Unmarshal([]byte(want), &expected); err != nil {
+			t.Fatal(err)
+		}
+		got, _ := json.Marshal(out)
+		wantJSON, _ := json.Marshal(expected)
+		if string(got) != string(wantJSON) {
+			t.Fatalf("%s: expected %s, got %s", name, wantJSON, got)
+		}
+	}
+	check("single", `{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`, http.StatusOK,
+		`{"jsonrpc":"2.0","id":1,"result":"eth_chainId:1"}`)
+	check("batch", `[{"jsonrpc":"2.0","id":1,"method":"a"},{"jsonrpc":"2.0","id":"x","method":"drop"},{"jsonrpc":"2.0","method":"notif"},`+
+		`{"jsonrpc":"2.0","id":3,"method":"err"},{"jsonrpc":"2.0","id":4,"method":"eth_subscribe"}]`, http.StatusOK,
+		`[{"jsonrpc":"2.0","id":1,"result":"a:2"},{"jsonrpc":"2.0","id":"x","error":{"code":-32002,"message":"request timed out"}},`+
+			`{"jsonrpc":"2.0","id":3,"error":{"code":-3,"message":"x"}},{"jsonrpc":"2.0","id":4,"error":{"code":-32601,"message":"notifications not supported"}}]`)
+	check("reused IDs", `[{"jsonrpc":"2.0","id":1,"method":"a"},{"jsonrpc":"2.0","id":1,"method":"b"}]`, http.StatusOK,
+		`[{"jsonrpc":"2.0","id":1,"result":"a:3"},{"jsonrpc":"2.0","id":1,"result":"b:4"}]`)
+	check("notification", `{"jsonrpc":"2.0","method":"notif"}`, http.StatusOK, "")
+	check("empty batch", `[]`, http.StatusOK, `{"jsonrpc":"2.0","id":null,"error":{"code":-32600,"message":"Invalid Request: empty batch"}}`)
+	if status, out := postJSON(t, srv, "/dial/s", `{bad`); status != http.StatusOK || out.(map[string]any)["error"] == nil {
+		t.Fatalf("expected parse error, got %d %v", status, out)
+	}
+	if status, _ := postJSON(t, srv, "/dial/unknown", `{}`); status != http.StatusNotFound {
+		t.Fatalf("expected unknown source to be rejected, got %d", status)
+	}
+	// the requests share a connection to the target, though each has its own route
+	if n := conns.Load(); n != 1 {
+		t.Fatalf("expected a single connection to the target, got %d", n)
+	}
+}
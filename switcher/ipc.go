@@ -0,0 +1,123 @@
+package switcher
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/protolambda/switcheroo/ws"
+	"github.com/protolambda/websocket"
+)
+
+// ipcListener exposes a source as a unix socket.
+type ipcListener struct {
+	source string
+	path   string
+	ln     net.Listener
+}
+
+// listenIPC starts serving the source on a unix socket at the given path.
+// A stale socket file, left behind by a previous run, is replaced,
+// but a socket that is still in use by another process is not.
+func (ba *Backend) listenIPC(source, path string) (*ipcListener, error) {
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		c, err := net.Dial("unix", path)
+		if err == nil {
+			_ = c.Close()
+			return nil, fmt.Errorf("socket %q is already in use", path)
+		}
+		if !errors.Is(err, syscall.ECONNREFUSED) {
+			return nil, fmt.Errorf("failed to check socket %q: %w", path, err)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket %q: %w", path, err)
+		}
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %q: %w", path, err)
+	}
+	l := &ipcListener{source: source, path: path, ln: ln}
+	ba.log.Info("exposing source over IPC", "source", source, "path", path)
+	go ba.acceptIPC(l)
+	return l, nil
+}
+
+func (ba *Backend) acceptIPC(l *ipcListener) {
+	for {
+		c, err := l.ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				ba.log.Error("failed to accept IPC connection", "source", l.source, "path", l.path, "err", err)
+			}
+			return
+		}
+		if err := ba.onIPCConnect(l, c); err != nil {
+			ba.log.Warn("rejected IPC connection", "source", l.source, "path", l.path, "err", err)
+			_ = c.Close()
+		}
+	}
+}
+
+// onIPCConnect routes a new IPC connection to the default target of the source.
+func (ba *Backend) onIPCConnect(l *ipcListener, c net.Conn) error {
+	if !ba.acceptNew.Load() {
+		return errors.New("not accepting new users")
+	}
+	ba.mu.Lock()
+	defer ba.mu.Unlock()
+	cfg := ba.cfg.Load()
+	sourceName := l.source
+	targetName := cfg.Routes[sourceName]
+	src, target, err := cfg.Route(sourceName, targetName)
+	if err != nil {
+		return err
+	}
+
+	ba.log.Info("new IPC JSON RPC connection to provider",
+		"path", l.path, "source", sourceName, "target", targetName)
+
+	conn := ws.NewStreamJSONRPC(c)
+	meta := &websocket.ConnectionMetadata{
+		RemoteAddr: "unix:" + l.path,
+		Context:    conn.CloseCtx(),
+	}
+	logger := ba.log.With("source", sourceName, "target", targetName)
+	user := newStreamUser(logger, conn, conn, meta, sourceName, src)
+	ba.startRoute(logger, user, targetName, src, target)
+	return nil
+}
+
+// updateIPC starts and stops the IPC listeners of the sources, to match the config.
+// Connections that were accepted by a stopped listener stay open,
+// unless their route is removed.
+// The caller must hold the lock.
+func (ba *Backend) updateIPC(cfg *Config) error {
+	var result error
+	for name, l := range ba.ipc {
+		if src, ok := cfg.Sources[name]; ok && src.IPCPath == l.path {
+			continue
+		}
+		if err := l.ln.Close(); err != nil {
+			result = errors.Join(result, fmt.Errorf("source %q: failed to close IPC listener: %w", name, err))
+		}
+		delete(ba.ipc, name)
+	}
+	for name, src := range cfg.Sources {
+		if src.IPCPath == "" {
+			continue
+		}
+		if _, ok := ba.ipc[name]; ok {
+			continue
+		}
+		l, err := ba.listenIPC(name, src.IPCPath)
+		if err != nil {
+			result = errors.Join(result, fmt.Errorf("source %q: %w", name, err))
+			continue
+		}
+		ba.ipc[name] = l
+	}
+	return result
+}
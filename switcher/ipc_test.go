@@ -0,0 +1,105 @@
+package switcher
+
+import (
+	"bufio"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	jsonrpc "github.com/protolambda/jsonrpc2"
+	"github.com/protolambda/switcheroo/ws"
+)
+
+// startIPCTarget serves a target on a unix socket, that answers requests with "ipc:" and the method.
+func startIPCTarget(t *testing.T, path string) {
+	t.Helper()
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s := ws.NewStreamJSONRPC(c)
+			go func() {
+				defer s.Close()
+				for {
+					var m jsonrpc.Message
+					if err := s.Read(&m); err != nil {
+						return
+					}
+					_ = s.Write(m.Respond("ipc:" + m.Method))
+				}
+			}()
+		}
+	}()
+}
+
+func ipcConfig(targetPath, srcPath string) *Config {
+	return &Config{
+		Targets: map[string]*Target{"t": {Endpoint: "ipc://" + targetPath}},
+		Sources: map[string]*Source{"s": {IPCPath: srcPath}},
+		Routes:  map[string]string{"s": "t"},
+	}
+}
+
+func TestIPC(t *testing.T) {
+	dir := t.TempDir()
+	targetPath := filepath.Join(dir, "geth.ipc")
+	startIPCTarget(t, targetPath)
+	srcPath := filepath.Join(dir, "switch.ipc")
+	// a socket file left behind by a previous run is replaced
+	stale, err := net.Listen("unix", srcPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	_ = stale.Close()
+	startServer(t, ipcConfig(targetPath, srcPath))
+
+	c, err := net.Dial("unix", srcPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// messages and batches can follow each other without separator
+	if _, err := c.Write([]byte(`{"jsonrpc":"2.0","id":1,"method":"a"}[{"jsonrpc":"2.0","id":2,"method":"b"},{"jsonrpc":"2.0","id":3,"method":"c"}]` + "\n")); err != nil {
+		t.Fatal(err)
+	}
+	sc := bufio.NewScanner(c)
+	var results []string
+	for len(results) < 3 && sc.Scan() {
+		results = append(results, sc.Text())
+	}
+	if len(results) != 3 {
+		t.Fatalf("expected 3 responses, got %v: %v", results, sc.Err())
+	}
+	for i, method := range []string{"a", "b", "c"} {
+		if !strings.Contains(results[i], `"ipc:`+method+`"`) {
+			t.Errorf("expected response to %s, got %s", method, results[i])
+		}
+	}
+}
+
+func TestIPCSocketInUse(t *testing.T) {
+	dir := t.TempDir()
+	srcPath := filepath.Join(dir, "switch.ipc")
+	startIPCTarget(t, srcPath)
+	srv := NewServer(testLogger(t), "127.0.0.1:0", ipcConfig(filepath.Join(dir, "geth.ipc"), srcPath), nil)
+	err := srv.Start()
+	_ = srv.Close()
+	if err == nil {
+		t.Fatal("expected a socket that is in use to not be replaced")
+	}
+	// the other process can still be reached
+	c, err := net.Dial("unix", srcPath)
+	if err != nil {
+		t.Fatalf("socket of the other process was removed: %v", err)
+	}
+	_ = c.Close()
+}
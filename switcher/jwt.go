@@ -0,0 +1,79 @@
+package switcher
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// jwtExpiryTimeout is how far the issued-at time of a token may be off, the same as geth.
+const jwtExpiryTimeout = 60 * time.Second
+
+// loadJWTSecret reads a hex-encoded 32 byte secret, in the same format as the geth --authrpc.jwtsecret file.
+func loadJWTSecret(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read JWT secret: %w", err)
+	}
+	secret, err := hex.DecodeString(strings.TrimPrefix(strings.TrimSpace(string(data)), "0x"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWT secret, expected hex: %w", err)
+	}
+	if len(secret) != 32 {
+		return nil, fmt.Errorf("invalid JWT secret, expected 32 bytes, got %d", len(secret))
+	}
+	return secret, nil
+}
+
+// jwtAuthHeader mints a fresh HS256 bearer token, with the current time as issued-at claim,
+// as the Engine API requires.
+func jwtAuthHeader(secret []byte) (http.Header, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+		IssuedAt: jwt.NewNumericDate(time.Now()),
+	})
+	s, err := token.SignedString(secret)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign JWT: %w", err)
+	}
+	header := make(http.Header)
+	header.Set("Authorization", "Bearer "+s)
+	return header, nil
+}
+
+// verifyJWT checks the bearer token of the request, the same way geth checks Engine API requests.
+func verifyJWT(secret []byte, r *http.Request) error {
+	var strToken string
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		strToken = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if len(strToken) == 0 {
+		return errors.New("missing token")
+	}
+	// Only HS256 is allowed, and the claim-check is disabled:
+	// the RegisteredClaims internally requires 'iat' to be no later than 'now', but we allow for a bit of drift.
+	var claims jwt.RegisteredClaims
+	token, err := jwt.ParseWithClaims(strToken, &claims, func(token *jwt.Token) (interface{}, error) {
+		return secret, nil
+	}, jwt.WithValidMethods([]string{"HS256"}), jwt.WithoutClaimsValidation())
+	switch {
+	case err != nil:
+		return err
+	case !token.Valid:
+		return errors.New("invalid token")
+	case !claims.VerifyExpiresAt(time.Now(), false): // optional
+		return errors.New("token is expired")
+	case claims.IssuedAt == nil:
+		return errors.New("missing issued-at")
+	case time.Since(claims.IssuedAt.Time) > jwtExpiryTimeout:
+		return errors.New("stale token")
+	case time.Until(claims.IssuedAt.Time) > jwtExpiryTimeout:
+		return errors.New("future token")
+	}
+	return nil
+}
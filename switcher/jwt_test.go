@@ -0,0 +1,110 @@
+package switcher
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	jsonrpc "github.com/protolambda/jsonrpc2"
+	"github.com/protolambda/switcheroo/ws"
+	"github.com/protolambda/websocket"
+)
+
+func writeJWTSecret(t *testing.T, path string, b byte) []byte {
+	t.Helper()
+	if err := os.WriteFile(path, []byte("0x"+strings.Repeat(fmt.Sprintf("%02x", b), 32)+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	secret, err := loadJWTSecret(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return secret
+}
+
+// startJWTTarget starts a websocket target that only accepts dials authenticated with the current secret,
+// and answers requests with "authed:" and the method.
+func startJWTTarget(t *testing.T, secret *atomic.Pointer[[]byte]) (string, *atomic.Int64) {
+	t.Helper()
+	var dials atomic.Int64
+	srv := websocket.NewServer[*websocket.Connection](func(c *websocket.Connection, meta *websocket.ConnectionMetadata) (*websocket.Connection, error) {
+		rpc := ws.NewJSONRPC(c)
+		go func() {
+			for {
+				var m jsonrpc.Message
+				if err := rpc.Read(&m); err != nil {
+					return
+				}
+				_ = rpc.Write(m.Respond("authed:" + m.Method))
+			}
+		}()
+		return c, nil
+	})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := verifyJWT(*secret.Load(), r); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		dials.Add(1)
+		srv.Handle(w, r)
+	}))
+	t.Cleanup(s.Close)
+	return strings.Replace(s.URL, "http://", "ws://", 1), &dials
+}
+
+func TestJWT(t *testing.T) {
+	secretPath := filepath.Join(t.TempDir(), "jwt.hex")
+	secret := writeJWTSecret(t, secretPath, 0xab)
+	var current atomic.Pointer[[]byte]
+	current.Store(&secret)
+	endpoint, dials := startJWTTarget(t, &current)
+	cfg := func() *Config {
+		return &Config{
+			Targets: map[string]*Target{
+				"authed":   {Endpoint: endpoint, JWTSecret: secretPath},
+				"unauthed": {Endpoint: endpoint},
+			},
+			Sources: map[string]*Source{"s": {JWTSecret: secretPath}},
+			Routes:  map[string]string{"s": "authed"},
+		}
+	}
+	srv := startServer(t, cfg())
+
+	if _, err := websocket.Dial(context.Background(), "ws://"+srv.Address()+"/dial/s"); err == nil {
+		t.Fatal("expected unauthenticated dial to be rejected")
+	}
+	header, err := jwtAuthHeader(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := ws.Dial(context.Background(), "ws://"+srv.Address()+"/dial/s", ws.DialOptions{Header: header})
+	if err != nil {
+		t.Fatalf("failed authenticated dial: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	src := ws.NewJSONRPC(conn)
+	expectResult(t, call(t, src, request("1", "engine_a", "")), "1", "authed:engine_a")
+
+	// a target without secret cannot connect, and the request is left unanswered
+	unauthed, err := ws.Dial(context.Background(), "ws://"+srv.Address()+"/dial/s/unauthed", ws.DialOptions{Header: header})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = unauthed.Close() })
+	eventually(t, func() bool { return srv.backend.remotes["unauthed"].State() == RemoteBackoff })
+
+	// rotating the secret in the same file reconnects the target on reload
+	rotated := writeJWTSecret(t, secretPath, 0xcd)
+	current.Store(&rotated)
+	if err := srv.Reload(cfg()); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, func() bool { return dials.Load() == 2 })
+	expectResult(t, call(t, src, request("2", "engine_b", "")), "2", "authed:engine_b")
+}
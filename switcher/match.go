@@ -0,0 +1,483 @@
+package switcher
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/google/cel-go/cel"
+	celast "github.com/google/cel-go/common/ast"
+	"github.com/google/cel-go/common/operators"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+)
+
+// Match filters messages by their content.
+//
+// Paths and the expression look at the same view of the message:
+//   - method: the method of the request, or of the request that is responded to, if known.
+//   - params: the params of the request, or of the request that is responded to, if known.
+//   - result: the result of the response, if any.
+//   - error: the error of the response, if any, with code, message and data.
+//
+// A message that lacks a field, e.g. a response without a known request, does not match comparisons of that field.
+type Match struct {
+	// Paths are comparisons of values in the message, selected by JSONPath. All must hold.
+	Paths []*PathMatch `yaml:"paths,omitempty"`
+	// Expr is a CEL expression that must evaluate to true, e.g. `params[0] == "latest"`.
+	// Values of the params or result that are compared with numbers are read as quantities:
+	// 0x-prefixed hex and decimal strings are converted, e.g. `result.number > 0x100`.
+	// The quantity function converts values elsewhere, e.g. `quantity(result.gasUsed) * 2 > 0x100`.
+	// Messages for which the expression fails to evaluate do not match, and are logged at debug level.
+	Expr string `yaml:"expr,omitempty"`
+
+	program cel.Program
+}
+
+func (m *Match) Init() error {
+	for i, p := range m.Paths {
+		if err := p.Init(); err != nil {
+			return fmt.Errorf("invalid path %d: %w", i, err)
+		}
+	}
+	if m.Expr != "" {
+		prg, err := compileMatchExpr(m.Expr)
+		if err != nil {
+			return fmt.Errorf("invalid expr: %w", err)
+		}
+		m.program = prg
+	}
+	return nil
+}
+
+// match checks if the message matches all paths and the expression.
+func (m *Match) match(em *Envelope) bool {
+	view, err := newMatchView(em)
+	if err != nil {
+		return false
+	}
+	for _, p := range m.Paths {
+		if !p.match(view) {
+			return false
+		}
+	}
+	if m.program != nil {
+		out, _, err := m.program.Eval(map[string]any{
+			"method": view["method"],
+			"params": celValue(view["params"]),
+			"result": celValue(view["result"]),
+			"error":  celValue(view["error"]),
+		})
+		if err != nil {
+			if em.Route != nil {
+				em.Route.log.Debug("match expression failed to evaluate", "expr", m.Expr, "err", err)
+			}
+			return false
+		}
+		if ok, isBool := out.Value().(bool); !isBool || !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// newMatchView decodes the message into the view that paths and expressions are matched against.
+// Numbers are decoded as json.Number, so large numbers are not rounded.
+func newMatchView(em *Envelope) (map[string]any, error) {
+	view := map[string]any{"method": em.Method()}
+	if em.Request != nil && len(em.Request.Params) > 0 {
+		var params any
+		if err := decodeJSON(em.Request.Params, &params); err != nil {
+			return nil, fmt.Errorf("failed to decode params: %w", err)
+		}
+		view["params"] = params
+	}
+	if em.Msg.Response != nil {
+		if em.Msg.Result != nil {
+			var result any
+			if err := decodeJSON(*em.Msg.Result, &result); err != nil {
+				return nil, fmt.Errorf("failed to decode result: %w", err)
+			}
+			view["result"] = result
+		}
+		if em.Msg.Error != nil {
+			errObj := map[string]any{
+				"code":    json.Number(strconv.FormatInt(em.Msg.Error.Code, 10)),
+				"message": em.Msg.Error.Message,
+			}
+			if len(em.Msg.Error.Data) > 0 {
+				var data any
+				if err := decodeJSON(em.Msg.Error.Data, &data); err != nil {
+					return nil, fmt.Errorf("failed to decode error data: %w", err)
+				}
+				errObj["data"] = data
+			}
+			view["error"] = errObj
+		}
+	}
+	return view, nil
+}
+
+// MatchOp is a comparison of a PathMatch.
+type MatchOp string
+
+const (
+	MatchEqual        MatchOp = "=="
+	MatchNotEqual     MatchOp = "!="
+	MatchLess         MatchOp = "<"
+	MatchLessEqual    MatchOp = "<="
+	MatchGreater      MatchOp = ">"
+	MatchGreaterEqual MatchOp = ">="
+	// MatchRegex matches a string against the regex of the value.
+	MatchRegex MatchOp = "matches"
+	// MatchExists checks if the path is present, or absent if the value is false.
+	MatchExists MatchOp = "exists"
+)
+
+// PathMatch compares a value in the message with a configured value.
+type PathMatch struct {
+	// Path selects the value, e.g. "$.params[0]", "$.result.number" or "$.error.code".
+	// Supported are the root "$", child names ".name" or "['name']", and array indices "[0]",
+	// with negative indices counting from the end.
+	Path string `yaml:"path"`
+	// Op is the comparison. Defaults to "==".
+	// The ordering comparisons convert both sides to integers,
+	// so hex quantities like "0x1b4" can be compared with numbers like 0x100.
+	// Equality compares numbers the same way, and other values exactly.
+	Op MatchOp `yaml:"op,omitempty"`
+	// Value to compare with.
+	Value any `yaml:"value,omitempty"`
+
+	steps []pathStep
+	value any
+	regex *regexp.Regexp
+}
+
+func (p *PathMatch) Init() error {
+	steps, err := parsePath(p.Path)
+	if err != nil {
+		return fmt.Errorf("invalid path %q: %w", p.Path, err)
+	}
+	p.steps = steps
+	if p.Op == "" {
+		p.Op = MatchEqual
+	}
+	// normalize the value like the decoded message, so they can be compared
+	data, err := json.Marshal(p.Value)
+	if err != nil {
+		return fmt.Errorf("invalid value: %w", err)
+	}
+	if err := decodeJSON(data, &p.value); err != nil {
+		return fmt.Errorf("invalid value: %w", err)
+	}
+	switch p.Op {
+	case MatchEqual, MatchNotEqual:
+	case MatchLess, MatchLessEqual, MatchGreater, MatchGreaterEqual:
+		if _, err := toBig(p.value); err != nil {
+			return fmt.Errorf("op %q needs an integer value: %w", p.Op, err)
+		}
+	case MatchRegex:
+		s, ok := p.value.(string)
+		if !ok {
+			return fmt.Errorf("op %q needs a regex value", p.Op)
+		}
+		if p.regex, err = regexp.Compile(s); err != nil {
+			return fmt.Errorf("invalid regex: %w", err)
+		}
+	case MatchExists:
+		if p.value == nil {
+			p.value = true
+		}
+		if _, ok := p.value.(bool); !ok {
+			return fmt.Errorf("op %q needs a boolean value", p.Op)
+		}
+	default:
+		return fmt.Errorf("unknown op %q", p.Op)
+	}
+	return nil
+}
+
+func (p *PathMatch) match(view map[string]any) bool {
+	v, ok := selectPath(view, p.steps)
+	if p.Op == MatchExists {
+		return ok == p.value.(bool)
+	}
+	if !ok {
+		return false
+	}
+	switch p.Op {
+	case MatchEqual:
+		return matchEqual(v, p.value)
+	case MatchNotEqual:
+		return !matchEqual(v, p.value)
+	case MatchRegex:
+		s, isStr := v.(string)
+		return isStr && p.regex.MatchString(s)
+	default:
+		x, err := toBig(v)
+		if err != nil {
+			return false
+		}
+		y, _ := toBig(p.value)
+		c := x.Cmp(y)
+		switch p.Op {
+		case MatchLess:
+			return c < 0
+		case MatchLessEqual:
+			return c <= 0
+		case MatchGreater:
+			return c > 0
+		case MatchGreaterEqual:
+			return c >= 0
+		}
+		return false
+	}
+}
+
+// matchEqual compares a value of the message with the configured value.
+// If the configured value is a number, the value of the message may also be a number-string.
+func matchEqual(v, want any) bool {
+	if n, ok := want.(json.Number); ok {
+		if y, err := toBig(n); err == nil {
+			x, err := toBig(v)
+			return err == nil && x.Cmp(y) == 0
+		}
+	}
+	return reflect.DeepEqual(v, want)
+}
+
+// pathStep selects a child of an object by name, or an element of an array by index.
+type pathStep struct {
+	name  string
+	index int
+	// isIndex is true if the step selects an array element
+	isIndex bool
+}
+
+// parsePath parses the supported subset of JSONPath.
+func parsePath(path string) ([]pathStep, error) {
+	rest, ok := strings.CutPrefix(path, "$")
+	if !ok {
+		return nil, errors.New("path must start with $")
+	}
+	var steps []pathStep
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, errors.New("empty name")
+			}
+			steps = append(steps, pathStep{name: rest[:end]})
+			rest = rest[end:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, errors.New("unclosed [")
+			}
+			inner := rest[1:end]
+			rest = rest[end+1:]
+			if len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0] {
+				steps = append(steps, pathStep{name: inner[1 : len(inner)-1]})
+				continue
+			}
+			i, err := strconv.Atoi(inner)
+			if err != nil {
+				return nil, fmt.Errorf("invalid index %q", inner)
+			}
+			steps = append(steps, pathStep{index: i, isIndex: true})
+		default:
+			return nil, fmt.Errorf("unexpected %q", rest[0])
+		}
+	}
+	return steps, nil
+}
+
+// selectPath finds the value at the path, and reports whether it is present.
+func selectPath(v any, steps []pathStep) (any, bool) {
+	for _, step := range steps {
+		if step.isIndex {
+			arr, ok := v.([]any)
+			if !ok {
+				return nil, false
+			}
+			i := step.index
+			if i < 0 {
+				i += len(arr)
+			}
+			if i < 0 || i >= len(arr) {
+				return nil, false
+			}
+			v = arr[i]
+		} else {
+			obj, ok := v.(map[string]any)
+			if !ok {
+				return nil, false
+			}
+			if v, ok = obj[step.name]; !ok {
+				return nil, false
+			}
+		}
+	}
+	return v, true
+}
+
+// compileMatchExpr compiles a CEL expression over the match view of a message.
+func compileMatchExpr(expr string) (cel.Program, error) {
+	env, err := cel.NewEnv(
+		cel.Variable("method", cel.StringType),
+		cel.Variable("params", cel.DynType),
+		cel.Variable("result", cel.DynType),
+		cel.Variable("error", cel.DynType),
+		cel.Function("quantity",
+			cel.Overload("quantity_dyn", []*cel.Type{cel.DynType}, cel.IntType,
+				cel.UnaryBinding(celQuantity))),
+		cel.Function(celNumberFunction,
+			cel.Overload("number_dyn", []*cel.Type{cel.DynType}, cel.DynType,
+				cel.UnaryBinding(celNumber))),
+	)
+	if err != nil {
+		return nil, err
+	}
+	parsed, iss := env.Parse(expr)
+	if iss.Err() != nil {
+		return nil, iss.Err()
+	}
+	convertNumberComparisons(parsed)
+	ast, iss := env.Check(parsed)
+	if iss.Err() != nil {
+		return nil, iss.Err()
+	}
+	if out := ast.OutputType(); !out.IsExactType(cel.BoolType) && !out.IsExactType(cel.DynType) {
+		return nil, fmt.Errorf("expression must be boolean, got %s", out)
+	}
+	return env.Program(ast)
+}
+
+// celNumberFunction converts values of the params or result that are compared with numbers.
+// It cannot be called from expressions, the name is not a valid identifier.
+const celNumberFunction = "@number"
+
+// convertNumberComparisons converts the values of the params or result that are compared with number literals,
+// so hex quantities, which are strings, compare as the numbers they encode.
+func convertNumberComparisons(ast *cel.Ast) {
+	native := ast.NativeRep()
+	root := celast.NavigateAST(native)
+	var nextID int64
+	for _, e := range celast.MatchDescendants(root, func(celast.NavigableExpr) bool { return true }) {
+		nextID = max(nextID, e.ID())
+	}
+	fac := celast.NewExprFactory()
+	for _, op := range []string{operators.Equals, operators.NotEquals,
+		operators.Less, operators.LessEquals, operators.Greater, operators.GreaterEquals} {
+		for _, cmp := range celast.MatchDescendants(root, celast.FunctionMatcher(op)) {
+			args := cmp.AsCall().Args()
+			if len(args) != 2 {
+				continue
+			}
+			for i, arg := range args {
+				other := args[1-i]
+				if other.Kind() != celast.LiteralKind {
+					continue
+				}
+				switch other.AsLiteral().(type) {
+				case types.Int, types.Uint, types.Double:
+				default:
+					continue
+				}
+				if messageVariable(arg) == "" {
+					continue
+				}
+				value := fac.CopyExpr(arg)
+				value.RenumberIDs(func(int64) int64 {
+					nextID++
+					return nextID
+				})
+				nextID++
+				arg.SetKindCase(fac.NewCall(nextID, celNumberFunction, value))
+			}
+		}
+	}
+}
+
+// messageVariable returns the params or result variable that the expression selects from, if any.
+func messageVariable(e celast.Expr) string {
+	for {
+		switch e.Kind() {
+		case celast.IdentKind:
+			if name := e.AsIdent(); name == "params" || name == "result" {
+				return name
+			}
+			return ""
+		case celast.SelectKind:
+			e = e.AsSelect().Operand()
+		case celast.CallKind:
+			call := e.AsCall()
+			if call.FunctionName() != operators.Index || len(call.Args()) != 2 {
+				return ""
+			}
+			e = call.Args()[0]
+		default:
+			return ""
+		}
+	}
+}
+
+// celQuantity converts a number, or a decimal or 0x-prefixed hex number-string, to an integer.
+func celQuantity(v ref.Val) ref.Val {
+	x, err := toBig(v.Value())
+	if err != nil {
+		return types.NewErr("%v", err)
+	}
+	if !x.IsInt64() {
+		return types.NewErr("quantity %s overflows int", x)
+	}
+	return types.Int(x.Int64())
+}
+
+// celNumber converts a decimal or 0x-prefixed hex number-string to an integer, and keeps numbers as they are.
+func celNumber(v ref.Val) ref.Val {
+	switch v.(type) {
+	case types.Int, types.Uint, types.Double:
+		return v
+	case types.String:
+		return celQuantity(v)
+	default:
+		return types.NewErr("cannot compare %s with a number", v.Type())
+	}
+}
+
+// celValue converts decoded JSON to values that CEL understands:
+// numbers become integers, or doubles if they are not integral.
+func celValue(v any) any {
+	switch x := v.(type) {
+	case json.Number:
+		if i, err := x.Int64(); err == nil {
+			return i
+		}
+		f, _ := x.Float64()
+		return f
+	case []any:
+		out := make([]any, len(x))
+		for i, e := range x {
+			out[i] = celValue(e)
+		}
+		return out
+	case map[string]any:
+		out := make(map[string]any, len(x))
+		for k, e := range x {
+			out[k] = celValue(e)
+		}
+		return out
+	default:
+		return v
+	}
+}
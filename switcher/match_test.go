@@ -0,0 +1,126 @@
+package switcher
+
+import (
+	"encoding/json"
+	"testing"
+
+	jsonrpc "github.com/protolambda/jsonrpc2"
+	"gopkg.in/yaml.v3"
+)
+
+func parseMatch(t *testing.T, src string) *Match {
+	t.Helper()
+	var m Match
+	if err := yaml.Unmarshal([]byte(src), &m); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Init(); err != nil {
+		t.Fatalf("failed to init match: %v", err)
+	}
+	return &m
+}
+
+// matchResponse is a response with the result, to a request with the method and params.
+func matchResponse(method, params, result string) *Envelope {
+	res := json.RawMessage(result)
+	return &Envelope{
+		Request: &jsonrpc.Request{Method: method, Params: jsonrpc.Params(params)},
+		Msg:     jsonrpc.Message{Response: &jsonrpc.Response{Result: &res}},
+	}
+}
+
+func TestMatchPaths(t *testing.T) {
+	m := parseMatch(t, `
+paths:
+  - path: "$.params[0]"
+    value: "latest"
+  - path: "$.params[-1]"
+    value: true
+  - path: "$.result.number"
+    op: ">"
+    value: 0x100
+  - path: "$.result['hash']"
+    op: matches
+    value: "^0xab"
+  - path: "$.error"
+    op: exists
+    value: false
+`)
+	for _, tc := range []struct {
+		name   string
+		em     *Envelope
+		expect bool
+	}{
+		{"match", matchResponse("eth_getBlockByNumber", `["latest", true]`, `{"number":"0x1b4","hash":"0xabcd"}`), true},
+		{"low number", matchResponse("eth_getBlockByNumber", `["latest", true]`, `{"number":"0x10","hash":"0xabcd"}`), false},
+		{"other block", matchResponse("eth_getBlockByNumber", `["0x5", true]`, `{"number":"0x1b4","hash":"0xabcd"}`), false},
+		{"other hash", matchResponse("eth_getBlockByNumber", `["latest", true]`, `{"number":"0x1b4","hash":"0xcd"}`), false},
+		{"no result", matchResponse("eth_getBlockByNumber", `["latest", true]`, `null`), false},
+	} {
+		if got := m.match(tc.em); got != tc.expect {
+			t.Errorf("%s: expected match %v, got %v", tc.name, tc.expect, got)
+		}
+	}
+}
+
+func TestMatchExpr(t *testing.T) {
+	for _, tc := range []struct {
+		expr   string
+		em     *Envelope
+		expect bool
+	}{
+		{`method == "eth_getBlockByNumber" && params[1] == true && size(params) == 2`,
+			matchResponse("eth_getBlockByNumber", `["latest", true]`, `{}`), true},
+		{`quantity(result.number) > 0x100`, matchResponse("eth_getBlockByNumber", `[]`, `{"number":"0x1b4"}`), true},
+		{`quantity(result.number) > 0x100`, matchResponse("eth_getBlockByNumber", `[]`, `{"number":"0x10"}`), false},
+		{`0x100 <= quantity(result.number)`, matchResponse("eth_getBlockByNumber", `[]`, `{"number":"0x100"}`), true},
+		{`quantity(result.number) == 0x1b4`, matchResponse("eth_getBlockByNumber", `[]`, `{"number":"0x1b4"}`), true},
+		{`quantity(params[0]) < 10`, matchResponse("eth_feeHistory", `[7]`, `{}`), true},
+		{`size(params) < 2`, matchResponse("eth_feeHistory", `[7]`, `{}`), true},
+		// values that are not quantities fail to evaluate, and do not match
+		{`quantity(result.number) > 0x100`, matchResponse("eth_getBlockByNumber", `[]`, `{"number":"pending"}`), false},
+		{`quantity(result.number) > 0x100`, matchResponse("eth_getBlockByNumber", `[]`, `{}`), false},
+		{`result.hash.startsWith("0xab")`, matchResponse("eth_getBlockByNumber", `[]`, `{"hash":"0xabcd"}`), true},
+		// values compared with numbers are read as quantities
+		{`result.number > 0x100`, matchResponse("eth_getBlockByNumber", `[]`, `{"number":"0x1b4"}`), true},
+		{`result.number > 0x100`, matchResponse("eth_getBlockByNumber", `[]`, `{"number":"0x10"}`), false},
+		{`result.number == 0x200`, matchResponse("eth_getBlockByNumber", `[]`, `{"number":"0x200"}`), true},
+		{`result.number != 0x200`, matchResponse("eth_getBlockByNumber", `[]`, `{"number":"0x200"}`), false},
+		{`0x100 <= params[0].number && params[1] == 7`, matchResponse("eth_call", `[{"number":"256"}, 7]`, `{}`), true},
+		{`result["number"] >= 1.5`, matchResponse("eth_getBlockByNumber", `[]`, `{"number":"0x2"}`), true},
+		{`result.number == "0x200"`, matchResponse("eth_getBlockByNumber", `[]`, `{"number":"0x200"}`), true},
+		{`result.number > 0x100`, matchResponse("eth_getBlockByNumber", `[]`, `{"number":true}`), false},
+	} {
+		m := parseMatch(t, "expr: '"+tc.expr+"'")
+		if got := m.match(tc.em); got != tc.expect {
+			t.Errorf("%s on %s: expected match %v, got %v", tc.expr, *tc.em.Msg.Result, tc.expect, got)
+		}
+	}
+
+	m := parseMatch(t, `{paths: [{path: "$.error.code", value: -32000}], expr: "error.code <= -32000 && error.message.startsWith('x')"}`)
+	em := &Envelope{Msg: jsonrpc.Message{Response: &jsonrpc.Response{Error: &jsonrpc.ErrorObject{Code: -32000, Message: "xy"}}}}
+	if !m.match(em) {
+		t.Error("expected error to match")
+	}
+}
+
+func TestMatchInvalid(t *testing.T) {
+	for _, src := range []string{
+		`{expr: "params +"}`,
+		`{expr: "1"}`,
+		`{expr: "@number(result) > 1"}`,
+		`{paths: [{path: "params"}]}`,
+		`{paths: [{path: "$.a", op: ">", value: x}]}`,
+		`{paths: [{path: "$.a", op: "matches", value: "("}]}`,
+		`{paths: [{path: "$.a", op: "exists", value: 1}]}`,
+		`{paths: [{path: "$.a", op: "~"}]}`,
+	} {
+		var m Match
+		if err := yaml.Unmarshal([]byte(src), &m); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Init(); err == nil {
+			t.Errorf("expected %s to be rejected", src)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package switcher
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "switcheroo"
+
+// messageEvent is something that happened to a message, counted in the metrics.
+type messageEvent int
+
+const (
+	eventIn          messageEvent = iota // the message entered the effects of a route
+	eventOut                             // the message left the effects of a route
+	eventDropped                         // an effect discarded the message
+	eventErrored                         // an effect answered or replaced the message with an error
+	eventSubstituted                     // an effect answered or replaced the message with a substitute result
+	eventDuplicated                      // an effect passed the message on twice
+	eventCorrupted                       // an effect corrupted the message
+)
+
+// metrics of a backend.
+type metrics struct {
+	registry *prometheus.Registry
+
+	// message counters, by messageEvent
+	events [7]*prometheus.CounterVec
+	// latency of requests from the source, until the response leaves towards the source
+	latency *prometheus.HistogramVec
+	// connections are the open users, by source and target
+	connections *prometheus.GaugeVec
+}
+
+func newMetrics(ba *Backend) *metrics {
+	m := &metrics{registry: prometheus.NewRegistry()}
+	messageLabels := []string{"source", "target", "method", "direction"}
+	for ev, name := range map[messageEvent]string{
+		eventIn:          "in",
+		eventOut:         "out",
+		eventDropped:     "dropped",
+		eventErrored:     "errored",
+		eventSubstituted: "substituted",
+		eventDuplicated:  "duplicated",
+		eventCorrupted:   "corrupted",
+	} {
+		m.events[ev] = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "messages_" + name + "_total",
+			Help:      "Number of messages " + name + ", by source, target, method and direction.",
+		}, messageLabels)
+		m.registry.MustRegister(m.events[ev])
+	}
+	m.latency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "request_latency_seconds",
+		Help:      "Time from a request of the source entering the switch, until the response leaves towards the source.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 16),
+	}, []string{"source", "target", "method"})
+	m.connections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "connections",
+		Help:      "Number of open source connections, by source and target.",
+	}, []string{"source", "target"})
+	m.registry.MustRegister(
+		m.latency,
+		m.connections,
+		&effectsCollector{backend: ba},
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// observeLatency measures the time since the request of the source entered the switch.
+func (m *metrics) observeLatency(ro *Route, method string, since time.Time) {
+	m.latency.WithLabelValues(ro.sourceName, ro.targetName, methodLabel(method)).Observe(time.Since(since).Seconds())
+}
+
+// observe counts the event of the message.
+func (m *metrics) observe(em *Envelope, ev messageEvent) {
+	m.events[ev].WithLabelValues(em.Route.sourceName, em.Route.targetName, methodLabel(em.Method()),
+		MessageDirection(em.Msg.Request != nil, em.FromSource).String()).Inc()
+}
+
+// otherMethod is the method label of all methods that are not known.
+const otherMethod = "other"
+
+// knownMethods are the methods that are labeled by name in the metrics.
+// Sources choose the methods they call, so any other method is labeled as otherMethod,
+// to keep the number of series bounded.
+var knownMethods = methodSet(
+	"web3_clientVersion", "web3_sha3",
+	"net_version", "net_listening", "net_peerCount",
+	"eth_accounts", "eth_blobBaseFee", "eth_blockNumber", "eth_call", "eth_chainId", "eth_coinbase",
+	"eth_createAccessList", "eth_estimateGas", "eth_feeHistory", "eth_gasPrice",
+	"eth_getBalance", "eth_getBlockByHash", "eth_getBlockByNumber", "eth_getBlockReceipts",
+	"eth_getBlockTransactionCountByHash", "eth_getBlockTransactionCountByNumber",
+	"eth_getCode", "eth_getFilterChanges", "eth_getFilterLogs", "eth_getLogs", "eth_getProof",
+	"eth_getStorageAt", "eth_getTransactionByBlockHashAndIndex", "eth_getTransactionByBlockNumberAndIndex",
+	"eth_getTransactionByHash", "eth_getTransactionCount", "eth_getTransactionReceipt",
+	"eth_getUncleByBlockHashAndIndex", "eth_getUncleByBlockNumberAndIndex",
+	"eth_getUncleCountByBlockHash", "eth_getUncleCountByBlockNumber",
+	"eth_maxPriorityFeePerGas", "eth_newBlockFilter", "eth_newFilter", "eth_newPendingTransactionFilter",
+	"eth_sendRawTransaction", "eth_sendTransaction", "eth_sign", "eth_signTransaction",
+	"eth_simulateV1", "eth_syncing", "eth_uninstallFilter",
+	"eth_subscribe", "eth_unsubscribe", "eth_subscription",
+	"debug_getBadBlocks", "debug_getRawBlock", "debug_getRawHeader", "debug_getRawReceipts",
+	"debug_getRawTransaction", "debug_traceBlockByHash", "debug_traceBlockByNumber",
+	"debug_traceCall", "debug_traceTransaction",
+	"engine_exchangeCapabilities",
+)
+
+// knownEngineMethods are the Engine API methods, without version suffix, that are labeled by name,
+// with any single-digit version, e.g. engine_newPayloadV3.
+var knownEngineMethods = methodSet(
+	"engine_newPayload", "engine_forkchoiceUpdated", "engine_getPayload",
+	"engine_getPayloadBodiesByHash", "engine_getPayloadBodiesByRange",
+	"engine_exchangeTransitionConfiguration", "engine_getClientVersion", "engine_getBlobs",
+)
+
+func methodSet(methods ...string) map[string]struct{} {
+	out := make(map[string]struct{}, len(methods))
+	for _, method := range methods {
+		out[method] = struct{}{}
+	}
+	return out
+}
+
+// methodLabel is the method as labeled in the metrics: the method if it is known, or else otherMethod.
+// Messages of which the method is not known, e.g. responses to untracked requests, have an empty label.
+func methodLabel(method string) string {
+	if method == "" {
+		return ""
+	}
+	if _, ok := knownMethods[method]; ok {
+		return method
+	}
+	if n := len(method); n > 2 && method[n-2] == 'V' && method[n-1] >= '0' && method[n-1] <= '9' {
+		if _, ok := knownEngineMethods[method[:n-2]]; ok {
+			return method
+		}
+	}
+	return otherMethod
+}
+
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// observe counts the event of the message, if the message is on a route.
+func (en *Envelope) observe(ev messageEvent) {
+	if en.Route != nil && en.Route.metrics != nil {
+		en.Route.metrics.observe(en, ev)
+	}
+}
+
+var (
+	parallelTokensDesc = prometheus.NewDesc(metricsNamespace+"_parallel_tokens_in_use",
+		"Number of requests holding a token of a parallel effect, awaiting a response.",
+		[]string{"scope", "name", "effect"}, nil)
+	rateLimitWaitDesc = prometheus.NewDesc(metricsNamespace+"_rate_limit_wait_seconds",
+		"Time a new message would wait for a reservation of a rate-limit effect.",
+		[]string{"scope", "name", "effect"}, nil)
+)
+
+// effectsCollector reports the state of the effects of the current config, when scraped.
+// Effects are identified by the source or target they are configured on, and their index.
+type effectsCollector struct {
+	backend *Backend
+}
+
+func (c *effectsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- parallelTokensDesc
+	ch <- rateLimitWaitDesc
+}
+
+func (c *effectsCollector) Collect(ch chan<- prometheus.Metric) {
+	cfg := c.backend.cfg.Load()
+	collect := func(scope EffectScope, name string, effects []*Effect) {
+		for i, ef := range effects {
+			labels := []string{string(scope), name, strconv.Itoa(i)}
+			if ef.Parallel != nil && ef.Parallel.tokens != nil {
+				ch <- prometheus.MustNewConstMetric(parallelTokensDesc, prometheus.GaugeValue,
+					float64(len(ef.Parallel.tokens)), labels...)
+			}
+			if ef.RateLimit != nil && ef.RateLimit.limiter != nil {
+				ch <- prometheus.MustNewConstMetric(rateLimitWaitDesc, prometheus.GaugeValue,
+					ef.RateLimit.waitSeconds(), labels...)
+			}
+		}
+	}
+	for name, src := range cfg.Sources {
+		collect(ScopeSource, name, src.Effects)
+	}
+	for name, target := range cfg.Targets {
+		collect(ScopeTarget, name, target.Effects)
+	}
+}
+
+// waitSeconds estimates how long a new message would wait for a reservation.
+// If the rate is 0 and no reservations are left, the wait is infinite.
+func (ef *RateLimitEffect) waitSeconds() float64 {
+	tokens := ef.limiter.Tokens()
+	if tokens >= 1 {
+		return 0
+	}
+	if ef.Rate <= 0 {
+		return math.Inf(1)
+	}
+	return (1 - tokens) / ef.Rate
+}
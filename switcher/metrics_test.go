@@ -0,0 +1,149 @@
+package switcher
+
+import (
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// gatherMetric returns the value of the counter or gauge with the given labels,
+// or the sample count if it is a histogram. False if there is no such metric.
+func gatherMetric(t *testing.T, srv *Server, name string, labels map[string]string) (float64, bool) {
+	t.Helper()
+	families, err := srv.backend.metrics.registry.Gather()
+	if err != nil {
+		t.Fatalf("failed to gather metrics: %v", err)
+	}
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, m := range f.GetMetric() {
+			got := make(map[string]string)
+			for _, l := range m.GetLabel() {
+				got[l.GetName()] = l.GetValue()
+			}
+			for k, v := range labels {
+				if got[k] != v {
+					continue metrics
+				}
+			}
+			switch f.GetType() {
+			case dto.MetricType_COUNTER:
+				return m.GetCounter().GetValue(), true
+			case dto.MetricType_GAUGE:
+				return m.GetGauge().GetValue(), true
+			case dto.MetricType_HISTOGRAM:
+				return float64(m.GetHistogram().GetSampleCount()), true
+			}
+		}
+	}
+	return 0, false
+}
+
+func expectMetric(t *testing.T, srv *Server, name string, labels map[string]string, want float64) {
+	t.Helper()
+	got, ok := gatherMetric(t, srv, name, labels)
+	if !ok || got != want {
+		t.Errorf("expected %s %v to be %v, got %v (found: %v)", name, labels, want, got, ok)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	srv := startServer(t, &Config{
+		Targets: map[string]*Target{"t": {Endpoint: startTarget(t)}},
+		Sources: map[string]*Source{"s": {Effects: []*Effect{
+			{RegexMatcher: regexp.MustCompile("^eth_call$"), Direction: DirectionSourceRequest, Drop: &DropEffect{Chance: 1}},
+			{RegexMatcher: regexp.MustCompile("^eth_getLogs$"), Direction: DirectionSourceRequest, Error: &ErrorEffect{Chance: 1, Code: 5}},
+			{RegexMatcher: regexp.MustCompile("^eth_gasPrice$"), Direction: DirectionTargetResponse, Substitute: &SubstituteEffect{Result: "x"}},
+			{Parallel: &ParallelEffect{Max: 3}},
+		}}},
+		Routes: map[string]string{"s": "t"},
+	})
+	src := dialSource(t, srv, "/dial/s")
+	expectResult(t, call(t, src, request("1", "eth_chainId", "")), "1", "eth_chainId:1")
+	if err := src.Write(request("2", "eth_call", "")); err != nil {
+		t.Fatal(err)
+	}
+	if resp := call(t, src, request("3", "eth_getLogs", "")); resp.Error == nil {
+		t.Fatal("expected error")
+	}
+	expectResult(t, call(t, src, request("4", "eth_gasPrice", "")), "4", "x")
+
+	route := map[string]string{"source": "s", "target": "t"}
+	with := func(labels map[string]string) map[string]string {
+		for k, v := range route {
+			labels[k] = v
+		}
+		return labels
+	}
+	expectMetric(t, srv, "switcheroo_connections", route, 1)
+	expectMetric(t, srv, "switcheroo_messages_in_total", with(map[string]string{"method": "eth_chainId", "direction": "source-request"}), 1)
+	expectMetric(t, srv, "switcheroo_messages_out_total", with(map[string]string{"method": "eth_chainId", "direction": "target-response"}), 1)
+	expectMetric(t, srv, "switcheroo_messages_dropped_total", with(map[string]string{"method": "eth_call", "direction": "source-request"}), 1)
+	expectMetric(t, srv, "switcheroo_messages_errored_total", with(map[string]string{"method": "eth_getLogs", "direction": "source-request"}), 1)
+	expectMetric(t, srv, "switcheroo_messages_substituted_total", with(map[string]string{"method": "eth_gasPrice", "direction": "target-response"}), 1)
+	expectMetric(t, srv, "switcheroo_request_latency_seconds", with(map[string]string{"method": "eth_chainId"}), 1)
+	expectMetric(t, srv, "switcheroo_request_latency_seconds", with(map[string]string{"method": "eth_getLogs"}), 1)
+	expectMetric(t, srv, "switcheroo_parallel_tokens_in_use", map[string]string{"scope": "source", "name": "s", "effect": "3"}, 0)
+
+	// the dropped request is no longer awaited
+	srv.backend.mu.Lock()
+	ro := srv.backend.routes[1]
+	srv.backend.mu.Unlock()
+	ro.requestsLock.Lock()
+	pending := len(ro.requestTimes)
+	ro.requestsLock.Unlock()
+	if pending != 0 {
+		t.Errorf("expected no pending request times, got %d", pending)
+	}
+
+	resp, err := http.Get("http://" + srv.Address() + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "switcheroo_messages_in_total{") {
+		t.Fatalf("expected message counters to be served, got %s", data)
+	}
+}
+
+func TestMetricsMethodLabels(t *testing.T) {
+	for method, want := range map[string]string{
+		"":                             "",
+		"eth_chainId":                  "eth_chainId",
+		"engine_newPayloadV4":          "engine_newPayloadV4",
+		"engine_forkchoiceUpdatedV3":   "engine_forkchoiceUpdatedV3",
+		"engine_newPayload":            otherMethod,
+		"engine_newPayloadV10":         otherMethod,
+		"engine_bogusV1":               otherMethod,
+		"eth_chainId_":                 otherMethod,
+		"random_method_of_a_source123": otherMethod,
+	} {
+		if got := methodLabel(method); got != want {
+			t.Errorf("method %q: expected label %q, got %q", method, want, got)
+		}
+	}
+
+	srv := startServer(t, &Config{
+		Targets: map[string]*Target{"t": {Endpoint: startTarget(t)}},
+		Sources: map[string]*Source{"s": {}},
+		Routes:  map[string]string{"s": "t"},
+	})
+	src := dialSource(t, srv, "/dial/s")
+	expectResult(t, call(t, src, request("1", "foo_a", "")), "1", "foo_a:1")
+	expectResult(t, call(t, src, request("2", "foo_b", "")), "2", "foo_b:2")
+	expectMetric(t, srv, "switcheroo_messages_in_total", map[string]string{"method": otherMethod, "direction": "source-request"}, 2)
+	if _, ok := gatherMetric(t, srv, "switcheroo_messages_in_total", map[string]string{"method": "foo_a"}); ok {
+		t.Error("expected unknown methods to not be labeled by name")
+	}
+}
@@ -0,0 +1,164 @@
+package switcher
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+
+	jsonrpc "github.com/protolambda/jsonrpc2"
+)
+
+type pendingRequest struct {
+	// route that sent the request, nil if the request was sent by the switch itself
+	route *Route
+	// id is the original ID, as chosen by the source
+	id jsonrpc.RawID
+	// method of the request, to track subscriptions
+	method string
+}
+
+type subscription struct {
+	route *Route
+	// namespace of the subscription, e.g. "eth" for "eth_subscribe"
+	namespace string
+}
+
+// multiplexer shares a single target connection between routes.
+// Request IDs are rewritten to be unique on the connection,
+// and restored when the response is routed back to the source.
+// Subscription notifications are routed to the source that created the subscription.
+type multiplexer struct {
+	mu sync.Mutex
+
+	nextID uint64
+
+	pending map[jsonrpc.RawID]*pendingRequest
+	// subs maps subscription IDs to the route that subscribed
+	subs map[string]*subscription
+}
+
+func newMultiplexer() *multiplexer {
+	return &multiplexer{
+		pending: make(map[jsonrpc.RawID]*pendingRequest),
+		subs:    make(map[string]*subscription),
+	}
+}
+
+// outgoing prepares a message of the given route to be sent to the target.
+// Requests are copied, with the ID rewritten; other messages are returned as-is.
+// A nil route registers a request by the switch itself, of which the response is ignored.
+func (m *multiplexer) outgoing(ro *Route, em *Envelope) *Envelope {
+	if em.Msg.Request == nil || em.Msg.ID.IsNotification() {
+		// responses to target-requests and notifications don't need rewriting
+		return em
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if ns, ok := strings.CutSuffix(em.Msg.Method, "_unsubscribe"); ok {
+		var params []string
+		if err := json.Unmarshal(em.Msg.Params, &params); err == nil && len(params) == 1 {
+			if sub, ok := m.subs[params[0]]; ok && sub.route == ro && sub.namespace == ns {
+				delete(m.subs, params[0])
+			}
+		}
+	}
+	m.nextID += 1
+	id := jsonrpc.RawID(strconv.FormatUint(m.nextID, 10))
+	m.pending[id] = &pendingRequest{route: ro, id: em.Msg.ID, method: em.Msg.Method}
+	out := *em
+	out.Msg.ID = id
+	return &out
+}
+
+// forget drops the pending request with the rewritten ID, of which no response is expected.
+func (m *multiplexer) forget(id jsonrpc.RawID) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.pending, id)
+}
+
+// incoming determines which routes a message from the target is for.
+// Responses are restored to the original request ID.
+// Requests and notifications that are not part of a subscription go to all given routes,
+// unless they expect a response, in which case they can only be delivered if there is a single route.
+func (m *multiplexer) incoming(em *Envelope, routes []*Route) (dest []*Route, out *Envelope) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if em.Msg.Response != nil {
+		req, ok := m.pending[em.Msg.ID]
+		if !ok || req.route == nil {
+			delete(m.pending, em.Msg.ID)
+			return nil, em
+		}
+		delete(m.pending, em.Msg.ID)
+		if ns, ok := strings.CutSuffix(req.method, "_subscribe"); ok && em.Msg.Result != nil {
+			var subID string
+			if err := json.Unmarshal(*em.Msg.Result, &subID); err == nil {
+				m.subs[subID] = &subscription{route: req.route, namespace: ns}
+			}
+		}
+		out = &Envelope{Ctx: em.Ctx, Msg: em.Msg}
+		out.Msg.ID = req.id
+		return []*Route{req.route}, out
+	}
+	if _, ok := strings.CutSuffix(em.Msg.Method, "_subscription"); ok {
+		var params struct {
+			Subscription string `json:"subscription"`
+		}
+		if err := json.Unmarshal(em.Msg.Params, &params); err == nil {
+			if sub, ok := m.subs[params.Subscription]; ok {
+				return []*Route{sub.route}, em
+			}
+		}
+		return nil, em
+	}
+	if !em.Msg.ID.IsNotification() && len(routes) > 1 {
+		// cannot pick which source should answer the request
+		return nil, em
+	}
+	return routes, em
+}
+
+// detach forgets all state of the route,
+// and returns unsubscribe requests for any subscriptions the route left open.
+func (m *multiplexer) detach(ro *Route) (unsubscribe []*jsonrpc.Message) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, req := range m.pending {
+		if req.route == ro {
+			delete(m.pending, id)
+		}
+	}
+	for subID, sub := range m.subs {
+		if sub.route != ro {
+			continue
+		}
+		delete(m.subs, subID)
+		params, _ := json.Marshal([]string{subID})
+		unsubscribe = append(unsubscribe, &jsonrpc.Message{
+			Request: &jsonrpc.Request{
+				Method: sub.namespace + "_unsubscribe",
+				Params: params,
+			},
+			// Any non-notification ID, it is rewritten when sent out.
+			ID: "0",
+		})
+	}
+	return unsubscribe
+}
+
+// reset forgets all requests and subscriptions, as they do not survive a new connection.
+// The pending requests of routes are returned, as they will never be answered.
+func (m *multiplexer) reset() (lost []*pendingRequest) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, req := range m.pending {
+		if req.route != nil {
+			lost = append(lost, req)
+		}
+	}
+	clear(m.pending)
+	clear(m.subs)
+	return lost
+}
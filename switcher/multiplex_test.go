@@ -0,0 +1,56 @@
+package switcher
+
+import (
+	"strings"
+	"testing"
+
+	jsonrpc "github.com/protolambda/jsonrpc2"
+	"github.com/protolambda/switcheroo/ws"
+)
+
+func TestMultiplexSharedRemote(t *testing.T) {
+	srv := startServer(t, &Config{
+		Targets: map[string]*Target{"t": {Endpoint: startTarget(t), KeepAlive: true}},
+		Sources: map[string]*Source{"a": {}, "b": {}},
+		Routes:  map[string]string{"a": "t", "b": "t"},
+	})
+	a := dialSource(t, srv, "/dial/a")
+	b := dialSource(t, srv, "/dial/b")
+
+	// both sources use the same request ID, the target sees unique IDs
+	for i, rpc := range []*ws.JSONRPC{a, b} {
+		if err := rpc.Write(request("7", []string{"m_a", "m_b"}[i], "")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	resultA, resultB := readMsg(t, a), readMsg(t, b)
+	var targetIDs []string
+	for method, msg := range map[string]*jsonrpc.Message{"m_a": resultA, "m_b": resultB} {
+		if msg.ID != "7" {
+			t.Errorf("%s: expected original ID 7, got %s", method, msg.ID)
+		}
+		var result string
+		if msg.Result == nil || decodeJSON(*msg.Result, &result) != nil {
+			t.Fatalf("%s: expected string result, got %s", method, (&Envelope{Msg: *msg}).JSON())
+		}
+		id, ok := strings.CutPrefix(result, method+":")
+		if !ok {
+			t.Fatalf("%s: response of another route: %q", method, result)
+		}
+		targetIDs = append(targetIDs, id)
+	}
+	if targetIDs[0] == targetIDs[1] {
+		t.Errorf("expected unique IDs at the target, got %v", targetIDs)
+	}
+
+	// notifications of a subscription only go to the source that subscribed
+	expectResult(t, call(t, b, request(`"x"`, "eth_subscribe", `["newHeads"]`)), `"x"`, "0xsub1")
+	notification := readMsg(t, b)
+	if notification.Method != "eth_subscription" {
+		t.Fatalf("expected subscription notification, got %s", (&Envelope{Msg: *notification}).JSON())
+	}
+	next := call(t, a, request("8", "m_a", ""))
+	if next.Response == nil || next.ID != "8" {
+		t.Fatalf("expected response to a, got %s", (&Envelope{Msg: *next}).JSON())
+	}
+}
@@ -0,0 +1,68 @@
+package switcher
+
+import (
+	"context"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// upstreamEffects lists the effects of messages travelling from source to target:
+// first the source effects, then the target effects.
+func upstreamEffects(src *Source, target *Target) (out []*Effect) {
+	out = append(out, src.Effects...)
+	return append(out, target.Effects...)
+}
+
+// downstreamEffects lists the effects of messages travelling from target to source:
+// first the target effects, then the source effects.
+func downstreamEffects(src *Source, target *Target) (out []*Effect) {
+	out = append(out, target.Effects...)
+	return append(out, src.Effects...)
+}
+
+// pipeline runs messages through a chain of effect stages.
+// Closing the head shuts down the stages one by one, after they processed all remaining messages.
+type pipeline struct {
+	head chan *Envelope
+	done chan struct{}
+	// captures record the messages that enter the pipeline
+	captures []*captureFile
+}
+
+// startPipeline starts the effect stages, and passes the messages that make it through to the output function.
+// Every stage draws from its own random streams, derived from the seed of the effect,
+// the stream labels of the pipeline, and the position of the effect in the pipeline.
+// Reproduced pipelines with the same labels thus make the same draws, independent of other pipelines.
+func startPipeline(ctx context.Context, effects []*Effect, stream []string, captures []*captureFile, output func(em *Envelope)) *pipeline {
+	p := &pipeline{
+		head:     make(chan *Envelope),
+		done:     make(chan struct{}),
+		captures: captures,
+	}
+	var in <-chan *Envelope = p.head
+	for i, ef := range effects {
+		next := make(chan *Envelope)
+		seed := deriveSeed(ef.seed, append(slices.Clone(stream), strconv.Itoa(i))...)
+		go ef.Run(ctx, seed, in, next)
+		in = next
+	}
+	go func() {
+		defer close(p.done)
+		for em := range in {
+			output(em)
+		}
+	}()
+	return p
+}
+
+// waitPipelines waits for the pipelines to shut down, or for the timeout.
+func waitPipelines(pipelines []*pipeline, timeout <-chan time.Time) {
+	for _, p := range pipelines {
+		select {
+		case <-p.done:
+		case <-timeout:
+			return
+		}
+	}
+}
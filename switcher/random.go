@@ -0,0 +1,86 @@
+package switcher
+
+import (
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"sync"
+)
+
+// effectRand is a deterministic stream of randomness, of a single run of an effect.
+type effectRand struct {
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+func newEffectRand(seed uint64) *effectRand {
+	return &effectRand{rng: rand.New(rand.NewPCG(seed, deriveSeed(seed, "pcg")))}
+}
+
+// float64 returns a random uniform float64 in the range 0 to 1
+func (r *effectRand) float64() float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rng.Float64()
+}
+
+// normFloat64 returns a normally distributed float64, with mean 0 and standard deviation 1.
+func (r *effectRand) normFloat64() float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rng.NormFloat64()
+}
+
+// shuffle randomizes the order of n elements, with swap exchanging two of them.
+func (r *effectRand) shuffle(n int, swap func(i, j int)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rng.Shuffle(n, swap)
+}
+
+// chance returns true with probability f.
+func (r *effectRand) chance(f float64) bool {
+	if f <= 0 {
+		return false
+	}
+	if f >= 1 {
+		return true
+	}
+	return r.float64() < f
+}
+
+// randUint64 reads a random uint64 from crypto/rand.
+func randUint64() uint64 {
+	var x [8]uint8
+	_, err := crand.Read(x[:])
+	if err != nil {
+		panic(fmt.Errorf("failed to get randomness: %w", err))
+	}
+	return binary.LittleEndian.Uint64(x[:])
+}
+
+// deriveSeed derives an independent seed from the seed and the labels,
+// so streams can be added without changing the draws of other streams.
+func deriveSeed(seed uint64, labels ...string) uint64 {
+	h := sha256.New()
+	_ = binary.Write(h, binary.LittleEndian, seed)
+	for _, label := range labels {
+		h.Write([]byte(label))
+		h.Write([]byte{0})
+	}
+	return binary.LittleEndian.Uint64(h.Sum(nil))
+}
+
+// seedRand sets the seed of the effect, from which every run derives its random streams.
+// The seed is derived from the config seed, and the source or target and position of the effect,
+// unless the effect sets its own seed.
+func (ef *Effect) seedRand(seed uint64, scope EffectScope, name string, index int) {
+	if ef.Seed != nil {
+		ef.seed = *ef.Seed
+	} else {
+		ef.seed = deriveSeed(seed, string(scope), name, strconv.Itoa(index))
+	}
+}
@@ -0,0 +1,92 @@
+package switcher
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	jsonrpc "github.com/protolambda/jsonrpc2"
+	"github.com/protolambda/switcheroo/ws"
+)
+
+func seededConfig(endpoint string, seed uint64) *Config {
+	return &Config{
+		Seed:    &seed,
+		Targets: map[string]*Target{"t": {Endpoint: endpoint}},
+		Sources: map[string]*Source{"s": {Effects: []*Effect{
+			{Direction: DirectionSourceRequest, Error: &ErrorEffect{Chance: 0.5, Code: -1}},
+		}}, "s2": {Effects: []*Effect{
+			{Direction: DirectionSourceRequest, Error: &ErrorEffect{Chance: 0.5, Code: -1}},
+		}}},
+		Routes: map[string]string{"s": "t", "s2": "t"},
+	}
+}
+
+// errorDraws calls n requests, and returns which were answered with the error of the effect.
+func errorDraws(t *testing.T, src *ws.JSONRPC, n int) (out []bool) {
+	t.Helper()
+	for i := range n {
+		resp := call(t, src, request(jsonrpc.RawID(fmt.Sprint(i)), "x", ""))
+		out = append(out, resp.Error != nil)
+	}
+	return out
+}
+
+func TestSeedPerRoute(t *testing.T) {
+	endpoint := startTarget(t)
+	const n = 32
+
+	srv := startServer(t, seededConfig(endpoint, 1))
+	alone := errorDraws(t, dialSource(t, srv, "/dial/s"), n)
+
+	// the draws of a route do not depend on the traffic of other routes
+	srv = startServer(t, seededConfig(endpoint, 1))
+	first, second := dialSource(t, srv, "/dial/s"), dialSource(t, srv, "/dial/s")
+	var firstDraws, secondDraws []bool
+	for range n {
+		firstDraws = append(firstDraws, errorDraws(t, first, 1)...)
+		secondDraws = append(secondDraws, errorDraws(t, second, 1)...)
+	}
+	if fmt.Sprint(firstDraws) != fmt.Sprint(alone) {
+		t.Fatalf("expected the same draws as the route on its own:\n%v\n%v", alone, firstDraws)
+	}
+	// every route has its own stream
+	if fmt.Sprint(secondDraws) == fmt.Sprint(firstDraws) {
+		t.Fatalf("expected routes to draw independently, both drew %v", firstDraws)
+	}
+
+	// another seed draws differently
+	srv = startServer(t, seededConfig(endpoint, 2))
+	if other := errorDraws(t, dialSource(t, srv, "/dial/s"), n); fmt.Sprint(other) == fmt.Sprint(alone) {
+		t.Fatalf("expected another seed to draw differently, both drew %v", alone)
+	}
+}
+
+func TestSeedPerSource(t *testing.T) {
+	endpoint := startTarget(t)
+	const n = 32
+
+	srv := startServer(t, seededConfig(endpoint, 1))
+	alone := errorDraws(t, dialSource(t, srv, "/dial/s"), n)
+
+	// routes of another source, also when they connect first, do not change the draws of the source
+	srv = startServer(t, seededConfig(endpoint, 1))
+	other := dialSource(t, srv, "/dial/s2")
+	errorDraws(t, other, n)
+	status, _ := postJSON(t, srv, "/dial/s2", `{"jsonrpc":"2.0","id":1,"method":"x"}`)
+	if status != http.StatusOK {
+		t.Fatalf("unexpected status %d", status)
+	}
+	src := dialSource(t, srv, "/dial/s")
+	if draws := errorDraws(t, src, n); fmt.Sprint(draws) != fmt.Sprint(alone) {
+		t.Fatalf("expected the same draws as the source on its own:\n%v\n%v", alone, draws)
+	}
+
+	// a reload starts new streams, rather than repeating the draws
+	if err := srv.Reload(seededConfig(endpoint, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if draws := errorDraws(t, src, n); fmt.Sprint(draws) == fmt.Sprint(alone) {
+		t.Fatalf("expected the draws to not restart after a reload, drew %v again", draws)
+	}
+}
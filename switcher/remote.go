@@ -1,30 +1,432 @@
 package switcher
 
 import (
+	"bytes"
 	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/ethereum/go-ethereum/log"
+	jsonrpc "github.com/protolambda/jsonrpc2"
 	"github.com/protolambda/switcheroo/ws"
-	"github.com/protolambda/websocket"
 )
 
+const (
+	// minBackoff is the time to wait before retrying a failed dial to a target.
+	minBackoff = 500 * time.Millisecond
+	// maxBackoff is the maximum time to wait between dials, as the backoff grows exponentially.
+	maxBackoff = 30 * time.Second
+	// stableConnection is how long a connection must stay up, for the backoff to start over when it is lost.
+	// Targets that accept the connection but close it right away are re-dialed with growing backoff.
+	stableConnection = 10 * time.Second
+	// httpLinger is how long a lazy remote stays connected after the route of an HTTP request detached,
+	// so sources that send one HTTP request at a time do not make the remote reconnect for every request.
+	httpLinger = 30 * time.Second
+)
+
+// RemoteState describes the connection-state of a Remote.
+type RemoteState uint32
+
+const (
+	RemoteDown       RemoteState = iota // not connected, and not trying to connect
+	RemoteConnecting                    // dialing the target
+	RemoteUp                            // connected to the target
+	RemoteBackoff                       // waiting to retry after a failed dial or a lost connection
+)
+
+func (s RemoteState) String() string {
+	switch s {
+	case RemoteDown:
+		return "down"
+	case RemoteConnecting:
+		return "connecting"
+	case RemoteUp:
+		return "up"
+	case RemoteBackoff:
+		return "backoff"
+	default:
+		return fmt.Sprintf("unknown-%d", uint32(s))
+	}
+}
+
+func (s RemoteState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// RemoteStatus summarizes a Remote, for inspection through the API.
+type RemoteStatus struct {
+	Name      string      `json:"name"`
+	Endpoint  string      `json:"endpoint"`
+	KeepAlive bool        `json:"keepAlive"`
+	State     RemoteState `json:"state"`
+	Routes    int         `json:"routes"`
+}
+
+// Remote is the outgoing connection to a Target, shared by all routes towards the target.
+// Keep-alive remotes stay connected for the lifetime of the backend,
+// other remotes only connect while there are routes attached to them,
+// or shortly after, if the last route was that of an HTTP request.
+// Lost connections are re-dialed with exponential backoff.
 type Remote struct {
-	cfg *Target
+	name string
 
 	log log.Logger
 
-	// TODO RPC connection
+	state atomic.Uint32
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu  sync.Mutex
+	cfg *Target
+	// stopConn stops the active connection loop, nil if not running.
+	stopConn context.CancelFunc
+	// connDone is closed when the last started connection loop exits.
+	connDone chan struct{}
+	routes   map[*Route]struct{}
+	// linger disconnects a lazy remote, once the last HTTP route detached long enough ago. Nil if not lingering.
+	linger *time.Timer
+
+	// mux shares the connection between the attached routes
+	mux *multiplexer
+
+	inwards  chan *Envelope
+	outwards chan *Envelope
+}
+
+func NewRemote(log log.Logger, name string, cfg *Target) *Remote {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &Remote{
+		name:     name,
+		log:      log,
+		cfg:      cfg,
+		ctx:      ctx,
+		cancel:   cancel,
+		routes:   make(map[*Route]struct{}),
+		mux:      newMultiplexer(),
+		inwards:  make(chan *Envelope, 100),
+		outwards: make(chan *Envelope, 100),
+	}
+	go r.dispatch()
+	return r
+}
+
+// Start connects to the target right away, if the target is configured to be kept alive.
+func (r *Remote) Start() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cfg.KeepAlive {
+		r.connect()
+	}
+}
+
+// Attach registers a route, to receive messages from the target.
+// The first route to attach to a lazy remote makes it connect.
+func (r *Remote) Attach(ro *Route) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.routes[ro] = struct{}{}
+	r.stopLinger()
+	if len(r.routes) == 1 && !r.cfg.KeepAlive {
+		r.connect()
+	}
+}
+
+// Detach unregisters a route.
+// The last route to detach from a lazy remote makes it disconnect,
+// right away, or after a while if it was the route of an HTTP request.
+// Subscriptions the route left open on a remaining connection are unsubscribed.
+func (r *Remote) Detach(ro *Route) {
+	unsubscribe := r.mux.detach(ro)
+	r.mu.Lock()
+	delete(r.routes, ro)
+	stop := len(r.routes) == 0 && !r.cfg.KeepAlive
+	if stop {
+		if ro.user.RPC == nil {
+			r.startLinger()
+			stop = false
+		} else {
+			r.disconnect()
+		}
+	}
+	r.mu.Unlock()
+	if stop {
+		return
+	}
+	for _, msg := range unsubscribe {
+		em := r.mux.outgoing(nil, &Envelope{Ctx: r.ctx, Msg: *msg})
+		select {
+		case <-r.ctx.Done():
+			return
+		case r.outwards <- em:
+		}
+	}
+}
+
+// prepare rewrites the request IDs of a message of the given route,
+// to not collide with those of other routes, before it is sent with Send.
+func (r *Remote) prepare(ro *Route, em *Envelope) *Envelope {
+	return r.mux.outgoing(ro, em)
+}
+
+// Send forwards a prepared message to the target.
+// This blocks until the message is queued, or the context is canceled.
+func (r *Remote) Send(ctx context.Context, em *Envelope) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-r.ctx.Done():
+		return fmt.Errorf("remote %q is closed", r.name)
+	case r.outwards <- em:
+		return nil
+	}
+}
+
+func (r *Remote) State() RemoteState {
+	return RemoteState(r.state.Load())
+}
+
+func (r *Remote) Status() RemoteStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return RemoteStatus{
+		Name:      r.name,
+		Endpoint:  r.cfg.Endpoint,
+		KeepAlive: r.cfg.KeepAlive,
+		State:     r.State(),
+		Routes:    len(r.routes),
+	}
+}
+
+// Config returns the current target configuration.
+func (r *Remote) Config() *Target {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cfg
+}
+
+// Reconfigure updates the target configuration.
+// The connection is only interrupted if the endpoint, authentication or TLS options changed,
+// including a JWT secret or certificate that changed in its file.
+func (r *Remote) Reconfigure(cfg *Target) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	prev := r.cfg
+	r.cfg = cfg
+	running := r.stopConn != nil
+	if running && (prev.Endpoint != cfg.Endpoint || !bytes.Equal(prev.jwtSecret, cfg.jwtSecret) || prev.tlsDigest != cfg.tlsDigest) {
+		r.log.Info("target connection changed, reconnecting", "endpoint", cfg.Endpoint)
+		r.disconnect()
+	}
+	if cfg.KeepAlive || len(r.routes) > 0 {
+		r.connect()
+	} else if r.linger == nil {
+		r.disconnect()
+	}
+}
+
+// Close disconnects the remote, and stops it from connecting again.
+func (r *Remote) Close() error {
+	r.mu.Lock()
+	r.disconnect()
+	r.mu.Unlock()
+	r.cancel()
+	return nil
+}
+
+func (r *Remote) setState(s RemoteState) {
+	if prev := RemoteState(r.state.Swap(uint32(s))); prev != s {
+		r.log.Info("target connection state changed", "state", s, "prev", prev)
+	}
+}
+
+// connect starts the connection loop, if it is not already running.
+// The caller must hold the lock.
+func (r *Remote) connect() {
+	if r.stopConn != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(r.ctx)
+	r.stopConn = cancel
+	prev := r.connDone
+	done := make(chan struct{})
+	r.connDone = done
+	go func() {
+		defer close(done)
+		// don't overlap with the previous connection loop, if it is still shutting down
+		if prev != nil {
+			<-prev
+		}
+		r.run(ctx)
+	}()
+}
+
+// startLinger disconnects the remote after a while, unless a route attaches before then.
+// The caller must hold the lock.
+func (r *Remote) startLinger() {
+	r.stopLinger()
+	var timer *time.Timer
+	timer = time.AfterFunc(httpLinger, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.linger != timer {
+			return
+		}
+		r.linger = nil
+		if len(r.routes) == 0 && !r.cfg.KeepAlive {
+			r.disconnect()
+		}
+	})
+	r.linger = timer
+}
+
+// stopLinger cancels a pending disconnect of startLinger.
+// The caller must hold the lock.
+func (r *Remote) stopLinger() {
+	if r.linger != nil {
+		r.linger.Stop()
+		r.linger = nil
+	}
+}
+
+// disconnect stops the connection loop, if it is running.
+// The caller must hold the lock.
+func (r *Remote) disconnect() {
+	r.stopLinger()
+	if r.stopConn == nil {
+		return
+	}
+	r.stopConn()
+	r.stopConn = nil
 }
 
-// TODO figure out how we want to model live / lazy connections to remote endpoints
+// run keeps the remote connected until the context is canceled.
+func (r *Remote) run(ctx context.Context) {
+	defer r.setState(RemoteDown)
+	cfg := r.Config()
+	if isHTTPEndpoint(cfg.Endpoint) {
+		r.runHTTP(ctx, cfg.Endpoint)
+		return
+	}
+	if isReplayEndpoint(cfg.Endpoint) {
+		r.runReplay(ctx)
+		return
+	}
+	backoff := minBackoff
+	// wait for the backoff, and grow it for the next retry. False if the context is canceled.
+	wait := func() bool {
+		r.setState(RemoteBackoff)
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxBackoff)
+		return true
+	}
+	for {
+		r.setState(RemoteConnecting)
+		conn, rpc, err := dialTarget(ctx, r.Config())
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			r.log.Warn("failed to dial target", "err", err, "backoff", backoff)
+			if !wait() {
+				return
+			}
+			continue
+		}
+		connected := time.Now()
+		r.setState(RemoteUp)
+		setupClientLoops(r.log, conn, rpc, ctx, r.inwards, r.outwards)
+		select {
+		case <-ctx.Done():
+			if err := conn.Close(); err != nil {
+				r.log.Warn("failed to close target connection", "err", err)
+			}
+			return
+		case <-conn.CloseCtx().Done():
+		}
+		// Responses and subscriptions of the lost connection will never arrive.
+		r.failPending(r.mux.reset())
+		if time.Since(connected) >= stableConnection {
+			backoff = minBackoff
+		}
+		r.log.Warn("lost connection to target", "err", conn.Err(), "backoff", backoff)
+		if !wait() {
+			return
+		}
+	}
+}
+
+// connectionLostErrorCode is the error code geth uses for generic server errors.
+const connectionLostErrorCode = -32000
+
+// connectionLostErrorObj answers the requests that were pending on a lost target connection.
+func connectionLostErrorObj() *jsonrpc.ErrorObject {
+	return &jsonrpc.ErrorObject{Code: connectionLostErrorCode, Message: "connection to target lost"}
+}
 
-func (r *Remote) Setup() {
-	cl := websocket.NewClient(r.cfg.Endpoint)
-	rpc := ws.NewJSONRPC(cl)
-	ctx := context.Background()
-	inwards := make(chan *Envelope)
-	outwards := make(chan *Envelope)
+// failPending answers the requests of a lost connection with an error,
+// so the sources do not wait for responses that will never arrive.
+func (r *Remote) failPending(lost []*pendingRequest) {
+	for _, req := range lost {
+		req.route.deliver(&Envelope{Ctx: r.ctx, Msg: jsonrpc.Message{
+			ID:       req.id,
+			Response: &jsonrpc.Response{Error: connectionLostErrorObj()},
+		}})
+	}
+}
+
+// dialTarget connects to the websocket or IPC endpoint of the target.
+func dialTarget(ctx context.Context, cfg *Target) (Conn, ws.JSONRPCConnection, error) {
+	if path, ok := strings.CutPrefix(cfg.Endpoint, "ipc://"); ok {
+		var d net.Dialer
+		c, err := d.DialContext(ctx, "unix", path)
+		if err != nil {
+			return nil, nil, err
+		}
+		s := ws.NewStreamJSONRPC(c)
+		return s, s, nil
+	}
+	header, err := cfg.authHeader()
+	if err != nil {
+		return nil, nil, err
+	}
+	conn, err := ws.Dial(ctx, cfg.Endpoint, ws.DialOptions{Header: header, TLSConfig: cfg.tlsConfig})
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, ws.NewJSONRPC(conn), nil
+}
 
-	// TODO fix ws library to make websocket.Client compatible with wider Messenger interface
-	setupClientLoops(r.log, nil, rpc, ctx, inwards, outwards)
+// dispatch delivers messages from the target to the routes they belong to.
+func (r *Remote) dispatch() {
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case em := <-r.inwards:
+			r.mu.Lock()
+			routes := make([]*Route, 0, len(r.routes))
+			for ro := range r.routes {
+				routes = append(routes, ro)
+			}
+			r.mu.Unlock()
+			dest, em := r.mux.incoming(em, routes)
+			if len(dest) == 0 {
+				r.log.Debug("no route for message from target", "msg", em.JSON())
+				continue
+			}
+			for _, ro := range dest {
+				// each route gets its own envelope, since effects may modify it
+				ro.deliver(&Envelope{Ctx: em.Ctx, Msg: em.Msg})
+			}
+		}
+	}
 }
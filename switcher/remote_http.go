@@ -0,0 +1,137 @@
+package switcher
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	jsonrpc "github.com/protolambda/jsonrpc2"
+)
+
+// httpTargetTimeout is how long a request to an HTTP target may take,
+// before it is answered with a timeout error.
+const httpTargetTimeout = 30 * time.Second
+
+// isHTTPEndpoint checks if the endpoint is to be reached with HTTP POST requests,
+// rather than a websocket connection.
+func isHTTPEndpoint(endpoint string) bool {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return false
+	}
+	return u.Scheme == "http" || u.Scheme == "https"
+}
+
+// runHTTP forwards messages to an HTTP target, each as a separate POST request,
+// until the context is canceled.
+// There is no connection to keep: the remote is up for as long as it runs.
+// Subscriptions are not supported, and are answered with an error.
+func (r *Remote) runHTTP(ctx context.Context, endpoint string) {
+	r.setState(RemoteUp)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case em := <-r.outwards:
+			if em.Msg.Request == nil {
+				// the target cannot send requests over HTTP, so there is nothing to respond to
+				r.log.Debug("cannot send response to HTTP target", "msg", em.JSON())
+				continue
+			}
+			if strings.HasSuffix(em.Msg.Method, "_subscribe") && !em.Msg.ID.IsNotification() {
+				r.receive(ctx, &Envelope{Ctx: em.Ctx, Msg: *em.Msg.RespondErr(errNotificationsUnsupported)})
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if resp := r.post(ctx, endpoint, &em.Msg, em.corrupt); resp != nil {
+					r.receive(ctx, &Envelope{Ctx: em.Ctx, Msg: *resp})
+				}
+			}()
+		}
+	}
+}
+
+// post sends the request to the HTTP target, and returns the response.
+// Failed requests are answered with an error response.
+// Notifications have no response, and nil is returned.
+// If an effect corrupted the request, the corrupted frame is posted.
+func (r *Remote) post(ctx context.Context, endpoint string, msg *jsonrpc.Message, corrupt *corruption) *jsonrpc.Message {
+	fail := func(err error) *jsonrpc.Message {
+		if msg.ID.IsNotification() {
+			r.log.Debug("failed to send notification to HTTP target", "err", err)
+			return nil
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			return msg.RespondErr(timeoutErrorObj())
+		}
+		return msg.RespondErr(jsonrpc.AnnotatedErrorObj(jsonrpc.InternalError, err))
+	}
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return fail(fmt.Errorf("failed to encode request: %w", err))
+	}
+	if corrupt != nil {
+		body = corrupt.apply(body)
+	}
+	ctx, cancel := context.WithTimeout(ctx, httpTargetTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fail(fmt.Errorf("failed to create request: %w", err))
+	}
+	cfg := r.Config()
+	header, err := cfg.authHeader()
+	if err != nil {
+		return fail(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := cfg.client().Do(req)
+	if err != nil {
+		return fail(fmt.Errorf("failed to reach target: %w", err))
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fail(fmt.Errorf("failed to read response: %w", err))
+	}
+	if msg.ID.IsNotification() {
+		return nil
+	}
+	var out jsonrpc.Message
+	if err := json.Unmarshal(data, &out); err != nil || out.Response == nil {
+		return fail(fmt.Errorf("unexpected HTTP response (%s): %q", resp.Status, truncate(data, 200)))
+	}
+	// The HTTP response can only be for this request, whatever ID the target may have used.
+	out.ID = msg.ID
+	return &out
+}
+
+// receive passes a message from the target to the dispatcher.
+func (r *Remote) receive(ctx context.Context, em *Envelope) {
+	select {
+	case <-ctx.Done():
+	case r.inwards <- em:
+	}
+}
+
+func truncate(data []byte, n int) []byte {
+	if len(data) > n {
+		return data[:n]
+	}
+	return data
+}
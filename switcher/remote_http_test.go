@@ -0,0 +1,59 @@
+package switcher
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	jsonrpc "github.com/protolambda/jsonrpc2"
+)
+
+func TestHTTPTarget(t *testing.T) {
+	var notified atomic.Int64
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var m jsonrpc.Message
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil || m.Request == nil {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		if m.ID.IsNotification() {
+			notified.Add(1)
+			return
+		}
+		if m.Method == "bad" {
+			http.Error(w, "nope", http.StatusInternalServerError)
+			return
+		}
+		// the response is matched with the request, whatever ID the target uses
+		resp := m.Respond("http:" + m.Method)
+		resp.ID = "99"
+		_ = json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(target.Close)
+	srv := startServer(t, &Config{
+		Targets: map[string]*Target{"t": {Endpoint: target.URL}, "down": {Endpoint: "http://127.0.0.1:1"}},
+		Sources: map[string]*Source{"s": {}},
+		Routes:  map[string]string{"s": "t"},
+	})
+	src := dialSource(t, srv, "/dial/s")
+	expectResult(t, call(t, src, request("1", "eth_chainId", "")), "1", "http:eth_chainId")
+	expectResult(t, call(t, src, request(`"a"`, "eth_chainId", "")), `"a"`, "http:eth_chainId")
+	if resp := call(t, src, request("2", "eth_subscribe", `["newHeads"]`)); resp.Error == nil || resp.Error.Code != errNotificationsUnsupported.Code {
+		t.Fatalf("expected subscriptions to be unsupported, got %s", (&Envelope{Msg: *resp}).JSON())
+	}
+	if resp := call(t, src, request("3", "bad", "")); resp.ID != "3" || resp.Error == nil || resp.Error.Code != jsonrpc.InternalError.Code() {
+		t.Fatalf("expected internal error, got %s", (&Envelope{Msg: *resp}).JSON())
+	}
+	if err := src.Write(request("", "note", "")); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, func() bool { return notified.Load() == 1 })
+
+	down := dialSource(t, srv, "/dial/s/down")
+	if resp := call(t, down, request("1", "eth_chainId", "")); resp.Error == nil || resp.Error.Code != jsonrpc.InternalError.Code() {
+		t.Fatalf("expected error of unreachable target, got %s", (&Envelope{Msg: *resp}).JSON())
+	}
+	expectResult(t, call(t, src, request("4", "eth_chainId", "")), "4", "http:eth_chainId")
+}
@@ -0,0 +1,328 @@
+package switcher
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	jsonrpc "github.com/protolambda/jsonrpc2"
+)
+
+// replayScheme prefixes the path of a capture file, to replay the capture as a target.
+const replayScheme = "replay://"
+
+// replayErrorCode is the error code for requests that have no recorded response.
+const replayErrorCode = -32000
+
+// isReplayEndpoint checks if the endpoint replays a capture file, rather than connecting to a target.
+func isReplayEndpoint(endpoint string) bool {
+	return strings.HasPrefix(endpoint, replayScheme)
+}
+
+// replayKey identifies a request by method and params.
+type replayKey struct {
+	method string
+	params string
+}
+
+func newReplayKey(req *jsonrpc.Request) replayKey {
+	return replayKey{method: req.Method, params: canonicalParams(req.Params)}
+}
+
+// canonicalParams encodes the params consistently, so equal params match regardless of formatting.
+// Missing, null and empty params are equal.
+func canonicalParams(params jsonrpc.Params) string {
+	dec := json.NewDecoder(bytes.NewReader(params))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return string(params)
+	}
+	switch x := v.(type) {
+	case nil:
+		return ""
+	case []any:
+		if len(x) == 0 {
+			return ""
+		}
+	}
+	out, err := json.Marshal(v)
+	if err != nil {
+		return string(params)
+	}
+	return string(out)
+}
+
+// replayExchange is a recorded response of the target.
+type replayExchange struct {
+	resp *jsonrpc.Response
+	// notifications of the subscription, if the request created one
+	notifications []*replayNotification
+}
+
+// replayNotification is a recorded subscription notification,
+// timed relative to the response that created the subscription.
+type replayNotification struct {
+	after  time.Duration
+	method string
+	// result of the notification
+	result json.RawMessage
+}
+
+// replayLog is a capture, indexed to answer requests with the recorded responses.
+type replayLog struct {
+	// responses to each request, in recorded order
+	responses map[replayKey][]*replayExchange
+}
+
+// loadReplay reads a capture file, and pairs the requests that reached the target with the responses of the target.
+// Messages are replayed as the target sent them, before any effects altered them.
+func loadReplay(path string) (*replayLog, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open capture: %w", err)
+	}
+	defer f.Close()
+
+	type routeID struct {
+		route uint64
+		id    jsonrpc.RawID
+	}
+	type routeSub struct {
+		route uint64
+		sub   string
+	}
+	type pendingReq struct {
+		key replayKey
+		sub bool
+	}
+	type openSub struct {
+		ex    *replayExchange
+		since time.Time
+	}
+	pending := make(map[routeID]pendingReq)
+	subs := make(map[routeSub]openSub)
+	out := &replayLog{responses: make(map[replayKey][]*replayExchange)}
+
+	dec := json.NewDecoder(f)
+	for line := 1; ; line++ {
+		var rec CaptureRecord
+		if err := dec.Decode(&rec); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, fmt.Errorf("invalid capture record %d: %w", line, err)
+		}
+		// what the target sent or received, rather than what the source saw
+		raw := rec.Msg
+		if (rec.Outcome == CaptureAltered || rec.Outcome == CaptureCorrupted) && rec.fromTarget() {
+			raw = rec.Original
+		}
+		switch rec.Outcome {
+		case CaptureForwarded, CaptureAltered:
+		case CaptureDropped, CaptureCorrupted:
+			if !rec.fromTarget() {
+				// never reached the target intact
+				continue
+			}
+		default:
+			// answered and injected messages did not reach the target, or did not come from it
+			continue
+		}
+		var msg jsonrpc.Message
+		if err := json.Unmarshal(raw, &msg); err != nil {
+			return nil, fmt.Errorf("invalid message in capture record %d: %w", line, err)
+		}
+		switch rec.Direction {
+		case DirectionSourceRequest:
+			if msg.ID.IsNotification() {
+				continue
+			}
+			pending[routeID{rec.Route, msg.ID}] = pendingReq{
+				key: newReplayKey(msg.Request),
+				sub: strings.HasSuffix(msg.Method, "_subscribe"),
+			}
+		case DirectionTargetResponse:
+			k := routeID{rec.Route, msg.ID}
+			req, ok := pending[k]
+			if !ok {
+				continue
+			}
+			delete(pending, k)
+			ex := &replayExchange{resp: msg.Response}
+			out.responses[req.key] = append(out.responses[req.key], ex)
+			if req.sub && msg.Result != nil {
+				var subID string
+				if err := json.Unmarshal(*msg.Result, &subID); err == nil {
+					subs[routeSub{rec.Route, subID}] = openSub{ex: ex, since: rec.Entered}
+				}
+			}
+		case DirectionTargetRequest:
+			if !strings.HasSuffix(msg.Method, "_subscription") {
+				continue
+			}
+			var params struct {
+				Subscription string          `json:"subscription"`
+				Result       json.RawMessage `json:"result"`
+			}
+			if err := json.Unmarshal(msg.Params, &params); err != nil {
+				continue
+			}
+			sub, ok := subs[routeSub{rec.Route, params.Subscription}]
+			if !ok {
+				continue
+			}
+			sub.ex.notifications = append(sub.ex.notifications, &replayNotification{
+				after:  rec.Entered.Sub(sub.since),
+				method: msg.Method,
+				result: params.Result,
+			})
+		}
+	}
+	return out, nil
+}
+
+// fromTarget checks if the recorded message travelled from the target to the source.
+func (rec *CaptureRecord) fromTarget() bool {
+	return rec.Direction.MatchTarget()
+}
+
+// replaySession tracks which recorded responses were served, and the subscriptions being replayed.
+type replaySession struct {
+	log *replayLog
+	// served counts the served responses per request
+	served map[replayKey]int
+
+	mu     sync.Mutex
+	nextID uint64
+	// subs are the replayed subscriptions, by the subscription ID served to the source
+	subs map[string]context.CancelFunc
+}
+
+// answer finds the next recorded response to the request.
+// Once all recorded responses to a request were served, the last one is repeated.
+func (s *replaySession) answer(req *jsonrpc.Request) (*replayExchange, bool) {
+	key := newReplayKey(req)
+	exs := s.log.responses[key]
+	if len(exs) == 0 {
+		return nil, false
+	}
+	i := min(s.served[key], len(exs)-1)
+	s.served[key] += 1
+	return exs[i], true
+}
+
+// runReplay answers requests with the responses recorded in the capture, until the context is canceled.
+// Subscription notifications are replayed with the timing of the recording,
+// relative to the response that created the subscription.
+func (r *Remote) runReplay(ctx context.Context) {
+	r.setState(RemoteUp)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	s := &replaySession{
+		log:    r.Config().replay,
+		served: make(map[replayKey]int),
+		subs:   make(map[string]context.CancelFunc),
+	}
+	if s.log == nil {
+		s.log = &replayLog{}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case em := <-r.outwards:
+			if em.Msg.Request == nil || em.Msg.ID.IsNotification() {
+				continue
+			}
+			if ns, ok := strings.CutSuffix(em.Msg.Method, "_unsubscribe"); ok {
+				r.receive(ctx, &Envelope{Ctx: em.Ctx, Msg: *s.unsubscribe(&em.Msg, ns)})
+				continue
+			}
+			ex, ok := s.answer(em.Msg.Request)
+			if !ok {
+				r.log.Debug("no recorded response to replay", "method", em.Msg.Method)
+				r.receive(ctx, &Envelope{Ctx: em.Ctx, Msg: *em.Msg.RespondErr(&jsonrpc.ErrorObject{
+					Code:    replayErrorCode,
+					Message: fmt.Sprintf("no recorded response to %s", em.Msg.Method),
+				})})
+				continue
+			}
+			resp := &jsonrpc.Message{Response: ex.resp, ID: em.Msg.ID}
+			if len(ex.notifications) == 0 || ex.resp.Result == nil {
+				r.receive(ctx, &Envelope{Ctx: em.Ctx, Msg: *resp})
+				continue
+			}
+			// Serve a fresh subscription ID, so replays of the same subscription do not collide.
+			subCtx, subID := s.subscribe(ctx)
+			result := json.RawMessage(strconv.Quote(subID))
+			resp.Response = &jsonrpc.Response{Result: &result}
+			r.receive(ctx, &Envelope{Ctx: em.Ctx, Msg: *resp})
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				r.replayNotifications(subCtx, em.Ctx, subID, ex.notifications)
+			}()
+		}
+	}
+}
+
+// subscribe registers a new replayed subscription.
+func (s *replaySession) subscribe(ctx context.Context) (context.Context, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID += 1
+	subID := "0x" + strconv.FormatUint(s.nextID, 16)
+	subCtx, cancel := context.WithCancel(ctx)
+	s.subs[subID] = cancel
+	return subCtx, subID
+}
+
+// unsubscribe stops the replay of the subscription, and answers the request like geth does.
+func (s *replaySession) unsubscribe(msg *jsonrpc.Message, namespace string) *jsonrpc.Message {
+	var params []string
+	if err := json.Unmarshal(msg.Params, &params); err != nil || len(params) != 1 {
+		return msg.RespondErr(jsonrpc.AnnotatedErrorObj(jsonrpc.InvalidParams, errors.New("expected a subscription ID")))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cancel, ok := s.subs[params[0]]
+	if !ok {
+		return msg.RespondErr(&jsonrpc.ErrorObject{Code: replayErrorCode, Message: "subscription not found"})
+	}
+	cancel()
+	delete(s.subs, params[0])
+	result := json.RawMessage("true")
+	return &jsonrpc.Message{Response: &jsonrpc.Response{Result: &result}, ID: msg.ID}
+}
+
+// replayNotifications sends the recorded notifications of a subscription, on the recorded timeline.
+func (r *Remote) replayNotifications(ctx context.Context, msgCtx context.Context, subID string, notifications []*replayNotification) {
+	start := time.Now()
+	for _, n := range notifications {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(start.Add(n.after))):
+		}
+		params, err := json.Marshal(struct {
+			Subscription string          `json:"subscription"`
+			Result       json.RawMessage `json:"result"`
+		}{Subscription: subID, Result: n.result})
+		if err != nil {
+			r.log.Warn("failed to encode replayed notification", "err", err)
+			continue
+		}
+		r.receive(ctx, &Envelope{Ctx: msgCtx, Msg: jsonrpc.Message{
+			Request: &jsonrpc.Request{Method: n.method, Params: params},
+		}})
+	}
+}
@@ -0,0 +1,83 @@
+package switcher
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	start := time.Now()
+	record := func(at time.Duration, direction Direction, outcome CaptureOutcome, msg, original string) string {
+		rec := CaptureRecord{Time: start.Add(at), Entered: start.Add(at), Route: 1, Source: "s", Target: "t",
+			Direction: direction, Outcome: outcome, Msg: json.RawMessage(msg)}
+		if original != "" {
+			rec.Original = json.RawMessage(original)
+		}
+		out, err := json.Marshal(&rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(out) + "\n"
+	}
+	capture := record(0, DirectionSourceRequest, CaptureForwarded, `{"jsonrpc":"2.0","id":1,"method":"eth_chainId"}`, "") +
+		record(1, DirectionTargetResponse, CaptureForwarded, `{"jsonrpc":"2.0","id":1,"result":"0x1"}`, "") +
+		record(2, DirectionSourceRequest, CaptureForwarded, `{"jsonrpc":"2.0","id":2,"method":"eth_getBlockByNumber","params":["0x1", false]}`, "") +
+		// altered responses are replayed as the target sent them
+		record(3, DirectionTargetResponse, CaptureAltered, `{"jsonrpc":"2.0","id":2,"result":"altered"}`, `{"jsonrpc":"2.0","id":2,"result":{"number":"0x1"}}`) +
+		record(4, DirectionSourceRequest, CaptureForwarded, `{"jsonrpc":"2.0","id":3,"method":"eth_subscribe","params":["newHeads"]}`, "") +
+		record(5*time.Millisecond, DirectionTargetResponse, CaptureForwarded, `{"jsonrpc":"2.0","id":3,"result":"0xabc"}`, "") +
+		record(205*time.Millisecond, DirectionTargetRequest, CaptureForwarded, `{"jsonrpc":"2.0","method":"eth_subscription","params":{"subscription":"0xabc","result":{"n":1}}}`, "") +
+		record(405*time.Millisecond, DirectionTargetRequest, CaptureDropped, `{"jsonrpc":"2.0","method":"eth_subscription","params":{"subscription":"0xabc","result":{"n":2}}}`, "") +
+		// answered requests never reached the target
+		record(6, DirectionSourceRequest, CaptureAnswered, `{"jsonrpc":"2.0","id":4,"method":"eth_blockNumber"}`, "")
+	if err := os.WriteFile(path, []byte(capture), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	srv := startServer(t, &Config{
+		Targets: map[string]*Target{"t": {Endpoint: replayScheme + path}},
+		Sources: map[string]*Source{"s": {}},
+		Routes:  map[string]string{"s": "t"},
+	})
+	src := dialSource(t, srv, "/dial/s")
+
+	// params match regardless of formatting, and empty params match missing params
+	expectResult(t, call(t, src, request("10", "eth_chainId", "[]")), "10", "0x1")
+	resp := call(t, src, request("11", "eth_getBlockByNumber", `["0x1",false]`))
+	if resp.Result == nil || string(*resp.Result) != `{"number":"0x1"}` {
+		t.Fatalf("expected the original response, got %s", (&Envelope{Msg: *resp}).JSON())
+	}
+	resp = call(t, src, request("12", "eth_blockNumber", ""))
+	if resp.Error == nil || resp.Error.Code != replayErrorCode {
+		t.Fatalf("expected no recorded response, got %s", (&Envelope{Msg: *resp}).JSON())
+	}
+
+	subscribed := time.Now()
+	resp = call(t, src, request("13", "eth_subscribe", `["newHeads"]`))
+	var sub string
+	if resp.Result == nil || decodeJSON(*resp.Result, &sub) != nil || sub == "" {
+		t.Fatalf("expected subscription, got %s", (&Envelope{Msg: *resp}).JSON())
+	}
+	// the notifications follow with the recorded timing, including those dropped by effects of the capture
+	for _, n := range []int{1, 2} {
+		msg := readMsg(t, src)
+		var params struct {
+			Subscription string `json:"subscription"`
+			Result       struct {
+				N int `json:"n"`
+			} `json:"result"`
+		}
+		if msg.Request == nil || msg.Method != "eth_subscription" || decodeJSON(msg.Params, &params) != nil {
+			t.Fatalf("expected notification, got %s", (&Envelope{Msg: *msg}).JSON())
+		}
+		if params.Subscription != sub || params.Result.N != n {
+			t.Fatalf("expected notification %d of %s, got %s", n, sub, msg.Params)
+		}
+		if elapsed := time.Since(subscribed); elapsed < time.Duration(n)*150*time.Millisecond {
+			t.Errorf("notification %d came early, after %s", n, elapsed)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package switcher
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	jsonrpc "github.com/protolambda/jsonrpc2"
+	"github.com/protolambda/websocket"
+)
+
+// A source that falls behind is disconnected, instead of holding up the other routes of the shared remote.
+func TestRemoteSlowRouteDoesNotBlockOthers(t *testing.T) {
+	stall := &Effect{Direction: DirectionTargetResponse, RateLimit: &RateLimitEffect{Rate: 0.001, Burst: 1}}
+	srv := startServer(t, &Config{
+		Targets: map[string]*Target{"t": {Endpoint: startTarget(t), KeepAlive: true}},
+		Sources: map[string]*Source{"slow": {Effects: []*Effect{stall}}, "fast": {}},
+		Routes:  map[string]string{"slow": "t", "fast": "t"},
+	})
+	slow := dialSource(t, srv, "/dial/slow")
+	fast := dialSource(t, srv, "/dial/fast")
+
+	// more responses than the effects and the route queue can hold
+	for i := range 3*matchedBuffer + routeQueueSize {
+		if err := slow.Write(request(jsonrpc.RawID(fmt.Sprint(i)), "x", "")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := range 10 {
+		id := jsonrpc.RawID(fmt.Sprint(i))
+		resp := call(t, fast, request(id, "y", ""))
+		if resp.ID != id || resp.Response == nil {
+			t.Fatalf("expected response %s, got %s", id, (&Envelope{Msg: *resp}).JSON())
+		}
+	}
+	// the slow source gets at most the first response, before its route is closed
+	for range 2 {
+		if err := slow.Read(new(jsonrpc.Message)); err != nil {
+			return
+		}
+	}
+	t.Fatal("expected the connection of the slow source to close")
+}
+
+// startClosingTarget starts a websocket target that reads the given number of frames of each connection, and then closes it.
+func startClosingTarget(t *testing.T, frames int) (string, *atomic.Int64) {
+	t.Helper()
+	var conns atomic.Int64
+	srv := websocket.NewServer[*websocket.Connection](func(c *websocket.Connection, meta *websocket.ConnectionMetadata) (*websocket.Connection, error) {
+		conns.Add(1)
+		go func() {
+			for range frames {
+				if _, _, err := c.Read(); err != nil {
+					return
+				}
+			}
+			_ = c.Close()
+		}()
+		return c, nil
+	})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", srv.Handle)
+	s := httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return strings.Replace(s.URL, "http://", "ws://", 1) + "/ws", &conns
+}
+
+// A target that closes every connection is redialed with backoff, not in a loop.
+func TestRemoteLostConnectionBackoff(t *testing.T) {
+	endpoint, conns := startClosingTarget(t, 0)
+	startServer(t, &Config{
+		Targets: map[string]*Target{"t": {Endpoint: endpoint, KeepAlive: true}},
+	})
+	time.Sleep(1500 * time.Millisecond)
+	// the first dial, and the redials after 500ms and 1s of backoff
+	if n := conns.Load(); n < 2 || n > 3 {
+		t.Fatalf("expected 2 or 3 dials, got %d", n)
+	}
+}
+
+// The requests that are pending when the target connection is lost are answered with an error.
+func TestRemoteLostConnectionPending(t *testing.T) {
+	endpoint, _ := startClosingTarget(t, 2)
+	srv := startServer(t, &Config{
+		Targets: map[string]*Target{"t": {Endpoint: endpoint}},
+		Sources: map[string]*Source{"s": {}},
+		Routes:  map[string]string{"s": "t"},
+	})
+	src := dialSource(t, srv, "/dial/s")
+	ids := []jsonrpc.RawID{`"a"`, "7"}
+	for _, id := range ids {
+		if err := src.Write(request(id, "x", "")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for range ids {
+		msg := readMsg(t, src)
+		if msg.Response == nil || msg.Error == nil || msg.Error.Code != connectionLostErrorCode {
+			t.Fatalf("expected connection lost error, got %s", (&Envelope{Msg: *msg}).JSON())
+		}
+		if msg.ID != ids[0] && msg.ID != ids[1] {
+			t.Fatalf("expected the ID of a request, got %s", msg.ID)
+		}
+	}
+}
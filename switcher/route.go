@@ -0,0 +1,478 @@
+package switcher
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+	jsonrpc "github.com/protolambda/jsonrpc2"
+)
+
+// routeQueueSize is the number of messages from the target that may wait for a route.
+// A route that falls further behind is closed, so it does not hold up the other routes of the remote.
+const routeQueueSize = 4096
+
+// maxHeld is the number of messages a paused route holds back per direction.
+// Once a paused route holds this many, it stops reading, and the source or the target is held up instead.
+const maxHeld = 1000
+
+// maxRequestTimes is the number of requests per route of which the latency is measured at any time.
+const maxRequestTimes = 10000
+
+// staleRequestTime is how long a request may go unanswered, before its latency is no longer measured.
+const staleRequestTime = 5 * time.Minute
+
+// Route pairs a source User with the Remote of its target,
+// and pumps messages between the two, through the effects of both.
+type Route struct {
+	log log.Logger
+
+	// id identifies the route in the admin API
+	id uint64
+
+	sourceName string
+	targetName string
+	// ordinal counts the routes between the source and target, this one included.
+	// Together with the generation of the pipelines, it labels the random streams of the route.
+	ordinal    uint64
+	generation uint64
+
+	user   *User
+	remote *Remote
+
+	// ctx is canceled when the route closes
+	ctx context.Context
+
+	// fromTarget buffers the messages the remote dispatched to this route.
+	fromTarget chan *Envelope
+	// overflowed is set when fromTarget ran full, and the route is closing
+	overflowed atomic.Bool
+
+	// configs the current pipelines were built from
+	src    *Source
+	target *Target
+
+	// current pipelines, and the handovers of replacements to the pumps
+	up, down         *pipeline
+	swapUp, swapDown *pipelineSwap
+
+	// resumed is closed while the route runs, and open while the route is paused.
+	pauseLock sync.Mutex
+	resumed   chan struct{}
+
+	// requests that are awaiting a response, by request ID,
+	// so effects can match responses by the request they answer.
+	requestsLock   sync.Mutex
+	sourceRequests map[jsonrpc.RawID]*jsonrpc.Request
+	targetRequests map[jsonrpc.RawID]*jsonrpc.Request
+	// requestTimes are the times the requests of the source entered the switch, to measure latency
+	requestTimes map[jsonrpc.RawID]time.Time
+
+	metrics *metrics
+	taps    *tapHub
+}
+
+func NewRoute(log log.Logger, id uint64, ordinal uint64, user *User, remote *Remote, metrics *metrics, taps *tapHub) *Route {
+	resumed := make(chan struct{})
+	close(resumed)
+	return &Route{
+		log:            log,
+		id:             id,
+		ordinal:        ordinal,
+		sourceName:     user.name,
+		targetName:     remote.name,
+		user:           user,
+		remote:         remote,
+		ctx:            user.Conn.CloseCtx(),
+		fromTarget:     make(chan *Envelope, routeQueueSize),
+		swapUp:         newPipelineSwap(),
+		swapDown:       newPipelineSwap(),
+		resumed:        resumed,
+		sourceRequests: make(map[jsonrpc.RawID]*jsonrpc.Request),
+		targetRequests: make(map[jsonrpc.RawID]*jsonrpc.Request),
+		requestTimes:   make(map[jsonrpc.RawID]time.Time),
+		metrics:        metrics,
+		taps:           taps,
+	}
+}
+
+// Start attaches the route to the remote, and pumps messages in both directions,
+// through the effects of the given source and target, until the source connection closes.
+func (ro *Route) Start(src *Source, target *Target) {
+	ro.remote.Attach(ro)
+	ro.src, ro.target = src, target
+	caps := captures(src, target)
+	ro.up = startPipeline(ro.ctx, upstreamEffects(src, target), ro.stream(true), caps, ro.toTarget)
+	ro.down = startPipeline(ro.ctx, downstreamEffects(src, target), ro.stream(false), caps, ro.toSource)
+	go ro.pump(ro.ctx, ro.user.inwards, ro.up, ro.swapUp, true, ro.targetRequests)
+	go ro.pump(ro.ctx, ro.fromTarget, ro.down, ro.swapDown, false, ro.sourceRequests)
+	go func() {
+		<-ro.ctx.Done()
+		ro.remote.Detach(ro)
+		ro.log.Info("closed route")
+	}()
+}
+
+// Reload replaces the effects of the route, without interrupting the connections.
+// The new pipelines are handed to the pumps without waiting for them,
+// so a busy or paused route does not hold up the reload.
+// The previous pipelines are returned: they are shut down,
+// but may still be processing the messages that entered them before the reload.
+// Reload must not be called concurrently.
+func (ro *Route) Reload(src *Source, target *Target) (old []*pipeline) {
+	ro.src, ro.target = src, target
+	ro.generation += 1
+	caps := captures(src, target)
+	up := startPipeline(ro.ctx, upstreamEffects(src, target), ro.stream(true), caps, ro.toTarget)
+	down := startPipeline(ro.ctx, downstreamEffects(src, target), ro.stream(false), caps, ro.toSource)
+	ro.swapUp.offer(up)
+	ro.swapDown.offer(down)
+	old = []*pipeline{ro.up, ro.down}
+	ro.up, ro.down = up, down
+	return old
+}
+
+// stream labels the random streams of the pipeline of the route in the given direction.
+// Routes are numbered per source and target in the order they connect,
+// so the routes of other sources and targets do not change the draws.
+// Every reload starts new streams, rather than repeating the draws of the previous pipelines.
+func (ro *Route) stream(upstream bool) []string {
+	direction := "down"
+	if upstream {
+		direction = "up"
+	}
+	return []string{ro.sourceName, ro.targetName, strconv.FormatUint(ro.ordinal, 10),
+		strconv.FormatUint(ro.generation, 10), direction}
+}
+
+// pipelineSwap hands a replacement pipeline to a pump, without blocking the sender.
+type pipelineSwap struct {
+	mu   sync.Mutex
+	next *pipeline
+	// closed is true once the pump stopped
+	closed bool
+	// ready signals that a replacement is pending
+	ready chan struct{}
+}
+
+func newPipelineSwap() *pipelineSwap {
+	return &pipelineSwap{ready: make(chan struct{}, 1)}
+}
+
+// offer makes the pipeline the pending replacement.
+// A replacement that the pump did not pick up yet is shut down, since no messages entered it.
+// If the pump stopped, the pipeline is shut down right away.
+func (s *pipelineSwap) offer(p *pipeline) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		close(p.head)
+		return
+	}
+	if s.next != nil {
+		close(s.next.head)
+	}
+	s.next = p
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+// take returns the pending replacement, or nil if there is none.
+func (s *pipelineSwap) take() *pipeline {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := s.next
+	s.next = nil
+	return p
+}
+
+// close shuts down the pending replacement, and any that are offered later.
+func (s *pipelineSwap) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.next != nil {
+		close(s.next.head)
+		s.next = nil
+	}
+}
+
+// Pause holds all messages of the route, in both directions, until the route is resumed.
+func (ro *Route) Pause() {
+	ro.pauseLock.Lock()
+	defer ro.pauseLock.Unlock()
+	if !ro.paused() {
+		ro.resumed = make(chan struct{})
+		ro.log.Info("paused route")
+	}
+}
+
+// Resume releases the messages that were held while the route was paused.
+func (ro *Route) Resume() {
+	ro.pauseLock.Lock()
+	defer ro.pauseLock.Unlock()
+	if ro.paused() {
+		close(ro.resumed)
+		ro.log.Info("resumed route")
+	}
+}
+
+// Paused reports whether the route is holding messages.
+func (ro *Route) Paused() bool {
+	ro.pauseLock.Lock()
+	defer ro.pauseLock.Unlock()
+	return ro.paused()
+}
+
+// paused checks the pause state. The caller must hold the pause lock.
+func (ro *Route) paused() bool {
+	select {
+	case <-ro.resumed:
+		return false
+	default:
+		return true
+	}
+}
+
+// resumedSignal returns a channel that is closed when the route is not paused.
+func (ro *Route) resumedSignal() <-chan struct{} {
+	ro.pauseLock.Lock()
+	defer ro.pauseLock.Unlock()
+	return ro.resumed
+}
+
+// toTarget is the output of the upstream pipeline.
+// Corrupted messages are captured as the frame that is written, with the request ID of the target connection.
+func (ro *Route) toTarget(em *Envelope) {
+	out := ro.remote.prepare(ro, em)
+	if em.corrupt != nil {
+		out.record(CaptureForwarded)
+	} else {
+		em.record(CaptureForwarded)
+	}
+	em.observe(eventOut)
+	ro.trackRequest(ro.sourceRequests, em)
+	if out != em && out.corrupt != nil && !carriesID(out) {
+		ro.forgetRequest(em.Msg.ID, out.Msg.ID)
+		em.release()
+	}
+	if err := ro.remote.Send(ro.ctx, out); err != nil {
+		ro.log.Debug("failed to send message to target", "err", err)
+	}
+}
+
+// toSource is the output of the downstream pipeline.
+func (ro *Route) toSource(em *Envelope) {
+	em.record(CaptureForwarded)
+	em.observe(eventOut)
+	if em.Msg.Response != nil && ro.metrics != nil {
+		if since, ok := ro.stopRequestTime(em.Msg.ID); ok {
+			ro.metrics.observeLatency(ro, em.Method(), since)
+		}
+	}
+	ro.trackRequest(ro.targetRequests, em)
+	send(ro.ctx, ro.user.outwards, em)
+}
+
+// deliver passes a message from the remote to the route, without blocking the remote.
+// If the route fell too far behind, it is closed.
+func (ro *Route) deliver(em *Envelope) {
+	select {
+	case <-ro.ctx.Done():
+	case ro.fromTarget <- em:
+	default:
+		if ro.overflowed.CompareAndSwap(false, true) {
+			ro.log.Warn("source is not keeping up with the target, closing route", "queued", routeQueueSize)
+			go func() {
+				if err := ro.user.Close(); err != nil {
+					ro.log.Warn("failed to close source connection", "err", err)
+				}
+			}()
+		}
+	}
+}
+
+// respond injects a response to the request into the opposite direction of the route.
+func (ro *Route) respond(req *Envelope, resp *jsonrpc.Message) {
+	em := &Envelope{
+		Ctx:     req.Ctx,
+		Msg:     *resp,
+		Request: req.Request,
+	}
+	to := ro.user.inwards
+	if req.FromSource {
+		to = ro.fromTarget
+	}
+	select {
+	case <-ro.ctx.Done():
+	case to <- em:
+	}
+}
+
+// startRequestTime remembers when the request of the source entered the switch, to measure its latency.
+// Requests that are never answered, e.g. as the target went away, are forgotten after staleRequestTime,
+// once the route tracks maxRequestTimes requests. Requests beyond that are not measured.
+func (ro *Route) startRequestTime(id jsonrpc.RawID) {
+	ro.requestsLock.Lock()
+	defer ro.requestsLock.Unlock()
+	if len(ro.requestTimes) >= maxRequestTimes {
+		for id, since := range ro.requestTimes {
+			if time.Since(since) > staleRequestTime {
+				delete(ro.requestTimes, id)
+			}
+		}
+		if len(ro.requestTimes) >= maxRequestTimes {
+			return
+		}
+	}
+	ro.requestTimes[id] = time.Now()
+}
+
+// stopRequestTime forgets the request of the source, and returns when it entered the switch, if known.
+func (ro *Route) stopRequestTime(id jsonrpc.RawID) (since time.Time, ok bool) {
+	ro.requestsLock.Lock()
+	defer ro.requestsLock.Unlock()
+	since, ok = ro.requestTimes[id]
+	delete(ro.requestTimes, id)
+	return since, ok
+}
+
+// forgetRequest stops waiting for the response to the request of the source,
+// e.g. as the request was corrupted into a frame without ID, that the target cannot answer.
+// The target ID is the rewritten ID of the request on the target connection.
+func (ro *Route) forgetRequest(id, targetID jsonrpc.RawID) {
+	ro.remote.mux.forget(targetID)
+	ro.requestsLock.Lock()
+	delete(ro.sourceRequests, id)
+	ro.requestsLock.Unlock()
+	ro.stopRequestTime(id)
+}
+
+// trackRequest remembers a request that left the pipeline,
+// so the response can be matched with it.
+func (ro *Route) trackRequest(requests map[jsonrpc.RawID]*jsonrpc.Request, em *Envelope) {
+	if em.Msg.Request == nil || em.Msg.ID.IsNotification() {
+		return
+	}
+	ro.requestsLock.Lock()
+	defer ro.requestsLock.Unlock()
+	requests[em.Msg.ID] = em.Msg.Request
+}
+
+// pump feeds messages into the pipeline, until the context is canceled.
+// Pipelines handed over by the swap replace the current pipeline, which is then shut down.
+// Responses are annotated with the request they answer,
+// as tracked in the requests that went the other way.
+// While the route is paused, messages are held back, but still read, up to maxHeld messages,
+// so a paused route does not block the other routes of the remote.
+func (ro *Route) pump(ctx context.Context, from <-chan *Envelope, to *pipeline, swap *pipelineSwap,
+	fromSource bool, requests map[jsonrpc.RawID]*jsonrpc.Request) {
+	defer func() {
+		// close whichever pipeline is current by then, and any replacement that is still pending
+		close(to.head)
+		swap.close()
+	}()
+	var held []*Envelope
+	ok := true
+	for {
+		resumed := ro.resumedSignal()
+		paused := true
+		select {
+		case <-resumed:
+			paused = false
+			resumed = nil
+		default:
+		}
+		if !paused && len(held) > 0 {
+			for _, em := range held {
+				if to, ok = ro.feed(ctx, to, swap, em, fromSource, requests); !ok {
+					return
+				}
+			}
+			held = nil
+			continue
+		}
+		in := from
+		if len(held) >= maxHeld {
+			in = nil
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-resumed:
+		case <-swap.ready:
+			to = swapPipeline(to, swap)
+		case em := <-in:
+			if paused {
+				held = append(held, em)
+				continue
+			}
+			if to, ok = ro.feed(ctx, to, swap, em, fromSource, requests); !ok {
+				return
+			}
+		}
+	}
+}
+
+// swapPipeline shuts down the current pipeline, if the swap has a replacement for it.
+func swapPipeline(current *pipeline, swap *pipelineSwap) *pipeline {
+	next := swap.take()
+	if next == nil {
+		return current
+	}
+	close(current.head)
+	return next
+}
+
+// feed annotates the message with the route, and sends it into the pipeline.
+// If a replacement pipeline is handed over while the current pipeline is busy,
+// the message enters the replacement instead. The pipeline the message entered is returned.
+// If the pipeline captures messages, or taps are connected, the message is traced to record its outcome.
+func (ro *Route) feed(ctx context.Context, to *pipeline, swap *pipelineSwap, em *Envelope,
+	fromSource bool, requests map[jsonrpc.RawID]*jsonrpc.Request) (*pipeline, bool) {
+	em.Route = ro
+	em.FromSource = fromSource
+	// responses synthesized by effects already know their request
+	injected := em.Msg.Response != nil && em.Request != nil
+	ro.trace(to, em, injected)
+	if em.Msg.Request != nil {
+		em.Request = em.Msg.Request
+		if fromSource && !em.Msg.ID.IsNotification() && ro.metrics != nil {
+			ro.startRequestTime(em.Msg.ID)
+		}
+	} else if em.Msg.Response != nil && em.Request == nil {
+		ro.requestsLock.Lock()
+		em.Request = requests[em.Msg.ID]
+		delete(requests, em.Msg.ID)
+		ro.requestsLock.Unlock()
+	}
+	em.observe(eventIn)
+	for {
+		select {
+		case <-ctx.Done():
+			em.dropped()
+			return to, false
+		case to.head <- em:
+			return to, true
+		case <-swap.ready:
+			if next := swapPipeline(to, swap); next != to {
+				to = next
+				ro.trace(to, em, injected)
+			}
+		}
+	}
+}
+
+// trace prepares the message to record its outcome, if the pipeline captures messages, or taps are connected.
+func (ro *Route) trace(to *pipeline, em *Envelope, injected bool) {
+	if em.trace != nil {
+		em.trace.files = to.captures
+	} else if len(to.captures) > 0 || ro.taps.active() {
+		em.trace = newCaptureTrace(to.captures, ro.taps, ro, em, injected)
+	}
+}
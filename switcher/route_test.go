@@ -0,0 +1,81 @@
+package switcher
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	jsonrpc "github.com/protolambda/jsonrpc2"
+	"github.com/protolambda/websocket"
+)
+
+func TestRoute(t *testing.T) {
+	srv := startServer(t, &Config{
+		Targets: map[string]*Target{"t": {Endpoint: startTarget(t), Effects: []*Effect{
+			{RegexMatcher: regexp.MustCompile("^eth_gasPrice$"), Direction: DirectionTargetResponse, Substitute: &SubstituteEffect{Result: "target"}},
+		}}, "t2": {Endpoint: startTarget(t)}},
+		Sources: map[string]*Source{"lone": {}, "s": {Effects: []*Effect{
+			{RegexMatcher: regexp.MustCompile("^eth_call$"), Direction: DirectionSourceRequest, Error: &ErrorEffect{Chance: 1, Code: 5, Message: "source"}},
+		}}},
+		Routes: map[string]string{"s": "t"},
+	})
+	src := dialSource(t, srv, "/dial/s")
+
+	// messages are relayed in both directions, through the effects of the source and of the target
+	for i, id := range []jsonrpc.RawID{"1", `"a"`, "1"} {
+		expectResult(t, call(t, src, request(id, "eth_chainId", "[]")), id, "eth_chainId:"+strconv.Itoa(i+1))
+	}
+	expectResult(t, call(t, src, request("2", "eth_gasPrice", "")), "2", "target")
+	if resp := call(t, src, request("3", "eth_call", "")); resp.Error == nil || resp.Error.Message != "source" {
+		t.Fatalf("expected error of the source effect, got %s", (&Envelope{Msg: *resp}).JSON())
+	}
+
+	// requests of the target reach the source
+	resp := call(t, src, request("4", "eth_subscribe", `["newHeads"]`))
+	var sub string
+	if resp.Result == nil || decodeJSON(*resp.Result, &sub) != nil {
+		t.Fatalf("expected subscription, got %s", (&Envelope{Msg: *resp}).JSON())
+	}
+	if msg := readMsg(t, src); msg.Request == nil || msg.Method != "eth_subscription" {
+		t.Fatalf("expected notification, got %s", (&Envelope{Msg: *msg}).JSON())
+	}
+
+	// sources may dial any target explicitly, also other than their default one, or without a default route
+	other := dialSource(t, srv, "/dial/s/t2")
+	expectResult(t, call(t, other, request("5", "eth_gasPrice", "")), "5", "eth_gasPrice:1")
+	if resp := call(t, other, request("6", "eth_call", "")); resp.Error == nil || resp.Error.Message != "source" {
+		t.Fatalf("expected error of the source effect, got %s", (&Envelope{Msg: *resp}).JSON())
+	}
+	expectResult(t, call(t, dialSource(t, srv, "/dial/lone/t"), request("1", "eth_gasPrice", "")), "1", "target")
+
+	// unknown routes are rejected before upgrading
+	if _, err := websocket.Dial(context.Background(), "ws://"+srv.Address()+"/dial/unknown"); err == nil {
+		t.Fatal("expected dial of unknown source to fail")
+	}
+	for _, tc := range []struct {
+		path string
+		msg  string
+	}{
+		{"/dial/unknown", `unknown source "unknown"`},
+		{"/dial/unknown/t", `unknown source "unknown"`},
+		{"/dial/s/unknown", `unknown target "unknown"`},
+		{"/dial/lone", `source "lone" has no default route, a target must be specified`},
+	} {
+		resp, err := http.Get("http://" + srv.Address() + tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusNotFound || strings.TrimSpace(string(body)) != tc.msg {
+			t.Errorf("%s: expected %d %q, got %s %q", tc.path, http.StatusNotFound, tc.msg, resp.Status, body)
+		}
+	}
+}
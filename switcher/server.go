@@ -1,6 +1,7 @@
 package switcher
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
@@ -19,6 +20,9 @@ type Server struct {
 
 	boundAddr net.Addr
 
+	// tls, if not nil, terminates TLS on the listener
+	tls *tls.Config
+
 	srv *http.Server
 
 	backend *Backend
@@ -26,27 +30,38 @@ type Server struct {
 	running atomic.Bool
 }
 
-func NewServer(log log.Logger, addr string, cfg *Config) *Server {
+// NewServer creates a server that listens on the given address.
+// If tlsCfg is not nil, the server only accepts TLS connections.
+func NewServer(log log.Logger, addr string, cfg *Config, tlsCfg *tls.Config) *Server {
 	backend := NewBackend(log, cfg)
 	return &Server{
 		log:  log,
 		addr: addr,
+		tls:  tlsCfg,
 		srv: &http.Server{
 			Handler: backend,
 		},
+		backend: backend,
 	}
 }
 
 func (s *Server) Start() error {
-	if s.running.CompareAndSwap(false, true) {
+	if !s.running.CompareAndSwap(false, true) {
 		return errors.New("server was already started")
 	}
 
+	if err := s.backend.Start(); err != nil {
+		return fmt.Errorf("failed to start backend: %w", err)
+	}
+
 	listener, err := net.Listen("tcp", s.addr)
 	if err != nil {
 		return fmt.Errorf("failed to bind to address %q: %w", s.addr, err)
 	}
 	s.boundAddr = listener.Addr()
+	if s.tls != nil {
+		listener = tls.NewListener(listener, s.tls)
+	}
 
 	go func() {
 		err := s.srv.Serve(listener)
@@ -58,8 +73,13 @@ func (s *Server) Start() error {
 	return nil
 }
 
+// Reload applies a new config, without closing the connections of routes that still exist.
+func (s *Server) Reload(cfg *Config) error {
+	return s.backend.Reload(cfg)
+}
+
 func (s *Server) Close() error {
-	if s.running.CompareAndSwap(true, false) {
+	if !s.running.CompareAndSwap(true, false) {
 		return errors.New("server was not running or already closed")
 	}
 
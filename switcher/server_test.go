@@ -0,0 +1,181 @@
+package switcher
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+	jsonrpc "github.com/protolambda/jsonrpc2"
+	"github.com/protolambda/switcheroo/ws"
+	"github.com/protolambda/websocket"
+)
+
+// testTimeout bounds every wait of the tests on a message.
+const testTimeout = 5 * time.Second
+
+// startTarget starts a websocket target that answers every request with its method and ID, e.g. "eth_chainId:1",
+// and eth_subscribe with a new subscription ID, followed by a notification of the subscription.
+func startTarget(t *testing.T) string {
+	t.Helper()
+	endpoint, _ := startCountedTarget(t)
+	return endpoint
+}
+
+// startCountedTarget starts a target like startTarget, and counts the connections to it.
+func startCountedTarget(t *testing.T) (string, *atomic.Int64) {
+	t.Helper()
+	var subs, conns atomic.Int64
+	srv := websocket.NewServer[*websocket.Connection](func(c *websocket.Connection, meta *websocket.ConnectionMetadata) (*websocket.Connection, error) {
+		conns.Add(1)
+		rpc := ws.NewJSONRPC(c)
+		go func() {
+			for {
+				var m jsonrpc.Message
+				if err := rpc.Read(&m); err != nil {
+					return
+				}
+				if m.Request == nil || m.ID.IsNotification() {
+					continue
+				}
+				if m.Method == "eth_subscribe" {
+					id := fmt.Sprintf("0xsub%d", subs.Add(1))
+					_ = rpc.Write(m.Respond(id))
+					params := jsonrpc.Params(fmt.Sprintf(`{"subscription":%q,"result":%q}`, id, id))
+					_ = rpc.Write(&jsonrpc.Message{Request: &jsonrpc.Request{Method: "eth_subscription", Params: params}})
+					continue
+				}
+				_ = rpc.Write(m.Respond(m.Method + ":" + string(m.ID)))
+			}
+		}()
+		return c, nil
+	})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", srv.Handle)
+	s := httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return strings.Replace(s.URL, "http://", "ws://", 1) + "/ws", &conns
+}
+
+// startServer starts a switch with the config, that is closed when the test ends.
+func startServer(t *testing.T, cfg *Config) *Server {
+	t.Helper()
+	srv := NewServer(testLogger(t), "127.0.0.1:0", cfg, nil)
+	if err := srv.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	t.Cleanup(func() { _ = srv.Close() })
+	return srv
+}
+
+// dialSource connects to the switch as a source, through the given dial path, e.g. "/dial/a".
+func dialSource(t *testing.T, srv *Server, path string) *ws.JSONRPC {
+	t.Helper()
+	conn, err := websocket.Dial(context.Background(), "ws://"+srv.Address()+path)
+	if err != nil {
+		t.Fatalf("failed to dial %s: %v", path, err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return ws.NewJSONRPC(conn)
+}
+
+// request builds a request message.
+func request(id jsonrpc.RawID, method string, params string) *jsonrpc.Message {
+	msg := &jsonrpc.Message{Request: &jsonrpc.Request{Method: method}, ID: id}
+	if params != "" {
+		msg.Params = jsonrpc.Params(params)
+	}
+	return msg
+}
+
+// readMsg reads the next message, and fails the test if none arrives in time.
+func readMsg(t *testing.T, rpc *ws.JSONRPC) *jsonrpc.Message {
+	t.Helper()
+	done := make(chan error, 1)
+	var msg jsonrpc.Message
+	go func() { done <- rpc.Read(&msg) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("failed to read message: %v", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for message")
+	}
+	return &msg
+}
+
+// call writes the request, and reads the next message.
+func call(t *testing.T, rpc *ws.JSONRPC, req *jsonrpc.Message) *jsonrpc.Message {
+	t.Helper()
+	if err := rpc.Write(req); err != nil {
+		t.Fatalf("failed to write request: %v", err)
+	}
+	return readMsg(t, rpc)
+}
+
+// expectResult checks that the message is a response with the given ID and string result.
+func expectResult(t *testing.T, msg *jsonrpc.Message, id jsonrpc.RawID, result string) {
+	t.Helper()
+	if msg.Response == nil {
+		t.Fatalf("expected response, got %s", msg.Method)
+	}
+	if msg.ID != id {
+		t.Errorf("expected ID %s, got %s", id, msg.ID)
+	}
+	if msg.Error != nil {
+		t.Fatalf("expected result %q, got error %d: %s", result, msg.Error.Code, msg.Error.Message)
+	}
+	var got string
+	if msg.Result == nil || decodeJSON(*msg.Result, &got) != nil || got != result {
+		t.Fatalf("expected result %q, got %s", result, (&Envelope{Msg: *msg}).JSON())
+	}
+}
+
+// eventually retries the check until it succeeds, and fails the test if it does not succeed in time.
+func eventually(t *testing.T, check func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for !check() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// testLogger logs to the test output, until the test ends.
+func testLogger(t *testing.T) log.Logger {
+	w := &testWriter{t: t}
+	t.Cleanup(w.stop)
+	return log.NewLogger(log.NewTerminalHandler(w, false))
+}
+
+// testWriter writes to the test log.
+// Connections may still log while shutting down, so output after the test ended is discarded.
+type testWriter struct {
+	t       *testing.T
+	mu      sync.Mutex
+	stopped bool
+}
+
+func (w *testWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.stopped {
+		w.t.Log(strings.TrimSpace(string(p)))
+	}
+	return len(p), nil
+}
+
+func (w *testWriter) stop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.stopped = true
+}
@@ -0,0 +1,167 @@
+package switcher
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sync"
+	"sync/atomic"
+
+	"github.com/protolambda/websocket"
+)
+
+// tapBuffer is the number of records that may queue up for a slow tap, before records are skipped.
+const tapBuffer = 256
+
+// tapFilter selects the messages a tap streams. Empty fields match anything.
+type tapFilter struct {
+	method *regexp.Regexp
+	source string
+	target string
+}
+
+func (f *tapFilter) match(rec *CaptureRecord) bool {
+	if f.source != "" && f.source != rec.Source {
+		return false
+	}
+	if f.target != "" && f.target != rec.Target {
+		return false
+	}
+	if f.method != nil && !f.method.MatchString(rec.Method) {
+		return false
+	}
+	return true
+}
+
+// tap is a connection that streams the records of matching messages.
+type tap struct {
+	conn    *websocket.Connection
+	filter  *tapFilter
+	records chan *CaptureRecord
+	// skipped counts the records that did not fit in the buffer
+	skipped atomic.Uint64
+}
+
+// tapHub publishes the records of traced messages to the connected taps.
+type tapHub struct {
+	mu   sync.RWMutex
+	taps map[*tap]struct{}
+	// count of the taps, to check if messages need to be traced without locking
+	count atomic.Int32
+}
+
+func newTapHub() *tapHub {
+	return &tapHub{taps: make(map[*tap]struct{})}
+}
+
+// active checks if any taps are connected.
+func (h *tapHub) active() bool {
+	return h != nil && h.count.Load() > 0
+}
+
+func (h *tapHub) add(t *tap) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.taps[t] = struct{}{}
+	h.count.Store(int32(len(h.taps)))
+}
+
+func (h *tapHub) remove(t *tap) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.taps, t)
+	h.count.Store(int32(len(h.taps)))
+}
+
+// publish passes the record to the matching taps.
+// Taps that cannot keep up skip records, rather than holding up the routes.
+func (h *tapHub) publish(rec *CaptureRecord) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for t := range h.taps {
+		if !t.filter.match(rec) {
+			continue
+		}
+		select {
+		case t.records <- rec:
+		default:
+			t.skipped.Add(1)
+		}
+	}
+}
+
+type tapFilterCtxKeyType struct{}
+
+var tapFilterCtxKey = tapFilterCtxKeyType{}
+
+// handleTap upgrades to a websocket that streams the records of messages as they cross the switch,
+// one JSON CaptureRecord per message.
+// The optional method (regex), source and target query parameters filter the messages.
+func (ba *Backend) handleTap(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := &tapFilter{source: q.Get("source"), target: q.Get("target")}
+	if m := q.Get("method"); m != "" {
+		re, err := regexp.Compile(m)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid method filter: %v", err), http.StatusBadRequest)
+			return
+		}
+		filter.method = re
+	}
+	r = r.WithContext(context.WithValue(r.Context(), tapFilterCtxKey, filter))
+	ba.tapSrv.Handle(w, r)
+}
+
+func (ba *Backend) initTapServer() {
+	ba.tapSrv = websocket.NewServer[*tap](func(c *websocket.Connection, meta *websocket.ConnectionMetadata) (*tap, error) {
+		filter, ok := meta.Context.Value(tapFilterCtxKey).(*tapFilter)
+		if !ok {
+			return nil, errors.New("tap without filter")
+		}
+		t := &tap{conn: c, filter: filter, records: make(chan *CaptureRecord, tapBuffer)}
+		ba.taps.add(t)
+		ba.log.Info("opened tap", "remote", meta.RemoteAddr,
+			"source", filter.source, "target", filter.target, "method", filter.method)
+		go ba.runTap(t)
+		return t, nil
+	}, websocket.WithOnDisconnect(func(t *tap) {
+		ba.taps.remove(t)
+		ba.log.Info("closed tap", "skipped", t.skipped.Load())
+	}), websocket.WithCheckOrigin[*tap](func(r *http.Request) bool {
+		return originAllowed(ba.cfg.Load().Origins, r.Header.Get("Origin"))
+	}))
+}
+
+// runTap writes the records to the tap connection, until it closes.
+func (ba *Backend) runTap(t *tap) {
+	c := t.conn
+	// Read, to handle pings and the close of the connection. Taps do not send messages.
+	go func() {
+		for {
+			if _, _, err := c.Read(); err != nil {
+				c.CloseWithCause(err)
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case <-c.CloseCtx().Done():
+			return
+		case rec := <-t.records:
+			data, err := json.Marshal(rec)
+			if err != nil {
+				ba.log.Warn("failed to encode tap record", "err", err)
+				continue
+			}
+			if err := c.Write(websocket.TextMessage, data); err != nil {
+				ba.log.Debug("failed to write to tap", "err", err)
+				c.CloseWithCause(err)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package switcher
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/protolambda/websocket"
+)
+
+func TestTap(t *testing.T) {
+	endpoint := startTarget(t)
+	config := func(allowIP string) *Config {
+		return &Config{
+			Targets: map[string]*Target{"t": {Endpoint: endpoint}},
+			Sources: map[string]*Source{"s": {Effects: []*Effect{
+				{RegexMatcher: regexp.MustCompile("^eth_err$"), Direction: DirectionSourceRequest, Error: &ErrorEffect{Chance: 1, Code: 5}},
+			}}, "s2": {}},
+			Routes:    map[string]string{"s": "t", "s2": "t"},
+			AdminAuth: &Auth{AllowIPs: []string{allowIP}},
+		}
+	}
+	srv := startServer(t, config("10.0.0.0/8"))
+	if _, err := websocket.Dial(context.Background(), "ws://"+srv.Address()+"/tap"); err == nil {
+		t.Fatal("expected tap of a client that is not allowed to be rejected")
+	}
+	if err := srv.Reload(config("127.0.0.1")); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Get("http://" + srv.Address() + "/tap?method=(")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected invalid method filter to be rejected, got %s", resp.Status)
+	}
+
+	conn, err := websocket.Dial(context.Background(), "ws://"+srv.Address()+"/tap?method=^eth_&source=s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	eventually(t, srv.backend.taps.active)
+
+	for _, call := range []string{"s/eth_x", "s/net_x", "s2/eth_x", "s/eth_err", "s/eth_end"} {
+		source, method, _ := strings.Cut(call, "/")
+		status, _ := postJSON(t, srv, "/dial/"+source, `{"jsonrpc":"2.0","id":1,"method":"`+method+`"}`)
+		if status != http.StatusOK {
+			t.Fatalf("%s: unexpected status %d", call, status)
+		}
+	}
+	// the records of the messages that pass the filter, in the order they crossed the switch
+	want := []string{
+		"eth_x source-request forwarded", "eth_x target-response forwarded",
+		"eth_err source-request answered", "eth_err target-response injected",
+		"eth_end source-request forwarded", "eth_end target-response forwarded",
+	}
+	for i, w := range want {
+		var rec CaptureRecord
+		readTap := make(chan error, 1)
+		go func() {
+			_, data, err := conn.Read()
+			if err == nil {
+				err = json.Unmarshal(data, &rec)
+			}
+			readTap <- err
+		}()
+		select {
+		case err := <-readTap:
+			if err != nil {
+				t.Fatalf("failed to read tap record %d: %v", i, err)
+			}
+		case <-time.After(testTimeout):
+			t.Fatalf("timed out waiting for tap record %d", i)
+		}
+		if rec.Source != "s" {
+			t.Errorf("record %d: expected source s, got %s", i, rec.Source)
+		}
+		if got := rec.Method + " " + rec.Direction.String() + " " + string(rec.Outcome); got != w {
+			t.Errorf("record %d: expected %q, got %q", i, w, got)
+		}
+	}
+}
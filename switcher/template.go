@@ -0,0 +1,137 @@
+package switcher
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// substituteTemplateData is the data a substitute template is executed with.
+type substituteTemplateData struct {
+	// ID of the request, decoded from JSON. Nil if unknown.
+	ID any
+	// Method of the request. Empty if unknown.
+	Method string
+	// Params of the request, decoded from JSON. Nil if unknown.
+	Params any
+	// Result of the response that is being substituted, decoded from JSON.
+	// Nil when substituting a request, or if the response is an error.
+	Result any
+}
+
+// substituteTemplateFuncs are the functions available to substitute templates,
+// next to the text/template builtins.
+var substituteTemplateFuncs = template.FuncMap{
+	// json encodes a value as JSON.
+	"json": func(v any) (string, error) {
+		out, err := json.Marshal(v)
+		return string(out), err
+	},
+	// hex formats a number, or a number-string, as 0x-prefixed hex quantity.
+	"hex": func(v any) (string, error) {
+		x, err := toBig(v)
+		if err != nil {
+			return "", err
+		}
+		return "0x" + x.Text(16), nil
+	},
+	// int parses a number, or a decimal or 0x-prefixed hex number-string, into an integer.
+	"int": toBig,
+	// add sums numbers, or number-strings.
+	"add": func(values ...any) (*big.Int, error) {
+		sum := new(big.Int)
+		for _, v := range values {
+			x, err := toBig(v)
+			if err != nil {
+				return nil, err
+			}
+			sum.Add(sum, x)
+		}
+		return sum, nil
+	},
+	// now is the current unix time in seconds.
+	"now": func() int64 {
+		return time.Now().Unix()
+	},
+}
+
+// toBig converts a decoded JSON number, an integer, or a number-string, into a big integer.
+// Strings may be decimal, or 0x-prefixed hex.
+func toBig(v any) (*big.Int, error) {
+	switch x := v.(type) {
+	case *big.Int:
+		return x, nil
+	case int:
+		return big.NewInt(int64(x)), nil
+	case int64:
+		return big.NewInt(x), nil
+	case uint64:
+		return new(big.Int).SetUint64(x), nil
+	case float64:
+		out, _ := big.NewFloat(x).Int(nil)
+		return out, nil
+	case json.Number:
+		out, ok := new(big.Int).SetString(x.String(), 10)
+		if !ok {
+			return nil, fmt.Errorf("invalid number: %q", x)
+		}
+		return out, nil
+	case string:
+		base := 10
+		if s, ok := strings.CutPrefix(x, "0x"); ok {
+			x, base = s, 16
+		}
+		out, ok := new(big.Int).SetString(x, base)
+		if !ok {
+			return nil, fmt.Errorf("invalid number: %q", v)
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("cannot convert %T to number", v)
+	}
+}
+
+// renderSubstitute executes the template with the request of the envelope,
+// and checks that the output is valid JSON.
+func renderSubstitute(tmpl *template.Template, em *Envelope) (json.RawMessage, error) {
+	var data substituteTemplateData
+	if !em.Msg.ID.IsNotification() {
+		if err := decodeJSON([]byte(em.Msg.ID), &data.ID); err != nil {
+			return nil, fmt.Errorf("failed to decode ID: %w", err)
+		}
+	}
+	if em.Request != nil {
+		data.Method = em.Request.Method
+		if len(em.Request.Params) > 0 {
+			if err := decodeJSON(em.Request.Params, &data.Params); err != nil {
+				return nil, fmt.Errorf("failed to decode params: %w", err)
+			}
+		}
+	}
+	if em.Msg.Response != nil && em.Msg.Result != nil {
+		if err := decodeJSON(*em.Msg.Result, &data.Result); err != nil {
+			return nil, fmt.Errorf("failed to decode result: %w", err)
+		}
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, &data); err != nil {
+		return nil, fmt.Errorf("failed to render substitute: %w", err)
+	}
+	out := bytes.TrimSpace(buf.Bytes())
+	if !json.Valid(out) {
+		return nil, errors.New("substitute template did not render valid JSON")
+	}
+	return out, nil
+}
+
+// decodeJSON decodes JSON, keeping numbers as json.Number, so large numbers are not rounded.
+func decodeJSON(data []byte, dest any) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(dest)
+}
@@ -0,0 +1,59 @@
+package switcher
+
+import (
+	"encoding/json"
+	"testing"
+
+	jsonrpc "github.com/protolambda/jsonrpc2"
+)
+
+func TestSubstituteTemplate(t *testing.T) {
+	req := &jsonrpc.Request{Method: "eth_getBlockByNumber", Params: jsonrpc.Params(`["0x10", false, 18446744073709551617]`)}
+	onRequest := &Envelope{Msg: jsonrpc.Message{Request: req, ID: `"abc"`}, Request: req}
+	result := json.RawMessage(`{"number":"0x10","gasUsed":"0x5"}`)
+	onResponse := &Envelope{Msg: jsonrpc.Message{Response: &jsonrpc.Response{Result: &result}, ID: "1"}, Request: req}
+	for _, tc := range []struct {
+		tmpl   string
+		em     *Envelope
+		expect string
+	}{
+		{`{"number": {{index .Params 0 | json}}, "id": {{json .ID}}, "method": "{{.Method}}"}`, onRequest,
+			`{"number": "0x10", "id": "abc", "method": "eth_getBlockByNumber"}`},
+		{`"{{add (index .Params 0) 1 | hex}}"`, onRequest, `"0x11"`},
+		// large numbers are not rounded
+		{`{{add (index .Params 2) 1}}`, onRequest, `18446744073709551618`},
+		{`{{int "0xff"}}`, onRequest, `255`},
+		{`{"number": "{{add .Result.number .Result.gasUsed | hex}}", "full": {{index .Params 1}}}`, onResponse,
+			`{"number": "0x15", "full": false}`},
+	} {
+		ef := &SubstituteEffect{Template: tc.tmpl}
+		if err := ef.Init(); err != nil {
+			t.Fatalf("failed to init %s: %v", tc.tmpl, err)
+		}
+		resp := ef.response(tc.em)
+		if resp.Error != nil {
+			t.Errorf("%s: unexpected error: %s", tc.tmpl, resp.Error.Message)
+			continue
+		}
+		if got := string(*resp.Result); got != tc.expect {
+			t.Errorf("%s: expected %s, got %s", tc.tmpl, tc.expect, got)
+		}
+	}
+
+	// templates that fail, or do not render JSON, answer with an internal error
+	for _, tmpl := range []string{`{"number": {{index .Params 0}}}`, `{{hex .Method}}`, `{{index .Params 5}}`} {
+		ef := &SubstituteEffect{Template: tmpl}
+		if err := ef.Init(); err != nil {
+			t.Fatalf("failed to init %s: %v", tmpl, err)
+		}
+		if resp := ef.response(onRequest); resp.Error == nil || resp.Error.Code != int64(jsonrpc.InternalError) {
+			t.Errorf("%s: expected internal error, got %v", tmpl, resp.Result)
+		}
+	}
+
+	for _, ef := range []*SubstituteEffect{{Template: `{{`}, {Template: `1`, Result: 1}} {
+		if err := ef.Init(); err == nil {
+			t.Errorf("expected %q to be rejected", ef.Template)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package switcher
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// TargetTLS configures how the TLS connection to a wss:// or https:// target is verified and authenticated.
+type TargetTLS struct {
+	// CA is the path to a PEM bundle of CA certificates to verify the target with,
+	// instead of the system roots.
+	CA string `yaml:"ca,omitempty"`
+	// Cert and Key are the paths to the PEM client certificate and key,
+	// to authenticate with to targets that require mTLS.
+	Cert string `yaml:"cert,omitempty"`
+	Key  string `yaml:"key,omitempty"`
+	// InsecureSkipVerify disables verification of the target certificate. Only meant for devnets.
+	InsecureSkipVerify bool `yaml:"insecureSkipVerify,omitempty"`
+}
+
+// config loads the certificates, into a TLS config for connections to the target.
+// The digest covers the options and the loaded certificate files,
+// so certificates that are replaced in place can be told apart from unchanged ones.
+func (t *TargetTLS) config() (*tls.Config, [sha256.Size]byte, error) {
+	var digest [sha256.Size]byte
+	h := sha256.New()
+	// hash each part, so the boundaries between the parts are unambiguous
+	add := func(data []byte) {
+		part := sha256.Sum256(data)
+		h.Write(part[:])
+	}
+	if t.InsecureSkipVerify {
+		add([]byte{1})
+	} else {
+		add([]byte{0})
+	}
+	out := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+	}
+	if t.CA != "" {
+		data, err := os.ReadFile(t.CA)
+		if err != nil {
+			return nil, digest, fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+		pool, err := parseCertPool(data, t.CA)
+		if err != nil {
+			return nil, digest, err
+		}
+		out.RootCAs = pool
+		add(data)
+	} else {
+		add(nil)
+	}
+	if (t.Cert == "") != (t.Key == "") {
+		return nil, digest, errors.New("client cert and key must be configured together")
+	}
+	if t.Cert != "" {
+		certPEM, err := os.ReadFile(t.Cert)
+		if err != nil {
+			return nil, digest, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		keyPEM, err := os.ReadFile(t.Key)
+		if err != nil {
+			return nil, digest, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, digest, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		out.Certificates = []tls.Certificate{cert}
+		add(certPEM)
+		add(keyPEM)
+	}
+	h.Sum(digest[:0])
+	return out, digest, nil
+}
+
+// ServerTLSConfig loads the certificate to serve with.
+// If a client CA is given, clients must present a certificate signed by it (mTLS).
+func ServerTLSConfig(certPath, keyPath, clientCAPath string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load server certificate: %w", err)
+	}
+	out := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+	if clientCAPath != "" {
+		pool, err := loadCertPool(clientCAPath)
+		if err != nil {
+			return nil, err
+		}
+		out.ClientCAs = pool
+		out.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return out, nil
+}
+
+// loadCertPool reads a PEM bundle of CA certificates.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+	}
+	return parseCertPool(data, path)
+}
+
+// parseCertPool parses a PEM bundle of CA certificates, read from the path.
+func parseCertPool(data []byte, path string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in CA bundle %q", path)
+	}
+	return pool, nil
+}
+
+// newHTTPClient creates a client for HTTP targets, using the given TLS config.
+func newHTTPClient(tlsCfg *tls.Config) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsCfg
+	return &http.Client{Transport: transport}
+}
@@ -0,0 +1,244 @@
+package switcher
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/protolambda/websocket"
+)
+
+// testCert is a generated certificate, written to PEM files.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	// certPath and keyPath are the PEM files
+	certPath, keyPath string
+}
+
+// newTestCert generates a certificate for localhost, signed by the parent, or self-signed CA if the parent is nil.
+func newTestCert(t *testing.T, name string, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	out := &testCert{cert: cert, key: key,
+		certPath: filepath.Join(dir, name+".pem"), keyPath: filepath.Join(dir, name+"-key.pem")}
+	if err := os.WriteFile(out.certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(out.keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func (c *testCert) tlsCert(t *testing.T) tls.Certificate {
+	t.Helper()
+	out, err := tls.LoadX509KeyPair(c.certPath, c.keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestTLSTarget(t *testing.T) {
+	ca := newTestCert(t, "ca", nil)
+	client := newTestCert(t, "client", ca)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	target := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"jsonrpc":"2.0","id":1,"result":"tls"}`)
+	}))
+	target.TLS = &tls.Config{
+		Certificates: []tls.Certificate{newTestCert(t, "target", ca).tlsCert(t)},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	target.StartTLS()
+	t.Cleanup(target.Close)
+
+	for _, tc := range []struct {
+		name string
+		tls  *TargetTLS
+		ok   bool
+	}{
+		{"system roots", nil, false},
+		{"no client cert", &TargetTLS{CA: ca.certPath}, false},
+		{"mTLS", &TargetTLS{CA: ca.certPath, Cert: client.certPath, Key: client.keyPath}, true},
+		{"insecure", &TargetTLS{InsecureSkipVerify: true, Cert: client.certPath, Key: client.keyPath}, true},
+	} {
+		srv := startServer(t, &Config{
+			Targets: map[string]*Target{"t": {Endpoint: target.URL, TLS: tc.tls}},
+			Sources: map[string]*Source{"s": {}},
+			Routes:  map[string]string{"s": "t"},
+		})
+		resp := call(t, dialSource(t, srv, "/dial/s"), request("1", "x", ""))
+		if tc.ok {
+			expectResult(t, resp, "1", "tls")
+		} else if resp.Error == nil {
+			t.Errorf("%s: expected the target to be unreachable, got %s", tc.name, (&Envelope{Msg: *resp}).JSON())
+		}
+	}
+
+	for _, cfg := range []*Config{
+		{Targets: map[string]*Target{"t": {Endpoint: "ws://localhost", TLS: &TargetTLS{}}}},
+		{Targets: map[string]*Target{"t": {Endpoint: target.URL, TLS: &TargetTLS{Cert: client.certPath}}}},
+		{Targets: map[string]*Target{"t": {Endpoint: target.URL, TLS: &TargetTLS{CA: client.keyPath}}}},
+	} {
+		err := cfg.Check()
+		if err == nil {
+			err = cfg.Init()
+		}
+		if err == nil {
+			t.Errorf("expected TLS options %+v to be rejected", cfg.Targets["t"].TLS)
+		}
+	}
+}
+
+func TestTLSListener(t *testing.T) {
+	ca := newTestCert(t, "ca", nil)
+	server := newTestCert(t, "server", ca)
+	client := newTestCert(t, "client", ca)
+	tlsCfg, err := ServerTLSConfig(server.certPath, server.keyPath, ca.certPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(testLogger(t), "127.0.0.1:0", &Config{
+		Targets: map[string]*Target{"t": {Endpoint: startTarget(t)}},
+		Sources: map[string]*Source{"s": {}},
+		Routes:  map[string]string{"s": "t"},
+	}, tlsCfg)
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = srv.Close() })
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	post := func(certs ...tls.Certificate) (string, error) {
+		c := newHTTPClient(&tls.Config{RootCAs: pool, Certificates: certs})
+		resp, err := c.Post("https://"+srv.Address()+"/dial/s", "application/json",
+			strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"x"}`))
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		var out struct {
+			Result string `json:"result"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&out)
+		return out.Result, err
+	}
+	if res, err := post(client.tlsCert(t)); err != nil || res != "x:1" {
+		t.Fatalf("expected the client with certificate to be served, got %q: %v", res, err)
+	}
+	if _, err := post(); err == nil {
+		t.Fatal("expected the client without certificate to be rejected")
+	}
+	resp, err := http.Post("http://"+srv.Address()+"/dial/s", "application/json", strings.NewReader(`{}`))
+	if err == nil {
+		_ = resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			t.Fatal("expected plain HTTP to be rejected")
+		}
+	}
+}
+
+// A certificate that is replaced in place is loaded again on reload, and the target is reconnected with it.
+func TestTLSTargetRotation(t *testing.T) {
+	ca := newTestCert(t, "ca", nil)
+	var conns atomic.Int64
+	wsSrv := websocket.NewServer[*websocket.Connection](func(c *websocket.Connection, meta *websocket.ConnectionMetadata) (*websocket.Connection, error) {
+		conns.Add(1)
+		return c, nil
+	})
+	target := httptest.NewUnstartedServer(http.HandlerFunc(wsSrv.Handle))
+	target.TLS = &tls.Config{Certificates: []tls.Certificate{newTestCert(t, "target", ca).tlsCert(t)}}
+	target.StartTLS()
+	t.Cleanup(target.Close)
+
+	config := func() *Config {
+		return &Config{Targets: map[string]*Target{"t": {
+			Endpoint:  strings.Replace(target.URL, "https://", "wss://", 1),
+			KeepAlive: true,
+			TLS:       &TargetTLS{CA: ca.certPath},
+		}}}
+	}
+	srv := startServer(t, config())
+	eventually(t, func() bool { return conns.Load() == 1 })
+
+	// the same certificates do not interrupt the connection
+	if err := srv.Reload(config()); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := conns.Load(); n != 1 {
+		t.Fatalf("expected the connection to be kept, got %d connections", n)
+	}
+
+	// add another CA to the bundle, at the same path
+	data, err := os.ReadFile(ca.certPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := os.ReadFile(newTestCert(t, "other", nil).certPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(ca.certPath, append(data, other...), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Reload(config()); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, func() bool { return conns.Load() == 2 })
+}
@@ -3,7 +3,9 @@ package switcher
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"slices"
 
 	"github.com/ethereum/go-ethereum/log"
 	jsonrpc "github.com/protolambda/jsonrpc2"
@@ -14,22 +16,119 @@ import (
 type Envelope struct {
 	Ctx context.Context
 	Msg jsonrpc.Message
+
+	// Route the message travels on. Nil until the message enters a route.
+	Route *Route
+	// FromSource is true if the message travels from source to target,
+	// and false if it travels from target to source.
+	FromSource bool
+	// Request is the request in the message, or the request that is responded to, if known.
+	Request *jsonrpc.Request
+
+	// trace of the message, if the route captures messages
+	trace *captureTrace
+	// corrupt, if set, corrupts the message when it is written to the connection
+	corrupt *corruption
+	// settle, if set, passes the message on in the place it entered the current effect,
+	// or gives up that place if called with nil
+	settle func(em *Envelope)
+	// held are called when the request is dropped, or can no longer be answered,
+	// to give back what effects hold until the response, e.g. the token of a parallel effect
+	held []func()
+}
+
+// Method of the request, or of the request that is responded to.
+// Empty if the request is not known.
+func (en *Envelope) Method() string {
+	if en.Request == nil {
+		return ""
+	}
+	return en.Request.Method
+}
+
+// Respond short-circuits the request in the envelope:
+// the response travels back to where the request came from,
+// as if the other side of the route responded.
+func (en *Envelope) Respond(resp *jsonrpc.Message) {
+	if en.Route == nil {
+		return
+	}
+	en.record(CaptureAnswered)
+	en.settled()
+	en.Route.respond(en, resp)
+}
+
+// dropped records that an effect discarded the message, in the capture and metrics of the route.
+// If the message is a request of the source, or the response to it, its latency is no longer measured.
+func (en *Envelope) dropped() {
+	en.record(CaptureDropped)
+	en.observe(eventDropped)
+	en.settled()
+	en.release()
+	if en.Route != nil && en.Route.metrics != nil && !en.Msg.ID.IsNotification() &&
+		(en.Msg.Request != nil) == en.FromSource {
+		en.Route.stopRequestTime(en.Msg.ID)
+	}
+}
+
+// settled gives up the place of the message in the current effect,
+// so the messages behind it pass on, as the sub-effects discard the message, or hold it back on purpose.
+func (en *Envelope) settled() {
+	if en.settle != nil {
+		en.settle(nil)
+		en.settle = nil
+	}
+}
+
+// release gives back what effects hold for the request, as no response will pass them by.
+func (en *Envelope) release() {
+	for _, fn := range en.held {
+		fn()
+	}
+	en.held = nil
+}
+
+// record captures the outcome of the message, if the route captures messages.
+func (en *Envelope) record(outcome CaptureOutcome) {
+	if en.trace != nil {
+		en.trace.record(en, outcome)
+	}
+}
+
+// duplicate copies the envelope, so an effect can pass the message on twice.
+// The copy is traced separately from the original, as a message injected by the effect.
+func (en *Envelope) duplicate() *Envelope {
+	dup := *en
+	dup.settle = nil
+	dup.held = nil
+	if en.trace != nil {
+		dup.trace = newCaptureTrace(en.trace.files, en.trace.taps, en.trace.route, &dup, true)
+		dup.trace.effects = slices.Clone(en.trace.effects)
+	}
+	return &dup
 }
 
 func (en *Envelope) JSON() string {
-	out, err := json.Marshal(en.Msg)
+	out, err := json.Marshal(&en.Msg)
 	if err != nil {
 		return fmt.Sprintf("invalid: %v", err)
 	}
 	return string(out)
 }
 
+// UserConn is the connection of a user. The routes of the user end when it closes.
+type UserConn interface {
+	Close() error
+	CloseCtx() context.Context
+}
+
 type User struct {
 	name string
 
-	Conn *websocket.Connection
+	Conn UserConn
 	Meta *websocket.ConnectionMetadata
-	RPC  ws.JSONRPCConnection
+	// RPC is the message stream of the connection. Nil for HTTP users, which exchange messages per request.
+	RPC ws.JSONRPCConnection
 
 	log log.Logger
 
@@ -39,32 +138,54 @@ type User struct {
 	outwards chan *Envelope
 }
 
-func NewUser(log log.Logger, conn *websocket.Connection, meta *websocket.ConnectionMetadata, name string) *User {
+func NewUser(log log.Logger, conn *websocket.Connection, meta *websocket.ConnectionMetadata, name string, cfg *Source) *User {
+	return newStreamUser(log, conn, ws.NewJSONRPC(conn), meta, name, cfg)
+}
+
+// newStreamUser creates a user that exchanges messages over a connection, e.g. a websocket or unix socket.
+func newStreamUser(log log.Logger, conn Conn, rpc ws.JSONRPCConnection, meta *websocket.ConnectionMetadata, name string, cfg *Source) *User {
 	u := &User{
+		name:     name,
 		Conn:     conn,
 		Meta:     meta,
-		RPC:      ws.NewJSONRPC(conn),
+		RPC:      rpc,
 		log:      log,
+		cfg:      cfg,
 		inwards:  make(chan *Envelope, 100),
 		outwards: make(chan *Envelope, 100),
 	}
-	setupClientLoops(u.log.New("user", u.Meta.RemoteAddr), u.Conn, u.RPC, u.Meta.Context, u.inwards, u.outwards)
+	setupClientLoops(u.log.New("user", u.Meta.RemoteAddr), conn, u.RPC, u.Meta.Context, u.inwards, u.outwards)
 	return u
 }
 
+// newHTTPUser creates a user for a single HTTP request.
+// Messages are passed through the inwards and outwards channels by the HTTP handler.
+func newHTTPUser(log log.Logger, conn UserConn, meta *websocket.ConnectionMetadata, name string, cfg *Source) *User {
+	return &User{
+		name:     name,
+		Conn:     conn,
+		Meta:     meta,
+		log:      log,
+		cfg:      cfg,
+		inwards:  make(chan *Envelope, 100),
+		outwards: make(chan *Envelope, 100),
+	}
+}
+
 // Close stops a user by closing its underlying connection.
 // The connection may be closed externally; the user will shutdown itself accordingly.
 func (u *User) Close() error {
 	return u.Conn.Close()
 }
 
-type Messenger interface {
-	websocket.Messenger
+// Conn is a connection that JSON-RPC messages are exchanged over, e.g. a websocket or unix socket.
+type Conn interface {
+	UserConn
+	Err() error
 	CloseWithCause(cause error)
-	CloseCtx() context.Context
 }
 
-func setupClientLoops(log log.Logger, conn Messenger, rpc ws.JSONRPCConnection,
+func setupClientLoops(log log.Logger, conn Conn, rpc ws.JSONRPCConnection,
 	msgCtx context.Context, inwards, outwards chan *Envelope) {
 	go func() {
 		defer func() {
@@ -84,8 +205,8 @@ func setupClientLoops(log log.Logger, conn Messenger, rpc ws.JSONRPCConnection,
 				if !ok {
 					return
 				}
-				log.Info("writing message", "msg", envelope.JSON())
-				if err := rpc.Write(&envelope.Msg); err != nil {
+				log.Debug("writing message", "msg", envelope.JSON())
+				if err := writeEnvelope(rpc, envelope); err != nil {
 					if conn.Err() != nil {
 						log.Warn("cannot write to broken connection",
 							"err", err, "connectionErr", conn.Err())
@@ -114,6 +235,11 @@ func setupClientLoops(log log.Logger, conn Messenger, rpc ws.JSONRPCConnection,
 					// connection issue / close
 					return
 				}
+				if !errors.Is(err, ws.ErrInvalidMessage) {
+					// the underlying connection broke, but was not closed yet
+					conn.CloseWithCause(err)
+					return
+				}
 				log.Error("failed to decode message", "err", err)
 				continue
 			}
@@ -126,7 +252,7 @@ func setupClientLoops(log log.Logger, conn Messenger, rpc ws.JSONRPCConnection,
 				return
 			case inwards <- e:
 			}
-			log.Info("reading message", "msg", e.JSON())
+			log.Debug("reading message", "msg", e.JSON())
 		}
 	}()
 }
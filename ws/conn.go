@@ -0,0 +1,127 @@
+package ws
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	gws "github.com/gorilla/websocket"
+	"github.com/protolambda/websocket"
+)
+
+const (
+	readBuffer         = 1024
+	writeBuffer        = 1024
+	writeTimeout       = 10 * time.Second
+	closeMessageExpiry = 5 * time.Second
+)
+
+// DialOptions customizes how a websocket connection is dialed.
+type DialOptions struct {
+	// Header is added to the upgrade request, e.g. for authentication.
+	Header http.Header
+	// TLSConfig is used for wss:// endpoints. If nil, the default TLS config is used.
+	TLSConfig *tls.Config
+}
+
+// Conn is a client-side websocket connection, like the websocket.Connection of protolambda/websocket,
+// but dialed with DialOptions.
+type Conn struct {
+	conn *gws.Conn
+
+	readLock  sync.Mutex
+	writeLock sync.Mutex
+
+	closer   sync.Once
+	closeCtx context.Context
+	cancel   context.CancelCauseFunc
+}
+
+var _ websocket.Messenger = (*Conn)(nil)
+
+// Dial connects to the websocket endpoint.
+func Dial(ctx context.Context, endpoint string, opts DialOptions) (*Conn, error) {
+	dialer := &gws.Dialer{
+		Proxy:             http.ProxyFromEnvironment,
+		ReadBufferSize:    readBuffer,
+		WriteBufferSize:   writeBuffer,
+		EnableCompression: true,
+		TLSClientConfig:   opts.TLSConfig,
+	}
+	header := opts.Header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	conn, resp, err := dialer.DialContext(ctx, endpoint, header)
+	if resp != nil {
+		defer resp.Body.Close() // note: this becomes a No-op closer if successfully upgraded to websocket.
+	}
+	if err != nil {
+		if resp != nil {
+			err = fmt.Errorf("response status %s, err: %w", resp.Status, err)
+		}
+		return nil, fmt.Errorf("failed to dial websocket: %w", err)
+	}
+	closeCtx, cancel := context.WithCancelCause(context.Background())
+	return &Conn{
+		conn:     conn,
+		closeCtx: closeCtx,
+		cancel:   cancel,
+	}, nil
+}
+
+// CloseCtx returns the context that terminates when the connection closed.
+func (c *Conn) CloseCtx() context.Context {
+	return c.closeCtx
+}
+
+// Err is a shorthand for the Cause error of the CloseCtx.
+func (c *Conn) Err() error {
+	return context.Cause(c.closeCtx)
+}
+
+// Close closes the connection, if it's not already closed.
+func (c *Conn) Close() error {
+	c.CloseWithCause(context.Canceled)
+	return nil
+}
+
+// CloseWithCause closes the connection, if it's not already closed, with the given error as cause.
+// If the connection is closed on purpose, a close message is sent first.
+func (c *Conn) CloseWithCause(cause error) {
+	c.closer.Do(func() {
+		// cancel first, so readers and writers know the connection closed on purpose
+		c.cancel(cause)
+		if errors.Is(cause, context.Canceled) {
+			_ = c.conn.WriteControl(gws.CloseMessage,
+				gws.FormatCloseMessage(gws.CloseNormalClosure, "bye"),
+				time.Now().Add(closeMessageExpiry))
+		}
+		_ = c.conn.Close()
+	})
+}
+
+func (c *Conn) Read() (messageType websocket.MessageType, p []byte, err error) {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+	typ, p, err := c.conn.ReadMessage()
+	if err != nil && c.Err() == nil {
+		c.CloseWithCause(err)
+	}
+	return websocket.MessageType(typ), p, err
+}
+
+func (c *Conn) Write(messageType websocket.MessageType, data []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	_ = c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	err := c.conn.WriteMessage(int(messageType), data)
+	if gws.IsUnexpectedCloseError(err) {
+		c.CloseWithCause(err)
+	}
+	return err
+}
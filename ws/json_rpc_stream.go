@@ -0,0 +1,131 @@
+package ws
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/protolambda/jsonrpc2"
+)
+
+// StreamJSONRPC represents a JSON RPC connection over a byte stream, such as a unix socket (IPC).
+// Messages are written newline-delimited.
+// Incoming messages may be delimited by whitespace, or not at all, like geth accepts on IPC.
+// Incoming batch-requests are broken apart into sequential reads.
+type StreamJSONRPC struct {
+	wLock sync.Mutex
+
+	rLock sync.Mutex
+	dec   *json.Decoder
+	batch []jsonrpc.Message
+
+	conn net.Conn
+
+	closer   sync.Once
+	closeCtx context.Context
+	cancel   context.CancelCauseFunc
+}
+
+func NewStreamJSONRPC(conn net.Conn) *StreamJSONRPC {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	return &StreamJSONRPC{
+		dec:      json.NewDecoder(conn),
+		conn:     conn,
+		closeCtx: ctx,
+		cancel:   cancel,
+	}
+}
+
+// CloseCtx returns the context that terminates when the connection closed.
+func (s *StreamJSONRPC) CloseCtx() context.Context {
+	return s.closeCtx
+}
+
+// Err is a shorthand for the Cause error of the CloseCtx.
+func (s *StreamJSONRPC) Err() error {
+	return context.Cause(s.closeCtx)
+}
+
+// Close closes the connection, if it's not already closed.
+func (s *StreamJSONRPC) Close() error {
+	s.CloseWithCause(context.Canceled)
+	return nil
+}
+
+// CloseWithCause closes the connection, if it's not already closed, with the given error as cause.
+func (s *StreamJSONRPC) CloseWithCause(cause error) {
+	s.closer.Do(func() {
+		// cancel first, so readers and writers know the connection closed on purpose
+		s.cancel(cause)
+		_ = s.conn.Close()
+	})
+}
+
+// Write to the RPC, safe for concurrent use
+func (s *StreamJSONRPC) Write(msg *jsonrpc.Message) error {
+	s.wLock.Lock()
+	defer s.wLock.Unlock()
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to marshal JSON RPC message: %w", err)
+	}
+	data = append(data, '\n')
+	if _, err := s.conn.Write(data); err != nil {
+		return fmt.Errorf("failed to write JSON RPC message: %w", err)
+	}
+	return nil
+}
+
+// WriteRaw writes the frame, newline-delimited, safe for concurrent use
+func (s *StreamJSONRPC) WriteRaw(data []byte) error {
+	s.wLock.Lock()
+	defer s.wLock.Unlock()
+	frame := make([]byte, 0, len(data)+1)
+	frame = append(append(frame, data...), '\n')
+	if _, err := s.conn.Write(frame); err != nil {
+		return fmt.Errorf("failed to write raw JSON RPC frame: %w", err)
+	}
+	return nil
+}
+
+// Read from the RPC, safe for concurrent use.
+// Errors that break the stream are returned as-is,
+// messages that are valid JSON, but not a valid JSON RPC message, wrap ErrInvalidMessage.
+func (s *StreamJSONRPC) Read(dest *jsonrpc.Message) error {
+	s.rLock.Lock()
+	defer s.rLock.Unlock()
+
+	// dequeue batch-element, if any is left
+	if len(s.batch) > 0 {
+		*dest = s.batch[0]
+		s.batch = s.batch[1:]
+		return nil
+	}
+	var raw json.RawMessage
+	if err := s.dec.Decode(&raw); err != nil {
+		// the decoder cannot recover from a broken stream
+		return err
+	}
+	raw = bytes.TrimLeft(raw, " \t\r\n")
+	if len(raw) > 0 && raw[0] == '[' {
+		var x []jsonrpc.Message
+		if err := json.Unmarshal(raw, &x); err != nil {
+			return fmt.Errorf("%w: failed to decode JSON RPC batch: %w", ErrInvalidMessage, err)
+		}
+		if len(x) == 0 {
+			return fmt.Errorf("%w: empty batch", ErrInvalidMessage)
+		}
+		*dest = x[0]
+		s.batch = x[1:]
+		return nil
+	}
+	if err := json.Unmarshal(raw, dest); err != nil {
+		return fmt.Errorf("%w: failed to decode JSON RPC message: %w", ErrInvalidMessage, err)
+	}
+	return nil
+}
+
+var _ JSONRPCConnection = (*StreamJSONRPC)(nil)
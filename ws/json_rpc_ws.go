@@ -3,6 +3,7 @@ package ws
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"sync"
 
@@ -10,8 +11,15 @@ import (
 	"github.com/protolambda/websocket"
 )
 
+// ErrInvalidMessage is wrapped by read errors of messages that could not be decoded.
+// The connection itself may still be healthy after such an error.
+var ErrInvalidMessage = errors.New("invalid message")
+
 type JSONRPCConnection interface {
 	Write(msg *jsonrpc.Message) error
+	// WriteRaw writes a frame as-is, without checking that it is a valid JSON RPC message,
+	// e.g. to test how the other side handles malformed messages.
+	WriteRaw(data []byte) error
 	Read(dest *jsonrpc.Message) error
 }
 
@@ -59,6 +67,16 @@ func (w *JSONRPC) Write(msg *jsonrpc.Message) error {
 	return nil
 }
 
+// WriteRaw writes the frame as text message, safe for concurrent use
+func (w *JSONRPC) WriteRaw(data []byte) error {
+	w.wLock.Lock()
+	defer w.wLock.Unlock()
+	if err := w.ws.Write(websocket.TextMessage, data); err != nil {
+		return fmt.Errorf("failed to write raw JSON RPC frame: %w", err)
+	}
+	return nil
+}
+
 // Read from the RPC, safe for concurrent use
 func (w *JSONRPC) Read(dest *jsonrpc.Message) error {
 	w.rLock.Lock()
@@ -77,13 +95,13 @@ func (w *JSONRPC) Read(dest *jsonrpc.Message) error {
 			return err
 		}
 		if typ != websocket.TextMessage {
-			return fmt.Errorf("unexpected message: %s", typ)
+			return fmt.Errorf("%w: unexpected message type: %s", ErrInvalidMessage, typ)
 		}
 		var x []jsonrpc.Message
 		if err := json.Unmarshal(data, &x); err != nil {
 			// not a batch
 			if err := json.Unmarshal(data, dest); err != nil {
-				return fmt.Errorf("failed to decode JSON RPC message: %w", err)
+				return fmt.Errorf("%w: failed to decode JSON RPC message: %w", ErrInvalidMessage, err)
 			}
 			return nil
 		} else {